@@ -5,6 +5,7 @@ go 1.22
 require (
 	github.com/ClickHouse/clickhouse-go/v2 v2.23.0
 	github.com/DATA-DOG/go-sqlmock v1.5.2
+	github.com/gogo/protobuf v1.3.2
 	github.com/jaegertracing/jaeger v1.56.0
 	github.com/remychantenay/slog-otel v1.3.0
 	github.com/spf13/viper v1.18.2
@@ -27,7 +28,6 @@ require (
 	github.com/go-faster/errors v0.7.1 // indirect
 	github.com/go-logr/logr v1.4.1 // indirect
 	github.com/go-logr/stdr v1.2.2 // indirect
-	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/golang/protobuf v1.5.4 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/grpc-ecosystem/grpc-gateway/v2 v2.19.1 // indirect
@@ -5,11 +5,13 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
 	store "github.com/nextrevision/jaeger-otel-clickhouse-backend/store"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/attributes"
 	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/clickhousestore"
 	slogotel "github.com/remychantenay/slog-otel"
 	"github.com/spf13/viper"
@@ -23,11 +25,18 @@ import (
 	"google.golang.org/grpc"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+// Time given to the tracer provider to export the remaining spans on shutdown
+const tracerShutdownTimeout = 5 * time.Second
+
 var tracer trace.Tracer
 
 func newExporter(ctx context.Context, enabled bool) (sdktrace.SpanExporter, error) {
@@ -109,8 +118,48 @@ func initDB(cfg *store.Config) (*sql.DB, error) {
 	return conn, nil
 }
 
+// newArchive creates the archive table if it does not exist and returns the archive
+// storage serving it
+func newArchive(ctx context.Context, cfg *store.Config, attributeTypes *attributes.Types, queryLimits clickhousestore.QueryLimits, db *sql.DB) (*store.Archive, error) {
+	archiveWriter := clickhousestore.NewArchiveWriter(cfg.DBTable, cfg.ArchiveTable, queryLimits, db, tracer)
+	if err := archiveWriter.Init(ctx); err != nil {
+		return nil, fmt.Errorf("unable to create archive table: %w", err)
+	}
+
+	archiveStore := clickhousestore.New(
+		cfg.ArchiveTable,
+		cfg.PadTraceID,
+		db,
+		tracer,
+		clickhousestore.WithAttributeTypes(attributeTypes),
+		clickhousestore.WithQueryLimits(queryLimits),
+	)
+	if _, err := archiveStore.DetectSchema(ctx); err != nil {
+		return nil, fmt.Errorf("unable to detect archive table schema: %w", err)
+	}
+
+	return store.NewArchive(store.New(
+		archiveStore,
+		archiveWriter,
+		tracer,
+		store.WithAttributeTypes(attributeTypes),
+	)), nil
+}
+
 func main() {
-	ctx := context.Background()
+	// Exit with an error status if setting up or serving failed, once all deferred cleanup
+	// has run
+	var failed bool
+	defer func() {
+		if failed {
+			os.Exit(1)
+		}
+	}()
+
+	// Cancel the context on termination, which stops background jobs and starts draining
+	// the gRPC server
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	// Set structured contextual logger
 	slog.SetDefault(slog.New(slogotel.OtelHandler{
@@ -161,8 +210,16 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Handle shutdown properly so nothing leaks.
-	defer func() { _ = tp.Shutdown(ctx) }()
+	// Handle shutdown properly so nothing leaks. Deferred calls run in reverse order, so the
+	// tracer provider exports the spans of closing the stores and the database last. Failures
+	// from here on return rather than exit, so that the deferred calls run.
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), tracerShutdownTimeout)
+		defer cancel()
+		if err := tp.Shutdown(shutdownCtx); err != nil {
+			logger.ErrorContext(shutdownCtx, "unable to shut down trace provider", "error", err)
+		}
+	}()
 
 	otel.SetTracerProvider(tp)
 	tracer = tp.Tracer("jaeger-otel-clickhouse-backend")
@@ -171,34 +228,265 @@ func main() {
 	db, err := initDB(cfg)
 	if err != nil {
 		logger.ErrorContext(ctx, "unable to create clickhouse connection", "error", err)
-		os.Exit(1)
+		failed = true
+		return
 	}
 	defer func() { _ = db.Close() }()
 
-	clickhouseStore := clickhousestore.New(cfg.DBTable, cfg.PadTraceID, db, tracer)
+	customAttributeTypes, err := attributes.ParseTypes(cfg.AttributeTypes)
+	if err != nil {
+		logger.ErrorContext(ctx, "unable to parse attribute types", "error", err)
+		failed = true
+		return
+	}
+	attributeTypes := attributes.NewTypes(customAttributeTypes)
+
+	queryLimits := clickhousestore.QueryLimits{
+		MaxExecutionTime:    time.Second * time.Duration(cfg.QueryMaxExecutionTimeSeconds),
+		MaxRowsToRead:       cfg.QueryMaxRowsToRead,
+		MaxBytesToRead:      cfg.QueryMaxBytesToRead,
+		TimeoutOverflowMode: cfg.QueryTimeoutOverflowMode,
+	}
+
+	clickhouseOptions := []clickhousestore.Option{
+		clickhousestore.WithAttributeTypes(attributeTypes),
+		clickhousestore.WithQueryLimits(queryLimits),
+	}
+
+	if cfg.TraceIDTsEnabled {
+		clickhouseOptions = append(clickhouseOptions, clickhousestore.WithTraceIDTsTable(cfg.TraceIDTsTable))
+	}
+
+	// Background jobs stop when the context is cancelled and are waited for on shutdown,
+	// including when setting up fails after some of them have started
+	var background sync.WaitGroup
+	defer func() {
+		stop()
+		background.Wait()
+	}()
+
+	// Start building service dependencies in the background
+	if cfg.DependenciesEnabled {
+		dependencyBuilder := clickhousestore.NewDependencyBuilder(
+			cfg.DBTable,
+			cfg.DependenciesTable,
+			time.Second*time.Duration(cfg.DependenciesIntervalSeconds),
+			time.Second*time.Duration(cfg.DependenciesBucketSeconds),
+			time.Second*time.Duration(cfg.DependenciesLookbackSeconds),
+			time.Second*time.Duration(cfg.DependenciesLagSeconds),
+			time.Second*time.Duration(cfg.DependenciesParentWindowSeconds),
+			db,
+			tracer,
+		)
+
+		if err := dependencyBuilder.Init(ctx); err != nil {
+			logger.ErrorContext(ctx, "unable to create dependencies table", "error", err)
+			failed = true
+			return
+		}
+
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			dependencyBuilder.Run(ctx)
+		}()
+
+		clickhouseOptions = append(clickhouseOptions, clickhousestore.WithDependenciesTable(cfg.DependenciesTable, time.Second*time.Duration(cfg.DependenciesBucketSeconds)))
+	}
+
+	// Aggregate span metrics into the rollup table as spans are inserted
+	if cfg.MetricsRollupEnabled {
+		metricsRollup := clickhousestore.NewMetricsRollup(cfg.DBTable, cfg.MetricsRollupTable, queryLimits, db, tracer)
+
+		if err := metricsRollup.Init(ctx); err != nil {
+			logger.ErrorContext(ctx, "unable to create metrics rollup table", "error", err)
+			failed = true
+			return
+		}
+
+		clickhouseOptions = append(clickhouseOptions, clickhousestore.WithMetricsRollupTable(cfg.MetricsRollupTable))
+	}
+
+	clickhouseStore := clickhousestore.New(cfg.DBTable, cfg.PadTraceID, db, tracer, clickhouseOptions...)
+
+	// Detect the schema of the spans table to fail fast when it is incompatible
+	schema, err := clickhouseStore.DetectSchema(ctx)
+	if err != nil {
+		logger.ErrorContext(ctx, "unable to detect table schema", "error", err)
+		failed = true
+		return
+	}
+	logger.InfoContext(ctx, "detected table schema", "table", cfg.DBTable, "version", schema.Version)
+
+	clickhouseWriter := clickhousestore.NewWriter(
+		cfg.DBTable,
+		int(cfg.WriterBatchSize),
+		time.Millisecond*time.Duration(cfg.WriterFlushIntervalMillis),
+		db,
+		tracer,
+	)
+	clickhouseWriter.UseSchema(schema)
+
+	// Flush buffered spans on shutdown within the cleanup time, leaving the rest of it for
+	// exporting the traces of the backend
+	flushTimeout := time.Second*time.Duration(cfg.ShutdownCleanupSeconds) - tracerShutdownTimeout
+	if flushTimeout < time.Second {
+		flushTimeout = time.Second
+	}
+	clickhouseWriter.SetCloseTimeout(flushTimeout)
 
 	// Create new storeBackend
-	storeBackend := store.New(clickhouseStore, tracer)
+	storeBackend := store.New(
+		clickhouseStore,
+		clickhouseWriter,
+		tracer,
+		store.WithAttributeTypes(attributeTypes),
+		store.WithProgressiveSearch(store.ProgressiveSearch{
+			Steps:         int(cfg.ProgressiveSearchSteps),
+			InitialWindow: time.Second * time.Duration(cfg.ProgressiveSearchInitialWindowSeconds),
+			TimeBudget:    time.Millisecond * time.Duration(cfg.SearchTimeBudgetMillis),
+		}),
+		store.WithAllServicesMaxRange(time.Second*time.Duration(cfg.SearchAllServicesMaxRangeSeconds)),
+		store.WithDurationScope(store.Scope(cfg.SearchDurationScope)),
+		store.WithMatchScope(store.Scope(cfg.SearchMatchScope)),
+	)
+	defer func() {
+		if err := storeBackend.Close(); err != nil {
+			logger.ErrorContext(ctx, "unable to close store", "error", err)
+		}
+	}()
+
+	// Serve archived traces from the archive table
+	var archive shared.ArchiveStoragePlugin
+	if cfg.ArchiveEnabled {
+		archiveBackend, err := newArchive(ctx, cfg, attributeTypes, queryLimits, db)
+		if err != nil {
+			logger.ErrorContext(ctx, "unable to set up archive storage", "error", err)
+			failed = true
+			return
+		}
+		defer func() {
+			if err := archiveBackend.Close(); err != nil {
+				logger.ErrorContext(ctx, "unable to close archive storage", "error", err)
+			}
+		}()
+
+		archive = archiveBackend
+	}
 
 	// Register store backend
-	handler := shared.NewGRPCHandlerWithPlugins(storeBackend, nil, storeBackend)
+	handler := shared.NewGRPCHandlerWithPlugins(storeBackend, archive, storeBackend)
 
 	// Start gRPC server
 	lis, err := net.Listen("tcp", ":14482")
 	if err != nil {
 		logger.ErrorContext(ctx, "failed to listen", "error", err)
+		failed = true
+		return
 	}
 
 	server := grpc.NewServer()
 	err = handler.Register(server)
 	if err != nil {
 		logger.ErrorContext(ctx, "unable to register server with grpc handler", "error", err)
-		os.Exit(1)
+		failed = true
+		return
+	}
+
+	// Serve span metrics through the metrics query API of Jaeger Query, for clients calling
+	// the backend directly, and through the Prometheus query API, which Jaeger Query reads
+	// the metrics of the "Monitor" tab from
+	var metricsServer *http.Server
+	if cfg.MetricsQueryEnabled {
+		metricsReader := store.NewMetricsReader(clickhouseStore, tracer)
+		store.NewMetricsQueryServer(metricsReader).Register(server)
+
+		metricsServer = &http.Server{
+			Addr:              fmt.Sprintf(":%d", cfg.MetricsQueryPort),
+			Handler:           store.NewPrometheusAPI(metricsReader).Handler(),
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+	}
+
+	// Report health through the gRPC health service and HTTP, where readiness reflects
+	// periodic checks of Clickhouse
+	health := store.NewHealth(db, clickhouseStore, time.Second*time.Duration(cfg.HealthCheckIntervalSeconds))
+	health.Register(server)
+
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		health.Run(ctx)
+	}()
+
+	healthServer := &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.HealthPort),
+		Handler:           health.Handler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	serveErr := make(chan error, 3)
+	go func() {
+		health.SetLive(true)
+		err := server.Serve(lis)
+		health.SetLive(false)
+		serveErr <- err
+	}()
+	go func() {
+		if err := healthServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- err
+		}
+	}()
+	if metricsServer != nil {
+		go func() {
+			if err := metricsServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				serveErr <- err
+			}
+		}()
 	}
 
-	logger.InfoContext(ctx, "server listening", "address", lis.Addr().String())
-	if err := server.Serve(lis); err != nil {
+	logger.InfoContext(ctx, "server listening", "address", lis.Addr().String(), "healthAddress", healthServer.Addr)
+	select {
+	case err := <-serveErr:
 		logger.ErrorContext(ctx, "failed to serve", "error", err)
-		os.Exit(1)
+		failed = true
+	case <-ctx.Done():
+	}
+
+	// Restore the default behavior of signals, so that a second signal terminates at once,
+	// and stop background jobs when shutting down after a failure to serve
+	stop()
+
+	// Stop accepting requests and wait for in-flight requests to complete. Requests still
+	// running after the drain timeout are cancelled, which cancels their Clickhouse queries.
+	drainTimeout := time.Second * time.Duration(cfg.ShutdownDrainTimeoutSeconds)
+	logger.InfoContext(ctx, "shutting down server", "drainTimeout", drainTimeout.String())
+	health.Shutdown()
+
+	drained := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(drainTimeout):
+		logger.WarnContext(ctx, "drain timeout exceeded, cancelling in-flight requests")
+		server.Stop()
+		<-drained
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := healthServer.Shutdown(shutdownCtx); err != nil {
+		logger.ErrorContext(shutdownCtx, "unable to shut down health server", "error", err)
+	}
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+			logger.ErrorContext(shutdownCtx, "unable to shut down metrics server", "error", err)
+		}
 	}
+
+	logger.InfoContext(ctx, "server stopped")
 }
@@ -0,0 +1,28 @@
+package store
+
+import (
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// Archive serves a Store of the archive table as the archive storage of Jaeger, which
+// Jaeger Query writes the spans of a trace to when it is archived, and reads traces from
+// when they are not found in the primary storage.
+type Archive struct {
+	store *Store
+}
+
+func NewArchive(store *Store) *Archive {
+	return &Archive{store: store}
+}
+
+func (a *Archive) ArchiveSpanReader() spanstore.Reader {
+	return a.store
+}
+
+func (a *Archive) ArchiveSpanWriter() spanstore.Writer {
+	return a.store
+}
+
+func (a *Archive) Close() error {
+	return a.store.Close()
+}
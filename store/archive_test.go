@@ -0,0 +1,41 @@
+package store
+
+import (
+	"context"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/clickhousestore"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace/noop"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	mockWriter := clickhousestore.NewMockClickhouseWriter()
+	tracer := noop.Tracer{}
+
+	archive := NewArchive(New(clickhousestore.NewMockClickhouseReader(2), mockWriter, tracer))
+	ctx := context.Background()
+
+	traceID, err := model.TraceIDFromString(clickhousestore.TestDataTraceIDOne)
+	assert.NoError(t, err)
+
+	trace, err := archive.ArchiveSpanReader().GetTrace(ctx, traceID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(trace.Spans))
+
+	for _, span := range trace.Spans {
+		assert.NoError(t, archive.ArchiveSpanWriter().WriteSpan(ctx, span))
+	}
+
+	assert.Equal(t, 2, len(mockWriter.Spans))
+	for i, span := range trace.Spans {
+		assert.Equal(t, fullTraceIDString(traceID), mockWriter.Spans[i].TraceID)
+		assert.Equal(t, span.SpanID.String(), mockWriter.Spans[i].SpanID)
+		assert.Equal(t, span.OperationName, mockWriter.Spans[i].SpanName)
+		assert.Equal(t, span.Process.ServiceName, mockWriter.Spans[i].ServiceName)
+		assert.Equal(t, span.StartTime.UnixNano(), mockWriter.Spans[i].Timestamp.UnixNano())
+	}
+
+	assert.NoError(t, archive.Close())
+	assert.True(t, mockWriter.Closed)
+}
@@ -0,0 +1,126 @@
+package attributes
+
+import (
+	"fmt"
+	"github.com/jaegertracing/jaeger/model"
+	"strconv"
+	"strings"
+)
+
+// Type is the type of an attribute value. The OpenTelemetry Clickhouse exporter stores
+// every attribute value as a string, so types are inferred from attribute keys.
+type Type string
+
+const (
+	TypeString  Type = "string"
+	TypeInt64   Type = "int64"
+	TypeFloat64 Type = "float64"
+	TypeBool    Type = "bool"
+)
+
+// defaultTypes contains non-string attributes defined by the OpenTelemetry semantic
+// conventions, including keys of older versions still emitted by instrumentations.
+var defaultTypes = map[string]Type{
+	"http.status_code":                      TypeInt64,
+	"http.response.status_code":             TypeInt64,
+	"http.request_content_length":           TypeInt64,
+	"http.response_content_length":          TypeInt64,
+	"http.request.body.size":                TypeInt64,
+	"http.response.body.size":               TypeInt64,
+	"http.resend_count":                     TypeInt64,
+	"http.request.resend_count":             TypeInt64,
+	"net.peer.port":                         TypeInt64,
+	"net.host.port":                         TypeInt64,
+	"net.sock.peer.port":                    TypeInt64,
+	"net.sock.host.port":                    TypeInt64,
+	"server.port":                           TypeInt64,
+	"client.port":                           TypeInt64,
+	"network.peer.port":                     TypeInt64,
+	"network.local.port":                    TypeInt64,
+	"rpc.grpc.status_code":                  TypeInt64,
+	"db.redis.database_index":               TypeInt64,
+	"messaging.batch.message_count":         TypeInt64,
+	"messaging.message.body.size":           TypeInt64,
+	"messaging.kafka.destination.partition": TypeInt64,
+	"messaging.kafka.message.offset":        TypeInt64,
+	"messaging.kafka.message.tombstone":     TypeBool,
+	"thread.id":                             TypeInt64,
+	"code.lineno":                           TypeInt64,
+	"process.pid":                           TypeInt64,
+	"process.parent_pid":                    TypeInt64,
+	"exception.escaped":                     TypeBool,
+}
+
+// Types resolves the type of attributes by key.
+type Types struct {
+	types map[string]Type
+}
+
+// NewTypes returns the types of the semantic conventions, extended or overridden by the
+// given custom types.
+func NewTypes(custom map[string]Type) *Types {
+	types := make(map[string]Type, len(defaultTypes)+len(custom))
+	for key, t := range defaultTypes {
+		types[key] = t
+	}
+	for key, t := range custom {
+		types[key] = t
+	}
+	return &Types{types: types}
+}
+
+// ParseTypes parses a list of "key=type" entries into custom attribute types.
+func ParseTypes(entries []string) (map[string]Type, error) {
+	types := make(map[string]Type, len(entries))
+	for _, entry := range entries {
+		key, value, ok := strings.Cut(entry, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid attribute type %q, expected key=type", entry)
+		}
+
+		t, err := ParseType(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		types[key] = t
+	}
+	return types, nil
+}
+
+// ParseType parses the name of a type.
+func ParseType(name string) (Type, error) {
+	switch t := Type(strings.ToLower(name)); t {
+	case TypeString, TypeInt64, TypeFloat64, TypeBool:
+		return t, nil
+	}
+	return "", fmt.Errorf("invalid attribute type %q, expected one of %s, %s, %s or %s", name, TypeString, TypeInt64, TypeFloat64, TypeBool)
+}
+
+// Lookup returns the type of an attribute, which is a string unless known otherwise.
+func (t *Types) Lookup(key string) Type {
+	if typ, ok := t.types[key]; ok {
+		return typ
+	}
+	return TypeString
+}
+
+// KeyValue converts an attribute into a Jaeger tag of its type. Values that cannot be
+// parsed as their type are kept as strings rather than being lost.
+func (t *Types) KeyValue(key string, value string) model.KeyValue {
+	switch t.Lookup(key) {
+	case TypeInt64:
+		if v, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return model.Int64(key, v)
+		}
+	case TypeFloat64:
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			return model.Float64(key, v)
+		}
+	case TypeBool:
+		if v, err := strconv.ParseBool(value); err == nil {
+			return model.Bool(key, v)
+		}
+	}
+	return model.String(key, value)
+}
@@ -0,0 +1,48 @@
+package attributes
+
+import (
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTypes_KeyValue(t *testing.T) {
+	types := NewTypes(map[string]Type{
+		"custom.ratio":     TypeFloat64,
+		"custom.enabled":   TypeBool,
+		"http.status_code": TypeString,
+	})
+
+	tests := []struct {
+		name  string
+		key   string
+		value string
+		want  model.KeyValue
+	}{
+		{name: "unknown key", key: "http.method", value: "GET", want: model.String("http.method", "GET")},
+		{name: "default int64", key: "server.port", value: "8080", want: model.Int64("server.port", 8080)},
+		{name: "default bool", key: "exception.escaped", value: "false", want: model.Bool("exception.escaped", false)},
+		{name: "custom float64", key: "custom.ratio", value: "0.5", want: model.Float64("custom.ratio", 0.5)},
+		{name: "custom bool", key: "custom.enabled", value: "true", want: model.Bool("custom.enabled", true)},
+		{name: "custom overrides default", key: "http.status_code", value: "500", want: model.String("http.status_code", "500")},
+		{name: "unparsable value", key: "server.port", value: "http", want: model.String("server.port", "http")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, types.KeyValue(tt.key, tt.value))
+		})
+	}
+}
+
+func TestParseTypes(t *testing.T) {
+	got, err := ParseTypes([]string{"custom.ratio=float64", " custom.enabled = BOOL "})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]Type{"custom.ratio": TypeFloat64, "custom.enabled": TypeBool}, got)
+
+	_, err = ParseTypes([]string{"custom.ratio"})
+	assert.Error(t, err)
+
+	_, err = ParseTypes([]string{"custom.ratio=decimal"})
+	assert.Error(t, err)
+}
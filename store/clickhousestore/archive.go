@@ -0,0 +1,177 @@
+package clickhousestore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Jaeger Query writes the spans of an archived trace one after another, so the spans
+// following the first one within this time belong to a trace that has just been copied
+const archivedTraceTTL = time.Minute
+
+// ArchiveWriter archives traces by copying their rows from the spans table into an archive
+// table with the same columns, which keeps spans beyond the TTL of the spans table and
+// keeps the rows exactly as the exporter stored them. Archived spans are read with a
+// ClickhouseReader of the archive table.
+type ArchiveWriter struct {
+	table         string
+	archiveTable  string
+	querySettings clickhouse.Settings
+	db            *sql.DB
+	tracer        trace.Tracer
+	logger        *slog.Logger
+
+	mu sync.Mutex
+	// archived holds the time at which recently archived traces were copied
+	archived map[string]time.Time
+}
+
+func NewArchiveWriter(table string, archiveTable string, limits QueryLimits, db *sql.DB, tracer trace.Tracer) *ArchiveWriter {
+	return &ArchiveWriter{
+		table:         table,
+		archiveTable:  archiveTable,
+		querySettings: limits.settings(),
+		db:            db,
+		tracer:        tracer,
+		logger:        slog.Default(),
+		archived:      map[string]time.Time{},
+	}
+}
+
+// Init creates the archive table with the columns of the spans table if it does not exist
+// yet. The table is created without a TTL and ordered by trace ID, as archived traces are
+// only read by their ID. It does not deduplicate rows when parts are merged, as the client
+// and server halves of a span shared by Zipkin clients have the same span ID.
+func (w *ArchiveWriter) Init(ctx context.Context) error {
+	ctx, span := w.tracer.Start(ctx, "archivewriter:Init")
+	defer span.End()
+
+	query := fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s AS %s "+
+			"ENGINE = MergeTree "+
+			"PARTITION BY toYYYYMM(Timestamp) "+
+			"ORDER BY (TraceId, Timestamp)",
+		w.archiveTable,
+		w.table,
+	)
+
+	return w.exec(ctx, query)
+}
+
+// WriteSpan copies the rows of the trace of the span from the spans table into the archive
+// table, once for the first span of the trace Jaeger Query writes. The following spans of
+// the trace have been copied along with it. Rows that have already been archived are not
+// copied again, so archiving a trace twice only adds the spans stored since. A trace that
+// is no longer in the spans table, or fails to be copied, is copied again for the next span
+// written.
+func (w *ArchiveWriter) WriteSpan(ctx context.Context, sp *ClickhouseOtelSpan) error {
+	if !w.claim(sp.TraceID) {
+		return nil
+	}
+
+	ctx, span := w.tracer.Start(ctx, "archivewriter:WriteSpan")
+	span.SetAttributes(attribute.String("trace-id", sp.TraceID))
+	defer span.End()
+
+	if err := w.archive(ctx, sp.TraceID); err != nil {
+		w.release(sp.TraceID)
+		return err
+	}
+
+	return nil
+}
+
+// archive copies the rows of a trace that are not in the archive table yet, failing with
+// ErrNotFound when the spans table has no rows of the trace, rather than archiving nothing
+func (w *ArchiveWriter) archive(ctx context.Context, traceID string) error {
+	var count uint64
+	query := fmt.Sprintf("SELECT count() FROM %s WHERE TraceId = ?", w.table)
+	if err := w.queryRow(ctx, query, traceID).Scan(&count); err != nil {
+		w.logger.ErrorContext(ctx, "unable to count spans of trace", "error", err)
+		span := trace.SpanFromContext(ctx)
+		span.SetStatus(codes.Error, "unable to count spans of trace")
+		span.RecordError(err)
+		return queryError(err)
+	}
+	if count == 0 {
+		return fmt.Errorf("%w: trace %s in %s", ErrNotFound, traceID, w.table)
+	}
+
+	query = fmt.Sprintf(
+		"INSERT INTO %s SELECT * FROM %s WHERE TraceId = ? "+
+			"AND (SpanId, SpanKind, Timestamp) NOT IN (SELECT SpanId, SpanKind, Timestamp FROM %s WHERE TraceId = ?)",
+		w.archiveTable,
+		w.table,
+		w.archiveTable,
+	)
+	return w.exec(ctx, query, traceID, traceID)
+}
+
+// Close does nothing, as traces are archived synchronously.
+func (w *ArchiveWriter) Close() error {
+	return nil
+}
+
+// claim returns whether the trace has to be copied, marking it as archived if so
+func (w *ArchiveWriter) claim(traceID string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	for id, archivedAt := range w.archived {
+		if now.Sub(archivedAt) >= archivedTraceTTL {
+			delete(w.archived, id)
+		}
+	}
+
+	if _, ok := w.archived[traceID]; ok {
+		return false
+	}
+	w.archived[traceID] = now
+	return true
+}
+
+// release forgets a trace that failed to be copied
+func (w *ArchiveWriter) release(traceID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.archived, traceID)
+}
+
+func (w *ArchiveWriter) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		semconv.DBSystemClickhouse,
+		semconv.DBStatement(query),
+		semconv.DBSQLTable(w.table),
+	)
+
+	return w.db.QueryRowContext(withQuerySettings(ctx, w.querySettings), query, args...)
+}
+
+func (w *ArchiveWriter) exec(ctx context.Context, query string, args ...interface{}) error {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		semconv.DBSystemClickhouse,
+		semconv.DBStatement(query),
+		semconv.DBSQLTable(w.archiveTable),
+	)
+
+	if _, err := w.db.ExecContext(withQuerySettings(ctx, w.querySettings), query, args...); err != nil {
+		w.logger.ErrorContext(ctx, "unable to execute query", "error", err)
+		span.SetStatus(codes.Error, "unable to execute query")
+		span.RecordError(err)
+		return queryError(err)
+	}
+
+	return nil
+}
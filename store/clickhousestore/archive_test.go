@@ -0,0 +1,97 @@
+package clickhousestore
+
+import (
+	"context"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestArchiveWriter_Init(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS test_archive AS test ENGINE = MergeTree PARTITION BY toYYYYMM(Timestamp) ORDER BY (TraceId, Timestamp)")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	w := NewArchiveWriter("test", "test_archive", QueryLimits{}, db, tracer)
+	assert.NoError(t, w.Init(context.Background()))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestArchiveWriter_WriteSpan(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+	count := regexp.QuoteMeta("SELECT count() FROM test WHERE TraceId = ?")
+	insert := regexp.QuoteMeta(
+		"INSERT INTO test_archive SELECT * FROM test WHERE TraceId = ? " +
+			"AND (SpanId, SpanKind, Timestamp) NOT IN (SELECT SpanId, SpanKind, Timestamp FROM test_archive WHERE TraceId = ?)",
+	)
+	expectArchive := func(traceID string) {
+		mock.ExpectQuery(count).WithArgs(traceID).WillReturnRows(sqlmock.NewRows([]string{"count()"}).AddRow(2))
+		mock.ExpectExec(insert).WithArgs(traceID, traceID).WillReturnResult(sqlmock.NewResult(0, 2))
+	}
+
+	// The rows of a trace are copied once, for the first of its spans
+	expectArchive(TestDataTraceIDOne)
+	// A trace that fails to be copied is copied again for its next span
+	mock.ExpectQuery(count).WithArgs(TestDataTraceIDTwo).WillReturnRows(sqlmock.NewRows([]string{"count()"}).AddRow(2))
+	mock.ExpectExec(insert).WithArgs(TestDataTraceIDTwo, TestDataTraceIDTwo).WillReturnError(errors.New("connection reset"))
+	expectArchive(TestDataTraceIDTwo)
+	// A trace archived again later is copied again
+	expectArchive(TestDataTraceIDOne)
+
+	w := NewArchiveWriter("test", "test_archive", QueryLimits{}, db, tracer)
+	ctx := context.Background()
+
+	assert.NoError(t, w.WriteSpan(ctx, &ClickhouseOtelSpan{TraceID: TestDataTraceIDOne, SpanID: "a7d2aa025caa9cb8"}))
+	assert.NoError(t, w.WriteSpan(ctx, &ClickhouseOtelSpan{TraceID: TestDataTraceIDOne, SpanID: "0d8fd33795ba49aa"}))
+
+	assert.Error(t, w.WriteSpan(ctx, &ClickhouseOtelSpan{TraceID: TestDataTraceIDTwo, SpanID: "a7d2aa025caa9cb8"}))
+	assert.NoError(t, w.WriteSpan(ctx, &ClickhouseOtelSpan{TraceID: TestDataTraceIDTwo, SpanID: "0d8fd33795ba49aa"}))
+
+	w.archived[TestDataTraceIDOne] = time.Now().Add(-archivedTraceTTL)
+	assert.NoError(t, w.WriteSpan(ctx, &ClickhouseOtelSpan{TraceID: TestDataTraceIDOne, SpanID: "a7d2aa025caa9cb8"}))
+
+	assert.NoError(t, w.Close())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestArchiveWriter_WriteSpan_notFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	// A trace that has expired from the spans table is not archived, and is looked up
+	// again for the next span
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT count() FROM test WHERE TraceId = ?")).
+			WithArgs(TestDataTraceIDOne).
+			WillReturnRows(sqlmock.NewRows([]string{"count()"}).AddRow(0))
+	}
+
+	w := NewArchiveWriter("test", "test_archive", QueryLimits{}, db, tracer)
+	ctx := context.Background()
+
+	assert.ErrorIs(t, w.WriteSpan(ctx, &ClickhouseOtelSpan{TraceID: TestDataTraceIDOne, SpanID: "a7d2aa025caa9cb8"}), ErrNotFound)
+	assert.ErrorIs(t, w.WriteSpan(ctx, &ClickhouseOtelSpan{TraceID: TestDataTraceIDOne, SpanID: "0d8fd33795ba49aa"}), ErrNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
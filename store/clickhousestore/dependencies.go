@@ -0,0 +1,191 @@
+package clickhousestore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"time"
+)
+
+// dependenciesQuery returns a query joining child spans to their parent spans within
+// the same trace and counting the calls between distinct services. The first pair of
+// arguments bounds the parent spans and the second pair bounds the child spans, which
+// keeps the scan limited to the relevant partitions. Calls within the same service are
+// not dependencies and are excluded, matching the behavior of Jaeger's own jobs.
+func dependenciesQuery(table string) string {
+	return fmt.Sprintf(
+		"SELECT parent.ServiceName AS Parent, child.ServiceName AS Child, count() AS CallCount FROM "+
+			"(SELECT TraceId, SpanId, ServiceName FROM %s WHERE Timestamp >= toDateTime(?) AND Timestamp < toDateTime(?)) AS parent "+
+			"INNER JOIN "+
+			"(SELECT TraceId, ParentSpanId, ServiceName FROM %s WHERE ParentSpanId != '' AND Timestamp >= toDateTime(?) AND Timestamp < toDateTime(?)) AS child "+
+			"ON parent.TraceId = child.TraceId AND parent.SpanId = child.ParentSpanId "+
+			"WHERE parent.ServiceName != child.ServiceName "+
+			"GROUP BY parent.ServiceName, child.ServiceName",
+		table,
+		table,
+	)
+}
+
+// DependencyBuilder periodically aggregates parent to child service call counts from
+// the spans table into time buckets stored in a dedicated dependencies table. Calls are
+// counted in the bucket of the child span, whose parent span may have started up to the
+// parent window before the bucket.
+type DependencyBuilder struct {
+	table             string
+	dependenciesTable string
+	interval          time.Duration
+	bucketSize        time.Duration
+	lookback          time.Duration
+	lag               time.Duration
+	parentWindow      time.Duration
+	db                *sql.DB
+	tracer            trace.Tracer
+	logger            *slog.Logger
+
+	// settled holds the Unix time of buckets processed once the lag had passed since
+	// their end, which no more late arriving spans are expected for
+	settled map[int64]bool
+}
+
+func NewDependencyBuilder(table string, dependenciesTable string, interval time.Duration, bucketSize time.Duration, lookback time.Duration, lag time.Duration, parentWindow time.Duration, db *sql.DB, tracer trace.Tracer) *DependencyBuilder {
+	return &DependencyBuilder{
+		table:             table,
+		dependenciesTable: dependenciesTable,
+		interval:          interval,
+		bucketSize:        bucketSize,
+		lookback:          lookback,
+		lag:               lag,
+		parentWindow:      parentWindow,
+		db:                db,
+		tracer:            tracer,
+		logger:            slog.Default(),
+		settled:           map[int64]bool{},
+	}
+}
+
+// Init creates the dependencies table if it does not exist yet. Buckets are stored in a
+// ReplacingMergeTree so that re-processing a bucket replaces its previous counts rather
+// than adding to them.
+func (b *DependencyBuilder) Init(ctx context.Context) error {
+	ctx, span := b.tracer.Start(ctx, "dependencybuilder:Init")
+	defer span.End()
+
+	query := fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s ("+
+			"Timestamp DateTime CODEC(Delta, ZSTD(1)), "+
+			"Parent LowCardinality(String) CODEC(ZSTD(1)), "+
+			"Child LowCardinality(String) CODEC(ZSTD(1)), "+
+			"CallCount UInt64 CODEC(ZSTD(1)), "+
+			"Version DateTime64(9) CODEC(Delta, ZSTD(1))"+
+			") ENGINE = ReplacingMergeTree(Version) "+
+			"PARTITION BY toDate(Timestamp) "+
+			"ORDER BY (Timestamp, Parent, Child)",
+		b.dependenciesTable,
+	)
+
+	return b.exec(ctx, query)
+}
+
+// Run builds dependencies immediately and then on every interval until the context
+// is cancelled.
+func (b *DependencyBuilder) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := b.BuildDependencies(ctx, time.Now()); err != nil {
+			b.logger.ErrorContext(ctx, "unable to build dependencies", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// BuildDependencies processes the buckets within the lookback window ending at now that
+// have not settled yet. These are the buckets ending less than the lag before now, which
+// are re-processed so that late arriving spans are accounted for, and after a restart or
+// a failure, the buckets that have not been processed since they settled. A bucket failing
+// to be processed does not keep the following buckets from being processed.
+func (b *DependencyBuilder) BuildDependencies(ctx context.Context, now time.Time) error {
+	ctx, span := b.tracer.Start(ctx, "dependencybuilder:BuildDependencies")
+	defer span.End()
+
+	from := now.Add(-b.lookback).Truncate(b.bucketSize)
+	for bucket := range b.settled {
+		if bucket < from.Unix() {
+			delete(b.settled, bucket)
+		}
+	}
+
+	var errs []error
+	for bucket := from; !bucket.After(now); bucket = bucket.Add(b.bucketSize) {
+		if b.settled[bucket.Unix()] {
+			continue
+		}
+
+		if err := b.processBucket(ctx, bucket); err != nil {
+			span.SetStatus(codes.Error, "unable to process bucket")
+			span.RecordError(err)
+			errs = append(errs, fmt.Errorf("bucket %s: %w", bucket.UTC().Format(time.RFC3339), err))
+			continue
+		}
+
+		if !bucket.Add(b.bucketSize + b.lag).After(now) {
+			b.settled[bucket.Unix()] = true
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (b *DependencyBuilder) processBucket(ctx context.Context, bucket time.Time) error {
+	ctx, span := b.tracer.Start(ctx, "dependencybuilder:processBucket")
+	span.SetAttributes(attribute.String("bucket", bucket.UTC().String()))
+	defer span.End()
+
+	// Child spans are bounded by the bucket while parent spans may have started up to
+	// the parent window earlier, so calls from long-running parent spans crossing bucket
+	// boundaries are still counted once, in the bucket of the child span.
+	query := fmt.Sprintf(
+		"INSERT INTO %s (Timestamp, Parent, Child, CallCount, Version) "+
+			"SELECT toDateTime(?), Parent, Child, CallCount, now64(9) FROM (%s)",
+		b.dependenciesTable,
+		dependenciesQuery(b.table),
+	)
+	end := bucket.Add(b.bucketSize)
+	args := []interface{}{
+		bucket.Unix(),
+		bucket.Add(-b.parentWindow).Unix(), end.Unix(),
+		bucket.Unix(), end.Unix(),
+	}
+
+	return b.exec(ctx, query, args...)
+}
+
+func (b *DependencyBuilder) exec(ctx context.Context, query string, args ...interface{}) error {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		semconv.DBSystemClickhouse,
+		semconv.DBStatement(query),
+		semconv.DBSQLTable(b.dependenciesTable),
+	)
+
+	if _, err := b.db.ExecContext(ctx, query, args...); err != nil {
+		b.logger.ErrorContext(ctx, "unable to execute query", "error", err)
+		span.SetStatus(codes.Error, "unable to execute query")
+		span.RecordError(err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package clickhousestore
+
+import (
+	"context"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+	"testing"
+	"time"
+)
+
+func TestDependencyBuilder_Init(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS test_dependencies .* ENGINE = ReplacingMergeTree\(Version\)`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	b := NewDependencyBuilder("test", "test_dependencies", time.Minute, 5*time.Minute, time.Hour, 5*time.Minute, 5*time.Minute, db, tracer)
+	assert.NoError(t, b.Init(context.Background()))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDependencyBuilder_BuildDependencies(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	now := time.Date(2024, 4, 1, 12, 7, 0, 0, time.UTC)
+	buckets := []time.Time{
+		time.Date(2024, 4, 1, 11, 55, 0, 0, time.UTC),
+		time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC),
+		time.Date(2024, 4, 1, 12, 5, 0, 0, time.UTC),
+	}
+
+	for _, bucket := range buckets {
+		end := bucket.Add(5 * time.Minute)
+		mock.ExpectExec(`INSERT INTO test_dependencies \(Timestamp, Parent, Child, CallCount, Version\) SELECT .* FROM test .* INNER JOIN`).
+			WithArgs(bucket.Unix(), bucket.Add(-5*time.Minute).Unix(), end.Unix(), bucket.Unix(), end.Unix()).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	b := NewDependencyBuilder("test", "test_dependencies", time.Minute, 5*time.Minute, 10*time.Minute, 5*time.Minute, 5*time.Minute, db, tracer)
+	assert.NoError(t, b.BuildDependencies(context.Background(), now))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDependencyBuilder_BuildDependencies_settled(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	expectBuckets := func(buckets ...time.Time) {
+		for _, bucket := range buckets {
+			mock.ExpectExec(`INSERT INTO test_dependencies`).
+				WithArgs(bucket.Unix(), bucket.Add(-5*time.Minute).Unix(), bucket.Add(5*time.Minute).Unix(), bucket.Unix(), bucket.Add(5*time.Minute).Unix()).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+	}
+	bucket := func(minute int) time.Time {
+		return time.Date(2024, 4, 1, 11, 55, 0, 0, time.UTC).Add(time.Duration(minute) * time.Minute)
+	}
+
+	// The first run processes the whole lookback, after which the buckets ending more than
+	// the lag ago, 11:55 and 12:00, have settled and are not processed again
+	expectBuckets(bucket(0), bucket(5), bucket(10), bucket(15))
+	expectBuckets(bucket(10), bucket(15))
+
+	b := NewDependencyBuilder("test", "test_dependencies", time.Minute, 5*time.Minute, 15*time.Minute, 5*time.Minute, 5*time.Minute, db, tracer)
+	assert.NoError(t, b.BuildDependencies(context.Background(), time.Date(2024, 4, 1, 12, 12, 0, 0, time.UTC)))
+	assert.NoError(t, b.BuildDependencies(context.Background(), time.Date(2024, 4, 1, 12, 13, 0, 0, time.UTC)))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDependencyBuilder_BuildDependencies_bucketError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	// The failing oldest bucket does not keep the newer buckets from being processed
+	mock.ExpectExec(`INSERT INTO test_dependencies`).
+		WillReturnError(errors.New("timeout exceeded"))
+	mock.ExpectExec(`INSERT INTO test_dependencies`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	b := NewDependencyBuilder("test", "test_dependencies", time.Minute, 5*time.Minute, 5*time.Minute, 5*time.Minute, 5*time.Minute, db, tracer)
+	err = b.BuildDependencies(context.Background(), time.Date(2024, 4, 1, 12, 2, 0, 0, time.UTC))
+	assert.ErrorContains(t, err, "bucket 2024-04-01T11:55:00Z: timeout exceeded")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDependencyBuilder_BuildDependencies_parentWindow(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	// A child span in the 12:05 bucket whose parent span started two buckets earlier at
+	// 11:56 is joined, as parent spans are read from the whole parent window
+	bucket := time.Date(2024, 4, 1, 12, 5, 0, 0, time.UTC)
+	parentStart := time.Date(2024, 4, 1, 11, 56, 0, 0, time.UTC)
+	end := bucket.Add(5 * time.Minute)
+	parentsFrom := bucket.Add(-time.Hour)
+	assert.True(t, parentsFrom.Before(parentStart))
+
+	mock.ExpectExec(`INSERT INTO test_dependencies`).
+		WithArgs(bucket.Unix(), parentsFrom.Unix(), end.Unix(), bucket.Unix(), end.Unix()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	b := NewDependencyBuilder("test", "test_dependencies", time.Minute, 5*time.Minute, 0, 5*time.Minute, time.Hour, db, tracer)
+	assert.NoError(t, b.BuildDependencies(context.Background(), bucket.Add(time.Minute)))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,95 @@
+package clickhousestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+	"math"
+	"time"
+)
+
+var (
+	ErrQueryLimitExceeded = errors.New("query limit exceeded")
+)
+
+// Clickhouse error codes returned when a query exceeds one of its limits
+const (
+	errCodeTooManyRows        = 158
+	errCodeTimeoutExceeded    = 159
+	errCodeTooManyBytes       = 307
+	errCodeTooManyRowsOrBytes = 396
+)
+
+// Modes of handling a query exceeding its execution time
+const (
+	TimeoutOverflowModeThrow = "throw"
+	TimeoutOverflowModeBreak = "break"
+)
+
+// QueryLimits restrict the resources a single query may use, so that a broad search fails
+// early instead of scanning the whole table. Zero values leave the limit to the server.
+type QueryLimits struct {
+	MaxExecutionTime time.Duration
+	MaxRowsToRead    uint64
+	MaxBytesToRead   uint64
+	// TimeoutOverflowMode either fails queries exceeding the execution time with "throw",
+	// or returns the results read so far with "break"
+	TimeoutOverflowMode string
+}
+
+// WithQueryLimits applies the limits to all queries of the reader.
+func WithQueryLimits(limits QueryLimits) Option {
+	return func(r *ClickhouseReader) {
+		r.querySettings = limits.settings()
+	}
+}
+
+// settings returns the Clickhouse settings enforcing the limits
+func (l QueryLimits) settings() clickhouse.Settings {
+	settings := clickhouse.Settings{}
+
+	if l.MaxExecutionTime > 0 {
+		// The execution time is set in whole seconds, rounded up to not disable the limit
+		settings["max_execution_time"] = int(math.Ceil(l.MaxExecutionTime.Seconds()))
+	}
+	if l.MaxRowsToRead > 0 {
+		settings["max_rows_to_read"] = l.MaxRowsToRead
+	}
+	if l.MaxBytesToRead > 0 {
+		settings["max_bytes_to_read"] = l.MaxBytesToRead
+	}
+	if l.TimeoutOverflowMode != "" {
+		settings["timeout_overflow_mode"] = l.TimeoutOverflowMode
+	}
+
+	return settings
+}
+
+// queryContext returns a context applying the query limits to the queries executed with it
+func (r *ClickhouseReader) queryContext(ctx context.Context) context.Context {
+	return withQuerySettings(ctx, r.querySettings)
+}
+
+// withQuerySettings returns a context applying the settings to the queries executed with it
+func withQuerySettings(ctx context.Context, settings clickhouse.Settings) context.Context {
+	if len(settings) == 0 {
+		return ctx
+	}
+	return clickhouse.Context(ctx, clickhouse.WithSettings(settings))
+}
+
+// queryError wraps errors of queries that exceeded one of their limits in ErrQueryLimitExceeded
+func queryError(err error) error {
+	var exception *clickhouse.Exception
+	if !errors.As(err, &exception) {
+		return err
+	}
+
+	switch exception.Code {
+	case errCodeTooManyRows, errCodeTimeoutExceeded, errCodeTooManyBytes, errCodeTooManyRowsOrBytes:
+		return fmt.Errorf("%w: %w", ErrQueryLimitExceeded, err)
+	}
+
+	return err
+}
@@ -0,0 +1,63 @@
+package clickhousestore
+
+import (
+	"context"
+	"errors"
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+	"testing"
+	"time"
+)
+
+func TestQueryLimits_settings(t *testing.T) {
+	assert.Equal(t, clickhouse.Settings{}, QueryLimits{}.settings())
+
+	assert.Equal(t, clickhouse.Settings{
+		"max_execution_time":    2,
+		"max_rows_to_read":      uint64(1000),
+		"max_bytes_to_read":     uint64(2000),
+		"timeout_overflow_mode": TimeoutOverflowModeBreak,
+	}, QueryLimits{
+		MaxExecutionTime:    1500 * time.Millisecond,
+		MaxRowsToRead:       1000,
+		MaxBytesToRead:      2000,
+		TimeoutOverflowMode: TimeoutOverflowModeBreak,
+	}.settings())
+}
+
+func TestClickhouseReader_SearchTraces_limitExceeded(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		exceeded bool
+	}{
+		{name: "tooManyRows", err: &clickhouse.Exception{Code: errCodeTooManyRows, Message: "Limit for rows to read exceeded"}, exceeded: true},
+		{name: "timeoutExceeded", err: &clickhouse.Exception{Code: errCodeTimeoutExceeded, Message: "Timeout exceeded"}, exceeded: true},
+		{name: "tooManyBytes", err: &clickhouse.Exception{Code: errCodeTooManyBytes, Message: "Limit for bytes to read exceeded"}, exceeded: true},
+		{name: "otherException", err: &clickhouse.Exception{Code: errCodeUnknownTable, Message: "Table does not exist"}, exceeded: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+			mock.ExpectQuery(`SELECT TraceId FROM test`).WillReturnError(tt.err)
+
+			cr := New("test", false, db, tracer, WithQueryLimits(QueryLimits{MaxRowsToRead: 1000}))
+			endTime := time.Now()
+			_, err = cr.SearchTraces(context.Background(), TestDataServiceNameOne, endTime.Add(-time.Hour), endTime, SearchOptions{SearchLimit: 20})
+			assert.Error(t, err)
+			assert.Equal(t, tt.exceeded, errors.Is(err, ErrQueryLimitExceeded))
+			assert.ErrorIs(t, err, tt.err)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
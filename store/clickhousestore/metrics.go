@@ -0,0 +1,312 @@
+package clickhousestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
+	"time"
+)
+
+// ErrServiceNamesRequired is returned for metrics queries without service names.
+var ErrServiceNamesRequired = errors.New("service names are required for metrics queries")
+
+// ClickhouseMetricsStore computes RED metrics of services from their spans.
+type ClickhouseMetricsStore interface {
+	GetLatencies(ctx context.Context, query MetricsQuery, quantile float64) ([]ClickhouseMetricPoint, error)
+	GetCallCounts(ctx context.Context, query MetricsQuery) ([]ClickhouseCallCount, error)
+}
+
+// MetricsQuery selects the spans metrics are computed from. Metrics are returned as points
+// every Step between StartTime and EndTime, where each point aggregates the spans of the
+// Window before it, so that points are smoothed over a longer time than the step.
+type MetricsQuery struct {
+	ServiceNames     []string
+	GroupByOperation bool
+	// SpanKinds are compared without their enum prefix and case-insensitively, so that
+	// "SPAN_KIND_SERVER" matches both "SPAN_KIND_SERVER" and "Server"
+	SpanKinds []string
+	StartTime time.Time
+	EndTime   time.Time
+	Step      time.Duration
+	Window    time.Duration
+}
+
+// ClickhouseMetricPoint is the value of a metric of a service, or of an operation of a
+// service if grouped by operation.
+type ClickhouseMetricPoint struct {
+	ServiceName string
+	Operation   string
+	Timestamp   time.Time
+	Value       float64
+}
+
+// ClickhouseCallCount is the number of calls and failed calls to a service, or to an
+// operation of a service if grouped by operation, within the window of a point.
+type ClickhouseCallCount struct {
+	ServiceName string
+	Operation   string
+	Timestamp   time.Time
+	Calls       uint64
+	Errors      uint64
+}
+
+// GetLatencies returns the quantile of the duration of spans in milliseconds.
+func (r *ClickhouseReader) GetLatencies(ctx context.Context, query MetricsQuery, quantile float64) ([]ClickhouseMetricPoint, error) {
+	ctx, span := r.tracer.Start(ctx, "clickhousereader:GetLatencies")
+	defer span.End()
+
+	// Quantiles are aggregated per step first and merged into the windows of the points
+	aggregates := metricsAggregates{
+		spans:  fmt.Sprintf("quantileState(%v)(Duration) AS State", quantile),
+		points: fmt.Sprintf("quantileMerge(%v)(State) / 1e6", quantile),
+	}
+
+	// Quantiles of the rollup can only be merged with the same quantiles of spans
+	if index := metricsRollupQuantileIndex(quantile); index > 0 && r.metricsRollupTable != "" {
+		aggregates = metricsAggregates{
+			spans:  fmt.Sprintf("quantilesState(%s)(toInt64(Duration)) AS State", metricsRollupLevels()),
+			rollup: fmt.Sprintf("quantilesMergeState(%s)(Latency) AS State", metricsRollupLevels()),
+			points: fmt.Sprintf("quantilesMerge(%s)(State)[%d] / 1e6", metricsRollupLevels(), index),
+		}
+	}
+
+	sql, args, err := r.metricsQuery(ctx, query, aggregates)
+	if err != nil {
+		span.SetStatus(codes.Error, "invalid metrics query")
+		span.RecordError(err)
+		return nil, err
+	}
+
+	points := []ClickhouseMetricPoint{}
+	err = r.queryMetrics(ctx, sql, args, func(scan func(dest ...interface{}) error) error {
+		var point ClickhouseMetricPoint
+		var timestamp int64
+		if err := scan(&point.ServiceName, &point.Operation, &timestamp, &point.Value); err != nil {
+			return err
+		}
+		point.Timestamp = time.Unix(0, timestamp)
+		points = append(points, point)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return points, nil
+}
+
+// GetCallCounts returns the number of spans and of spans with an error status.
+func (r *ClickhouseReader) GetCallCounts(ctx context.Context, query MetricsQuery) ([]ClickhouseCallCount, error) {
+	ctx, span := r.tracer.Start(ctx, "clickhousereader:GetCallCounts")
+	defer span.End()
+
+	sql, args, err := r.metricsQuery(ctx, query, metricsAggregates{
+		spans:  fmt.Sprintf("count() AS Calls, countIf(%s = 'error') AS Errors", columnTags["otel.status_code"].target.Expression),
+		rollup: "countMerge(Calls) AS Calls, sumMerge(Errors) AS Errors",
+		points: "sum(Calls), sum(Errors)",
+	})
+	if err != nil {
+		span.SetStatus(codes.Error, "invalid metrics query")
+		span.RecordError(err)
+		return nil, err
+	}
+
+	counts := []ClickhouseCallCount{}
+	err = r.queryMetrics(ctx, sql, args, func(scan func(dest ...interface{}) error) error {
+		var count ClickhouseCallCount
+		var timestamp int64
+		if err := scan(&count.ServiceName, &count.Operation, &timestamp, &count.Calls, &count.Errors); err != nil {
+			return err
+		}
+		count.Timestamp = time.Unix(0, timestamp)
+		counts = append(counts, count)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// metricsAggregates are the aggregates of a metrics query. Spans, and rows of the rollup
+// table where it covers the time range, are aggregated into buckets of the step, which are
+// merged into the points whose window they fall into.
+type metricsAggregates struct {
+	spans string
+	// rollup aggregates rows of the rollup table into the same types as spans does, or is
+	// empty if the metric cannot be read from the rollup
+	rollup string
+	points string
+}
+
+// metricsQuery returns a query aggregating spans into buckets of the step, and merging the
+// buckets within the window of each point. Every bucket is repeated for all of the points
+// whose window it falls into, where the timestamp of a point is the end of its last bucket.
+// Buckets are read from the rollup table for the time it covers if its minutes fit into
+// the buckets, and from spans for the time before.
+func (r *ClickhouseReader) metricsQuery(ctx context.Context, query MetricsQuery, aggregates metricsAggregates) (string, []interface{}, error) {
+	step := query.Step.Nanoseconds()
+	buckets := int64(1)
+	if query.Window > query.Step {
+		buckets = (query.Window.Nanoseconds() + step - 1) / step
+	}
+
+	spansStart := query.StartTime.Add(-time.Duration(buckets * step))
+
+	var rollupStart time.Time
+	if r.metricsRollupTable != "" && aggregates.rollup != "" && query.Step%metricsRollupInterval == 0 {
+		rollupStart = r.metricsRollupStart(ctx)
+	}
+	if !rollupStart.IsZero() && !rollupStart.Before(query.EndTime) {
+		rollupStart = time.Time{}
+	}
+
+	var sources []string
+	var args []interface{}
+
+	if rollupStart.IsZero() || rollupStart.After(spansStart) {
+		spansEnd := condition{"Timestamp <= " + dateTime64Param, []interface{}{query.EndTime.UnixNano()}}
+		if !rollupStart.IsZero() {
+			spansEnd = condition{"Timestamp < " + dateTime64Param, []interface{}{rollupStart.UnixNano()}}
+		}
+
+		source, sourceArgs, err := r.metricsSource(
+			query,
+			r.table,
+			fmt.Sprintf("intDiv(toUnixTimestamp64Nano(Timestamp), %d)", step),
+			aggregates.spans,
+			condition{"Timestamp >= " + dateTime64Param, []interface{}{spansStart.UnixNano()}},
+			spansEnd,
+		)
+		if err != nil {
+			return "", nil, err
+		}
+		sources = append(sources, source)
+		args = append(args, sourceArgs...)
+	}
+
+	if !rollupStart.IsZero() {
+		if rollupStart.Before(spansStart) {
+			rollupStart = spansStart
+		}
+
+		source, sourceArgs, err := r.metricsSource(
+			query,
+			r.metricsRollupTable,
+			fmt.Sprintf("intDiv(toInt64(toUnixTimestamp(Timestamp)), %d)", step/int64(time.Second)),
+			aggregates.rollup,
+			condition{"Timestamp >= toDateTime(?)", []interface{}{rollupStart.Unix()}},
+			condition{"Timestamp <= toDateTime(?)", []interface{}{query.EndTime.Unix()}},
+		)
+		if err != nil {
+			return "", nil, err
+		}
+		sources = append(sources, source)
+		args = append(args, sourceArgs...)
+	}
+
+	sql := fmt.Sprintf(
+		"SELECT ServiceName, Operation, toInt64((Bucket + 1 + Offset) * %d) AS Point, %s FROM (%s) "+
+			"ARRAY JOIN range(%d) AS Offset "+
+			"WHERE Point >= ? AND Point <= ? "+
+			"GROUP BY ServiceName, Operation, Point "+
+			"ORDER BY ServiceName, Operation, Point",
+		step,
+		aggregates.points,
+		strings.Join(sources, " UNION ALL "),
+		buckets,
+	)
+	args = append(args, query.StartTime.UnixNano(), query.EndTime.UnixNano())
+
+	return sql, args, nil
+}
+
+// metricsSource returns a query aggregating the rows of a table within the time range into
+// buckets, by service and by operation if grouped by operation
+func (r *ClickhouseReader) metricsSource(query MetricsQuery, table string, bucket string, aggregates string, start condition, end condition) (string, []interface{}, error) {
+	if len(query.ServiceNames) == 0 {
+		return "", nil, ErrServiceNamesRequired
+	}
+
+	operation := "''"
+	if query.GroupByOperation {
+		operation = "SpanName"
+	}
+
+	serviceNames := make([]interface{}, 0, len(query.ServiceNames))
+	for _, serviceName := range query.ServiceNames {
+		serviceNames = append(serviceNames, serviceName)
+	}
+
+	conditions := []condition{
+		{"ServiceName IN (?" + strings.Repeat(", ?", len(serviceNames)-1) + ")", serviceNames},
+		start,
+		end,
+	}
+
+	if len(query.SpanKinds) > 0 {
+		spanKinds := make([]interface{}, 0, len(query.SpanKinds))
+		for _, spanKind := range query.SpanKinds {
+			spanKinds = append(spanKinds, strings.ToLower(strings.TrimPrefix(spanKind, "SPAN_KIND_")))
+		}
+		conditions = append(conditions, condition{
+			columnTags["span.kind"].target.Expression + " IN (?" + strings.Repeat(", ?", len(spanKinds)-1) + ")",
+			spanKinds,
+		})
+	}
+
+	where := joinConditions(conditions, " AND ")
+	sql := fmt.Sprintf(
+		"SELECT ServiceName, %s AS Operation, %s AS Bucket, %s FROM %s WHERE %s GROUP BY ServiceName, Operation, Bucket",
+		operation,
+		bucket,
+		aggregates,
+		table,
+		where.query,
+	)
+
+	return sql, where.args, nil
+}
+
+// queryMetrics executes a metrics query and calls scanRow for each of the resulting rows
+func (r *ClickhouseReader) queryMetrics(ctx context.Context, sql string, args []interface{}, scanRow func(scan func(dest ...interface{}) error) error) error {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		semconv.DBSystemClickhouse,
+		semconv.DBStatement(sql),
+		semconv.DBSQLTable(r.table),
+	)
+
+	rows, err := r.db.QueryContext(r.queryContext(ctx), sql, args...)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "unable to execute query", "error", err)
+		span.SetStatus(codes.Error, "unable to execute query")
+		span.RecordError(err)
+		return queryError(err)
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		if err := scanRow(rows.Scan); err != nil {
+			r.logger.ErrorContext(ctx, "unable to scan row results", "error", err)
+			span.SetStatus(codes.Error, "unable to scan row results")
+			span.RecordError(err)
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		r.logger.ErrorContext(ctx, "received errors in rows", "error", err)
+		span.SetStatus(codes.Error, "received errors in rows")
+		span.RecordError(err)
+		return queryError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package clickhousestore
+
+import (
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestClickhouseReader_GetCallCounts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	endTime := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	startTime := endTime.Add(-time.Hour)
+
+	query := "SELECT ServiceName, Operation, toInt64((Bucket + 1 + Offset) * 60000000000) AS Point, sum(Calls), sum(Errors) FROM " +
+		"(SELECT ServiceName, SpanName AS Operation, intDiv(toUnixTimestamp64Nano(Timestamp), 60000000000) AS Bucket, " +
+		"count() AS Calls, countIf(lower(replaceOne(StatusCode, 'STATUS_CODE_', '')) = 'error') AS Errors FROM test " +
+		"WHERE ServiceName IN (?, ?) AND Timestamp >= fromUnixTimestamp64Nano(toInt64(?)) AND Timestamp <= fromUnixTimestamp64Nano(toInt64(?)) " +
+		"AND lower(replaceOne(SpanKind, 'SPAN_KIND_', '')) IN (?) GROUP BY ServiceName, Operation, Bucket) " +
+		"ARRAY JOIN range(10) AS Offset WHERE Point >= ? AND Point <= ? " +
+		"GROUP BY ServiceName, Operation, Point ORDER BY ServiceName, Operation, Point"
+
+	point := endTime.Add(-time.Minute)
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(
+			TestDataServiceNameOne, TestDataServiceNameTwo,
+			startTime.Add(-10*time.Minute).UnixNano(), endTime.UnixNano(),
+			"server",
+			startTime.UnixNano(), endTime.UnixNano(),
+		).
+		WillReturnRows(sqlmock.NewRows([]string{"ServiceName", "Operation", "Point", "sum(Calls)", "sum(Errors)"}).
+			AddRow(TestDataServiceNameOne, TestDataSpanNameOne, point.UnixNano(), uint64(600), uint64(6)))
+
+	cr := New("test", false, db, tracer)
+	res, err := cr.GetCallCounts(context.Background(), MetricsQuery{
+		ServiceNames:     []string{TestDataServiceNameOne, TestDataServiceNameTwo},
+		GroupByOperation: true,
+		SpanKinds:        []string{"SPAN_KIND_SERVER"},
+		StartTime:        startTime,
+		EndTime:          endTime,
+		Step:             time.Minute,
+		Window:           10 * time.Minute,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []ClickhouseCallCount{
+		{ServiceName: TestDataServiceNameOne, Operation: TestDataSpanNameOne, Timestamp: time.Unix(0, point.UnixNano()), Calls: 600, Errors: 6},
+	}, res)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_GetLatencies(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	endTime := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	startTime := endTime.Add(-time.Hour)
+
+	query := "SELECT ServiceName, Operation, toInt64((Bucket + 1 + Offset) * 5000000000) AS Point, quantileMerge(0.95)(State) / 1e6 FROM " +
+		"(SELECT ServiceName, '' AS Operation, intDiv(toUnixTimestamp64Nano(Timestamp), 5000000000) AS Bucket, " +
+		"quantileState(0.95)(Duration) AS State FROM test " +
+		"WHERE ServiceName IN (?) AND Timestamp >= fromUnixTimestamp64Nano(toInt64(?)) AND Timestamp <= fromUnixTimestamp64Nano(toInt64(?)) " +
+		"GROUP BY ServiceName, Operation, Bucket) " +
+		"ARRAY JOIN range(1) AS Offset WHERE Point >= ? AND Point <= ? " +
+		"GROUP BY ServiceName, Operation, Point ORDER BY ServiceName, Operation, Point"
+
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(TestDataServiceNameOne, startTime.Add(-5*time.Second).UnixNano(), endTime.UnixNano(), startTime.UnixNano(), endTime.UnixNano()).
+		WillReturnRows(sqlmock.NewRows([]string{"ServiceName", "Operation", "Point", "Latency"}).
+			AddRow(TestDataServiceNameOne, "", endTime.UnixNano(), 12.5))
+
+	cr := New("test", false, db, tracer)
+	res, err := cr.GetLatencies(context.Background(), MetricsQuery{
+		ServiceNames: []string{TestDataServiceNameOne},
+		StartTime:    startTime,
+		EndTime:      endTime,
+		Step:         5 * time.Second,
+		Window:       5 * time.Second,
+	}, 0.95)
+	assert.NoError(t, err)
+	assert.Equal(t, []ClickhouseMetricPoint{
+		{ServiceName: TestDataServiceNameOne, Timestamp: time.Unix(0, endTime.UnixNano()), Value: 12.5},
+	}, res)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_metricsWithoutServiceNames(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	query := MetricsQuery{
+		StartTime: time.Now().Add(-time.Minute),
+		EndTime:   time.Now(),
+		Step:      5 * time.Second,
+		Window:    5 * time.Second,
+	}
+
+	cr := New("test", false, db, tracer)
+	_, err = cr.GetLatencies(context.Background(), query, 0.95)
+	assert.ErrorIs(t, err, ErrServiceNamesRequired)
+	_, err = cr.GetCallCounts(context.Background(), query)
+	assert.ErrorIs(t, err, ErrServiceNamesRequired)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
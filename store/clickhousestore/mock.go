@@ -2,6 +2,7 @@ package clickhousestore
 
 import (
 	"context"
+	"slices"
 	"time"
 )
 
@@ -14,9 +15,29 @@ const (
 	TestDataSpanNameTwo    = "child-span"
 )
 
+// TestDataStartTime is the start of the first test trace. The second test trace starts a
+// minute later.
+var TestDataStartTime = time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+
 type MockClickhouseReader struct {
 	returnCount int
 	traces      map[string]*ClickhouseOtelTrace
+
+	// SearchCalls records the arguments of every SearchTraces call
+	SearchCalls []MockSearchCall
+	// SearchError is returned by SearchTraces if set
+	SearchError error
+	// SearchResults are returned by consecutive SearchTraces calls if set, without the
+	// ignored trace IDs and cut to the search limit
+	SearchResults [][]string
+	// MetricsCalls records the queries of every GetLatencies and GetCallCounts call
+	MetricsCalls []MetricsQuery
+}
+
+type MockSearchCall struct {
+	StartTime time.Time
+	EndTime   time.Time
+	Options   SearchOptions
 }
 
 func NewMockClickhouseReader(returnCount int) *MockClickhouseReader {
@@ -27,7 +48,7 @@ func NewMockClickhouseReader(returnCount int) *MockClickhouseReader {
 				TraceID: TestDataTraceIDOne,
 				Spans: []ClickhouseOtelSpan{
 					{
-						Timestamp:    time.Time{},
+						Timestamp:    TestDataStartTime,
 						TraceID:      TestDataTraceIDOne,
 						SpanID:       "a7d2aa025caa9cb8",
 						ParentSpanID: "",
@@ -53,7 +74,7 @@ func NewMockClickhouseReader(returnCount int) *MockClickhouseReader {
 						EventsAttributes: nil,
 					},
 					{
-						Timestamp:          time.Time{},
+						Timestamp:          TestDataStartTime.Add(time.Second),
 						TraceID:            TestDataTraceIDOne,
 						SpanID:             "0d8fd33795ba49aa",
 						ParentSpanID:       "a7d2aa025caa9cb8",
@@ -78,7 +99,7 @@ func NewMockClickhouseReader(returnCount int) *MockClickhouseReader {
 				TraceID: TestDataTraceIDTwo,
 				Spans: []ClickhouseOtelSpan{
 					{
-						Timestamp:    time.Time{},
+						Timestamp:    TestDataStartTime.Add(time.Minute),
 						TraceID:      TestDataTraceIDTwo,
 						SpanID:       "a7d2aa025caa9cb8",
 						ParentSpanID: "",
@@ -104,7 +125,7 @@ func NewMockClickhouseReader(returnCount int) *MockClickhouseReader {
 						EventsAttributes: nil,
 					},
 					{
-						Timestamp:          time.Time{},
+						Timestamp:          TestDataStartTime.Add(time.Minute + time.Second),
 						TraceID:            TestDataTraceIDTwo,
 						SpanID:             "0d8fd33795ba49aa",
 						ParentSpanID:       "a7d2aa025caa9cb8",
@@ -122,6 +143,10 @@ func NewMockClickhouseReader(returnCount int) *MockClickhouseReader {
 						EventsTimestamp:    nil,
 						EventsName:         nil,
 						EventsAttributes:   nil,
+						LinksTraceID:       []string{TestDataTraceIDOne},
+						LinksSpanID:        []string{"0d8fd33795ba49aa"},
+						LinksTraceState:    []string{""},
+						LinksAttributes:    []map[string]string{{}},
 					},
 				},
 			},
@@ -161,13 +186,33 @@ func (r *MockClickhouseReader) GetTraces(ctx context.Context, traceIDs []string)
 		return traces, nil
 	}
 
-	for _, trace := range r.traces {
-		traces = append(traces, trace)
+	for _, traceID := range traceIDs {
+		if trace, ok := r.traces[traceID]; ok {
+			traces = append(traces, trace)
+		}
 	}
 	return traces, nil
 }
 
 func (r *MockClickhouseReader) SearchTraces(ctx context.Context, serviceName string, startTime time.Time, endTime time.Time, options SearchOptions) ([]string, error) {
+	r.SearchCalls = append(r.SearchCalls, MockSearchCall{StartTime: startTime, EndTime: endTime, Options: options})
+
+	if r.SearchError != nil {
+		return nil, r.SearchError
+	}
+
+	if r.SearchResults != nil {
+		results := []string{}
+		if len(r.SearchCalls) <= len(r.SearchResults) {
+			for _, traceID := range r.SearchResults[len(r.SearchCalls)-1] {
+				if len(results) < options.SearchLimit && !slices.Contains(options.IgnoredTraceIDs, traceID) {
+					results = append(results, traceID)
+				}
+			}
+		}
+		return results, nil
+	}
+
 	if r.returnCount == 0 {
 		return []string{}, nil
 	} else if r.returnCount == 1 {
@@ -175,3 +220,65 @@ func (r *MockClickhouseReader) SearchTraces(ctx context.Context, serviceName str
 	}
 	return []string{TestDataTraceIDOne, TestDataTraceIDTwo}, nil
 }
+
+func (r *MockClickhouseReader) GetDependencies(ctx context.Context, startTime time.Time, endTime time.Time) ([]ClickhouseDependencyLink, error) {
+	if r.returnCount == 0 {
+		return []ClickhouseDependencyLink{}, nil
+	}
+	return []ClickhouseDependencyLink{
+		{Parent: TestDataServiceNameOne, Child: TestDataServiceNameTwo, CallCount: uint64(r.returnCount)},
+	}, nil
+}
+
+func (r *MockClickhouseReader) GetLatencies(ctx context.Context, query MetricsQuery, quantile float64) ([]ClickhouseMetricPoint, error) {
+	r.MetricsCalls = append(r.MetricsCalls, query)
+
+	points := []ClickhouseMetricPoint{}
+	if r.returnCount == 0 {
+		return points, nil
+	}
+	for _, serviceName := range query.ServiceNames {
+		point := ClickhouseMetricPoint{ServiceName: serviceName, Timestamp: query.EndTime, Value: 10 * quantile}
+		if query.GroupByOperation {
+			point.Operation = TestDataSpanNameOne
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+func (r *MockClickhouseReader) GetCallCounts(ctx context.Context, query MetricsQuery) ([]ClickhouseCallCount, error) {
+	r.MetricsCalls = append(r.MetricsCalls, query)
+
+	counts := []ClickhouseCallCount{}
+	if r.returnCount == 0 {
+		return counts, nil
+	}
+	for _, serviceName := range query.ServiceNames {
+		count := ClickhouseCallCount{ServiceName: serviceName, Timestamp: query.EndTime, Calls: 600, Errors: 60}
+		if query.GroupByOperation {
+			count.Operation = TestDataSpanNameOne
+		}
+		counts = append(counts, count)
+	}
+	return counts, nil
+}
+
+type MockClickhouseWriter struct {
+	Spans  []*ClickhouseOtelSpan
+	Closed bool
+}
+
+func NewMockClickhouseWriter() *MockClickhouseWriter {
+	return &MockClickhouseWriter{}
+}
+
+func (w *MockClickhouseWriter) WriteSpan(ctx context.Context, span *ClickhouseOtelSpan) error {
+	w.Spans = append(w.Spans, span)
+	return nil
+}
+
+func (w *MockClickhouseWriter) Close() error {
+	w.Closed = true
+	return nil
+}
@@ -28,6 +28,16 @@ type ClickhouseOtelSpan struct {
 	EventsTimestamp    []time.Time
 	EventsName         []string
 	EventsAttributes   []map[string]string
+	LinksTraceID       []string
+	LinksSpanID        []string
+	LinksTraceState    []string
+	LinksAttributes    []map[string]string
+}
+
+type ClickhouseDependencyLink struct {
+	Parent    string
+	Child     string
+	CallCount uint64
 }
 
 type SearchOptions struct {
@@ -37,4 +47,30 @@ type SearchOptions struct {
 	MinDuration     time.Duration
 	MaxDuration     time.Duration
 	SearchLimit     int
+
+	// Child restricts the search to spans calling a span matching the filter
+	Child *SpanFilter
+
+	// MatchTrace allows each condition to be matched by a different span of a trace, except
+	// for structural searches, where all conditions apply to the calling span
+	MatchTrace bool
+
+	// Filters applied to whole traces rather than to individual spans
+	MinTraceDuration time.Duration
+	MaxTraceDuration time.Duration
+	MinSpanCount     int
+	MaxSpanCount     int
+}
+
+// SpanFilter selects spans by service, span name and tags
+type SpanFilter struct {
+	ServiceName string
+	SpanName    string
+	Attributes  map[string]string
+}
+
+// HasTraceFilters reports whether the search filters traces by their duration or number of
+// spans, which are aggregated over all spans of a trace within the time range.
+func (o SearchOptions) HasTraceFilters() bool {
+	return o.MinTraceDuration != 0 || o.MaxTraceDuration != 0 || o.MinSpanCount != 0 || o.MaxSpanCount != 0
 }
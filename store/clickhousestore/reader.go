@@ -5,46 +5,111 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/attributes"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/tagquery"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
 	"go.opentelemetry.io/otel/trace"
 	"log/slog"
-	"regexp"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// Searches with trace filters aggregate up to this many times the number of requested
+// traces, as the filters reject an unknown share of the traces matching the search
+const traceFilterCandidateFactor = 100
+
 var (
 	ErrNotFound = errors.New("not found")
 )
 
+const (
+	// Clickhouse error code returned when querying a table that does not exist
+	errCodeUnknownTable = 60
+
+	// DateTime64(9) parameter matching the precision of the Timestamp column, with
+	// the time passed as nanoseconds since epoch. The driver binds time.Time values
+	// with a precision of seconds only.
+	dateTime64Param = "fromUnixTimestamp64Nano(toInt64(?))"
+)
+
 type ClickhouseStore interface {
 	GetServices(ctx context.Context) ([]string, error)
 	GetSpanNames(ctx context.Context, serviceName string) ([]string, error)
 	GetTrace(ctx context.Context, traceID string) (*ClickhouseOtelTrace, error)
 	GetTraces(ctx context.Context, traceIDs []string) ([]*ClickhouseOtelTrace, error)
 	SearchTraces(ctx context.Context, serviceName string, startTime time.Time, endTime time.Time, options SearchOptions) ([]string, error)
+	GetDependencies(ctx context.Context, startTime time.Time, endTime time.Time) ([]ClickhouseDependencyLink, error)
 }
 
 type ClickhouseReader struct {
-	table      string
-	padTraceID bool
-	db         *sql.DB
-	tracer     trace.Tracer
-	logger     *slog.Logger
+	table              string
+	dependenciesTable  string
+	dependenciesBucket time.Duration
+	traceIDTsTable     string
+	traceIDTsDisabled  atomic.Bool
+	attributeTypes     *attributes.Types
+	schema             *Schema
+	padTraceID         bool
+	querySettings      clickhouse.Settings
+	metricsRollupTable string
+	// Unix time from which on the metrics rollup table is known to cover all spans
+	metricsRollupCovered atomic.Int64
+	db                   *sql.DB
+	tracer               trace.Tracer
+	logger               *slog.Logger
 }
 
-func New(table string, padTraceID bool, db *sql.DB, tracer trace.Tracer) *ClickhouseReader {
-	return &ClickhouseReader{
-		table:      table,
-		padTraceID: padTraceID,
-		db:         db,
-		tracer:     tracer,
-		logger:     slog.Default(),
+// Option configures optional behavior of a ClickhouseReader.
+type Option func(r *ClickhouseReader)
+
+// WithDependenciesTable reads service dependencies from the pre-aggregated table
+// maintained by a DependencyBuilder with the given bucket size instead of joining raw
+// spans on demand.
+func WithDependenciesTable(table string, bucketSize time.Duration) Option {
+	return func(r *ClickhouseReader) {
+		r.dependenciesTable = table
+		r.dependenciesBucket = bucketSize
 	}
 }
 
+// WithTraceIDTsTable looks up the time bounds of traces in the trace ID to timestamp
+// table created by the exporter, so that reading traces only scans matching partitions.
+func WithTraceIDTsTable(table string) Option {
+	return func(r *ClickhouseReader) {
+		r.traceIDTsTable = table
+	}
+}
+
+// WithAttributeTypes sets the types used to compare attribute values when searching.
+func WithAttributeTypes(types *attributes.Types) Option {
+	return func(r *ClickhouseReader) {
+		r.attributeTypes = types
+	}
+}
+
+func New(table string, padTraceID bool, db *sql.DB, tracer trace.Tracer, options ...Option) *ClickhouseReader {
+	r := &ClickhouseReader{
+		table:          table,
+		attributeTypes: attributes.NewTypes(nil),
+		schema:         DefaultSchema(),
+		padTraceID:     padTraceID,
+		db:             db,
+		tracer:         tracer,
+		logger:         slog.Default(),
+	}
+
+	for _, option := range options {
+		option(r)
+	}
+
+	return r
+}
+
 func (r *ClickhouseReader) GetServices(ctx context.Context) ([]string, error) {
 	ctx, span := r.tracer.Start(ctx, "clickhousereader:GetServices")
 	defer span.End()
@@ -101,80 +166,363 @@ func (r *ClickhouseReader) SearchTraces(ctx context.Context, serviceName string,
 	span.SetAttributes(attribute.String("time-range", endTime.Sub(startTime).String()))
 
 	args := []interface{}{}
-	query := fmt.Sprintf("SELECT DISTINCT TraceId FROM %s WHERE ServiceName = ?", r.table)
-	args = append(args, serviceName)
+	query := fmt.Sprintf("SELECT TraceId FROM %s", r.table)
+
+	// Structural searches match spans calling a child span matching the child filter
+	if options.Child != nil {
+		join, joinArgs, err := r.childJoin(ctx, *options.Child, startTime, endTime)
+		if err != nil {
+			span.SetStatus(codes.Error, "unable to build child conditions")
+			span.RecordError(err)
+			return nil, err
+		}
+		query = query + join
+		args = append(args, joinArgs...)
+	}
+
+	var spanConditions []condition
+
+	// Without a service name, spans of all services are searched
+	if serviceName != "" {
+		spanConditions = append(spanConditions, condition{"ServiceName = ?", []interface{}{serviceName}})
+	}
 
 	if options.SpanName != "" {
-		query = query + " AND SpanName = ?"
-		args = append(args, options.SpanName)
+		spanConditions = append(spanConditions, condition{"SpanName = ?", []interface{}{options.SpanName}})
 	}
 
-	query = query + " AND (Timestamp >= toDateTime(?) AND Timestamp <= toDateTime(?))"
-	args = append(args, startTime.Unix(), endTime.Unix())
+	timeCondition := condition{
+		fmt.Sprintf("(Timestamp >= %[1]s AND Timestamp <= %[1]s)", dateTime64Param),
+		[]interface{}{startTime.UnixNano(), endTime.UnixNano()},
+	}
+
+	var durationConditions []condition
 
 	if options.MinDuration != 0 {
-		query = query + " AND Duration >= ?"
-		args = append(args, options.MinDuration.Nanoseconds())
+		durationConditions = append(durationConditions, condition{"Duration >= ?", []interface{}{options.MinDuration.Nanoseconds()}})
 	}
 
 	if options.MaxDuration != 0 {
-		query = query + " AND Duration <= ?"
-		args = append(args, options.MaxDuration.Nanoseconds())
+		durationConditions = append(durationConditions, condition{"Duration <= ?", []interface{}{options.MaxDuration.Nanoseconds()}})
 	}
 
-	for key, value := range options.Attributes {
-		if strings.ToLower(key) == "error" {
-			query = query + " AND StatusCode = 'STATUS_CODE_ERROR'"
-			if strings.ToLower(value) == "true" {
-				continue
+	tagConditions, err := r.tagConditions(ctx, options.Attributes)
+	if err != nil {
+		span.SetStatus(codes.Error, "unable to build tag conditions")
+		span.RecordError(err)
+		return nil, err
+	}
+
+	var conditions []condition
+	var having *condition
+
+	if options.MatchTrace && options.Child == nil {
+		// Every condition has to be matched by any span of the trace, where the service,
+		// span name and duration describe a single span, while negated tags must not be
+		// matched by any span of the trace, as in "no span has peer.service".
+		var matchConditions, excludeConditions []condition
+		if spanMatch := append(spanConditions, durationConditions...); len(spanMatch) > 0 {
+			matchConditions = append(matchConditions, joinConditions(spanMatch, " AND ").parenthesize())
+		}
+		for _, c := range tagConditions {
+			if c.positive != nil {
+				excludeConditions = append(excludeConditions, *c.positive)
+			} else {
+				matchConditions = append(matchConditions, c.condition)
 			}
 		}
 
-		// Check for instances of wildcard without being escaped
-		wildcardMatch, _ := regexp.MatchString(`(^|[^\\])%`, value)
-
-		if strings.HasPrefix(value, "~") {
-			value = strings.TrimLeft(value, "~")
-			span.SetAttributes(attribute.String("query-type", "MATCH"))
-			span.SetAttributes(attribute.String("query-key", key))
-			span.SetAttributes(attribute.String("query-value", value))
-			query = query + " AND match(SpanAttributes[?], ?)"
-			args = append(args, key, value)
-		} else if wildcardMatch {
-			span.SetAttributes(attribute.String("query-type", "LIKE"))
-			span.SetAttributes(attribute.String("query-key", key))
-			span.SetAttributes(attribute.String("query-value", value))
-			query = query + " AND (SpanAttributes[?] LIKE ? AND SpanAttributes[?] != '')"
-			args = append(args, key, value, key)
-		} else {
-			// Replace all escaped wildcards with literal '%'
-			// This is a janky workaround to support wildcard matches while also supporting
-			// literal '%' queries. If the query only contains literals by way of escaping,
-			// normalize them into the proper query syntax.
-			value = strings.ReplaceAll(value, "\\%", "%")
-			span.SetAttributes(attribute.String("query-type", "EQUAL"))
-			span.SetAttributes(attribute.String("query-key", key))
-			span.SetAttributes(attribute.String("query-value", value))
-			query = query + " AND SpanAttributes[?] = ?"
-			args = append(args, key, value)
+		counts := make([]condition, 0, len(matchConditions)+len(excludeConditions))
+		for _, c := range matchConditions {
+			counts = append(counts, condition{fmt.Sprintf("countIf(%s) > 0", c.query), c.args})
+		}
+		for _, c := range excludeConditions {
+			counts = append(counts, condition{fmt.Sprintf("countIf(%s) = 0", c.query), c.args})
+		}
+
+		// Spans matching none of the conditions are skipped before aggregating. As traces
+		// only matching negated tags have no such spans, all spans are aggregated then.
+		conditions = []condition{timeCondition}
+		if len(matchConditions) > 0 {
+			prefilter := append(append([]condition{}, matchConditions...), excludeConditions...)
+			conditions = append(conditions, joinConditions(prefilter, " OR ").parenthesize())
+		}
+		if len(counts) > 0 {
+			countCondition := joinConditions(counts, " AND ")
+			having = &countCondition
 		}
+	} else {
+		conditions = append(append(append(spanConditions, timeCondition), durationConditions...), tagMatchConditions(tagConditions)...)
 	}
 
 	if len(options.IgnoredTraceIDs) > 0 {
-		query = query + fmt.Sprintf(" AND TraceId NOT IN (%s)", "?"+strings.Repeat(",?", len(options.IgnoredTraceIDs)-1))
+		ignored := condition{query: fmt.Sprintf("TraceId NOT IN (%s)", "?"+strings.Repeat(",?", len(options.IgnoredTraceIDs)-1))}
 		for _, traceID := range options.IgnoredTraceIDs {
-			args = append(args, traceID)
+			ignored.args = append(ignored.args, traceID)
 		}
+		conditions = append(conditions, ignored)
+	}
+
+	where := joinConditions(conditions, " AND ")
+	query = query + " WHERE " + where.query + " GROUP BY TraceId"
+	args = append(args, where.args...)
+
+	if having != nil {
+		query = query + " HAVING " + having.query
+		args = append(args, having.args...)
 	}
 
-	// Sorting by service is required for early termination of primary key scan:
-	// * https://github.com/ClickHouse/ClickHouse/issues/7102
-	query = query + " ORDER BY ServiceName, -toUnixTimestamp(Timestamp) LIMIT ?"
-	args = append(args, options.SearchLimit-len(options.IgnoredTraceIDs))
+	// Only the traces with the most recent matching spans are aggregated over all of their
+	// spans, as aggregating every matching trace reads all spans of the time range. Trace
+	// filters may reject any number of traces, so a multiple of the limit is aggregated and
+	// filtered before the limit is applied then.
+	candidates := options.SearchLimit
+	if options.HasTraceFilters() {
+		candidates = options.SearchLimit * traceFilterCandidateFactor
+	}
+	query = query + " ORDER BY min(Timestamp) DESC, TraceId LIMIT ?"
+	args = append(args, candidates)
+
+	// The candidate traces are aggregated over all of their spans within the time range,
+	// so that they are ordered by the start of the trace rather than of the earliest span
+	// matching the search, and trace filters apply to whole traces
+	query = fmt.Sprintf(
+		"SELECT TraceId FROM %[1]s WHERE (Timestamp >= %[2]s AND Timestamp <= %[2]s) AND TraceId IN (%[3]s) GROUP BY TraceId",
+		r.table,
+		dateTime64Param,
+		query,
+	)
+	args = append([]interface{}{startTime.UnixNano(), endTime.UnixNano()}, args...)
+
+	if options.HasTraceFilters() {
+		having, havingArgs := traceFilters(options)
+		query = query + " HAVING " + having
+		args = append(args, havingArgs...)
+	}
+
+	// Traces are ordered by the start of their earliest span, most recent first, with the
+	// trace ID as tie-breaker to keep results stable between searches
+	query = query + " ORDER BY min(Timestamp) DESC, TraceId LIMIT ?"
+	args = append(args, options.SearchLimit)
 
 	return r.queryToStrings(ctx, query, args...)
 }
 
+// condition is a SQL condition along with the arguments of its placeholders
+type condition struct {
+	query string
+	args  []interface{}
+}
+
+func (c condition) parenthesize() condition {
+	return condition{"(" + c.query + ")", c.args}
+}
+
+// tagMatch is the condition of a tag. Negated tags also carry the condition they negate,
+// which matches the spans excluded by the tag.
+type tagMatch struct {
+	condition
+	positive *condition
+}
+
+// tagMatchConditions returns the conditions of the tags
+func tagMatchConditions(matches []tagMatch) []condition {
+	conditions := make([]condition, 0, len(matches))
+	for _, m := range matches {
+		conditions = append(conditions, m.condition)
+	}
+	return conditions
+}
+
+// joinConditions joins conditions with an operator such as " AND ".
+func joinConditions(conditions []condition, operator string) condition {
+	if len(conditions) == 1 {
+		return conditions[0]
+	}
+
+	queries := make([]string, 0, len(conditions))
+	var args []interface{}
+	for _, c := range conditions {
+		queries = append(queries, c.query)
+		args = append(args, c.args...)
+	}
+	return condition{strings.Join(queries, operator), args}
+}
+
+// tagConditions returns the conditions matching spans against each of the given tags.
+func (r *ClickhouseReader) tagConditions(ctx context.Context, tags map[string]string) ([]tagMatch, error) {
+	span := trace.SpanFromContext(ctx)
+
+	var conditions []tagMatch
+
+	for key, value := range tags {
+		if strings.ToLower(key) == "error" {
+			conditions = append(conditions, tagMatch{condition: condition{query: "StatusCode = 'STATUS_CODE_ERROR'"}})
+			if strings.ToLower(value) == "true" {
+				continue
+			}
+		}
+
+		expr, err := tagquery.ParseTag(key, value)
+		if err != nil {
+			r.logger.WarnContext(ctx, "unable to parse tag", "error", err)
+			return nil, err
+		}
+
+		span.SetAttributes(attribute.String("query-type", expr.Operator.String()))
+		span.SetAttributes(attribute.String("query-key", expr.Key))
+		span.SetAttributes(attribute.StringSlice("query-value", expr.Values))
+
+		query, args, err := r.tagCondition(expr)
+		if err != nil {
+			r.logger.WarnContext(ctx, "unable to compile tag", "error", err)
+			return nil, err
+		}
+		c := tagMatch{condition: condition{query, args}}
+
+		if expr.Operator.Negated() {
+			positiveQuery, positiveArgs, err := r.tagCondition(tagquery.Expr{Key: expr.Key, Operator: expr.Operator.Positive(), Values: expr.Values})
+			if err != nil {
+				r.logger.WarnContext(ctx, "unable to compile tag", "error", err)
+				return nil, err
+			}
+			c.positive = &condition{positiveQuery, positiveArgs}
+		}
+
+		conditions = append(conditions, c)
+	}
+
+	return conditions, nil
+}
+
+// childJoin returns a self-join restricting spans to those with a direct child span
+// matching the filter within the time range. Columns of the child spans are aliased to
+// keep unqualified column names of the searched spans unambiguous.
+func (r *ClickhouseReader) childJoin(ctx context.Context, child SpanFilter, startTime time.Time, endTime time.Time) (string, []interface{}, error) {
+	args := []interface{}{}
+	query := fmt.Sprintf("SELECT TraceId AS ChildTraceId, ParentSpanId AS ChildParentSpanId FROM %s WHERE", r.table)
+
+	if child.ServiceName != "" {
+		query = query + " ServiceName = ? AND"
+		args = append(args, child.ServiceName)
+	}
+
+	if child.SpanName != "" {
+		query = query + " SpanName = ? AND"
+		args = append(args, child.SpanName)
+	}
+
+	query = query + fmt.Sprintf(" (Timestamp >= %[1]s AND Timestamp <= %[1]s) AND ParentSpanId != ''", dateTime64Param)
+	args = append(args, startTime.UnixNano(), endTime.UnixNano())
+
+	tagConditions, err := r.tagConditions(ctx, child.Attributes)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, c := range tagConditions {
+		query = query + " AND " + c.query
+		args = append(args, c.args...)
+	}
+
+	return fmt.Sprintf(" INNER JOIN (%s) AS child ON TraceId = ChildTraceId AND SpanId = ChildParentSpanId", query), args, nil
+}
+
+// traceFilters returns the HAVING conditions for the trace filters of the search options,
+// to be used in a query grouping spans by TraceId.
+func traceFilters(options SearchOptions) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	traceDuration := "max(toUnixTimestamp64Nano(Timestamp) + toInt64(Duration)) - min(toUnixTimestamp64Nano(Timestamp))"
+
+	if options.MinTraceDuration != 0 {
+		conditions = append(conditions, traceDuration+" >= ?")
+		args = append(args, options.MinTraceDuration.Nanoseconds())
+	}
+
+	if options.MaxTraceDuration != 0 {
+		conditions = append(conditions, traceDuration+" <= ?")
+		args = append(args, options.MaxTraceDuration.Nanoseconds())
+	}
+
+	if options.MinSpanCount != 0 {
+		conditions = append(conditions, "count() >= ?")
+		args = append(args, options.MinSpanCount)
+	}
+
+	if options.MaxSpanCount != 0 {
+		conditions = append(conditions, "count() <= ?")
+		args = append(args, options.MaxSpanCount)
+	}
+
+	return strings.Join(conditions, " AND "), args
+}
+
+func (r *ClickhouseReader) GetDependencies(ctx context.Context, startTime time.Time, endTime time.Time) ([]ClickhouseDependencyLink, error) {
+	ctx, span := r.tracer.Start(ctx, "clickhousereader:GetDependencies")
+	span.SetAttributes(attribute.String("time-range", endTime.Sub(startTime).String()))
+	defer span.End()
+
+	links := []ClickhouseDependencyLink{}
+
+	if endTime.Before(startTime) || endTime.UTC() == startTime.UTC() {
+		return links, nil
+	}
+
+	var query string
+	var args []interface{}
+
+	if r.dependenciesTable != "" {
+		// Sum the pre-aggregated buckets maintained by the DependencyBuilder. FINAL
+		// collapses buckets that have been re-processed into their latest version. The
+		// bucket containing the start time is included as a whole.
+		query = fmt.Sprintf(
+			"SELECT Parent, Child, sum(CallCount) FROM %s FINAL WHERE Timestamp >= toDateTime(?) AND Timestamp < toDateTime(?) GROUP BY Parent, Child",
+			r.dependenciesTable,
+		)
+		args = []interface{}{startTime.Truncate(r.dependenciesBucket).Unix(), endTime.Unix()}
+	} else {
+		query = dependenciesQuery(r.table)
+		args = []interface{}{startTime.Unix(), endTime.Unix(), startTime.Unix(), endTime.Unix()}
+	}
+
+	span.SetAttributes(
+		semconv.DBSystemClickhouse,
+		semconv.DBStatement(query),
+		semconv.DBSQLTable(r.table),
+	)
+
+	rows, err := r.db.QueryContext(r.queryContext(ctx), query, args...)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "unable to execute query", "error", err)
+		span.SetStatus(codes.Error, "unable to execute query")
+		span.RecordError(err)
+		return nil, queryError(err)
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var link ClickhouseDependencyLink
+		if err := rows.Scan(&link.Parent, &link.Child, &link.CallCount); err != nil {
+			r.logger.ErrorContext(ctx, "unable to scan row results", "error", err)
+			span.SetStatus(codes.Error, "unable to scan row results")
+			span.RecordError(err)
+			return nil, err
+		}
+		links = append(links, link)
+	}
+
+	if err := rows.Err(); err != nil {
+		r.logger.ErrorContext(ctx, "received errors in rows", "error", err)
+		span.SetStatus(codes.Error, "received errors in rows")
+		span.RecordError(err)
+		return nil, queryError(err)
+	}
+
+	return links, nil
+}
+
 func (r *ClickhouseReader) queryToStrings(ctx context.Context, sql string, args ...interface{}) ([]string, error) {
 	ctx, span := r.tracer.Start(ctx, "clickhousereader:queryToStrings")
 	defer span.End()
@@ -184,12 +532,12 @@ func (r *ClickhouseReader) queryToStrings(ctx context.Context, sql string, args
 		semconv.DBSQLTable(r.table),
 	)
 
-	rows, err := r.db.QueryContext(ctx, sql, args...)
+	rows, err := r.db.QueryContext(r.queryContext(ctx), sql, args...)
 	if err != nil {
 		r.logger.ErrorContext(ctx, "unable to execute query", "error", err)
 		span.SetStatus(codes.Error, "unable to execute query")
 		span.RecordError(err)
-		return nil, err
+		return nil, queryError(err)
 	}
 
 	defer func() { _ = rows.Close() }()
@@ -211,7 +559,7 @@ func (r *ClickhouseReader) queryToStrings(ctx context.Context, sql string, args
 		r.logger.ErrorContext(ctx, "received errors in rows", "error", err)
 		span.SetStatus(codes.Error, "received errors in rows")
 		span.RecordError(err)
-		return nil, err
+		return nil, queryError(err)
 	}
 
 	return values, nil
@@ -239,10 +587,18 @@ func (r *ClickhouseReader) getTraces(ctx context.Context, traceIDs []string) ([]
 	}
 
 	query := fmt.Sprintf(
-		"SELECT Timestamp, TraceId, SpanId, ParentSpanId, TraceState, SpanName, SpanKind, ServiceName, ResourceAttributes, ScopeName, ScopeVersion, SpanAttributes, Duration, StatusCode, StatusMessage, Events.Timestamp, Events.Name, Events.Attributes FROM %s PREWHERE TraceId IN (%s)",
+		"SELECT %s FROM %s PREWHERE TraceId IN (%s)",
+		r.schema.selectColumns(),
 		r.table,
 		"?"+strings.Repeat(",?", len(traceIDSearch)-1),
 	)
+	args := traceIDSearch
+
+	if start, end, ok := r.traceTimeBounds(ctx, traceIDSearch); ok {
+		// The bounds may have been truncated to seconds, so the end is extended by a second
+		query = query + " WHERE Timestamp >= toDateTime(?) AND Timestamp <= toDateTime(?)"
+		args = append(args, start.Unix(), end.Unix()+1)
+	}
 
 	span.SetAttributes(
 		semconv.DBSystemClickhouse,
@@ -250,12 +606,12 @@ func (r *ClickhouseReader) getTraces(ctx context.Context, traceIDs []string) ([]
 		semconv.DBSQLTable(r.table),
 	)
 
-	rows, err := r.db.QueryContext(ctx, query, traceIDSearch...)
+	rows, err := r.db.QueryContext(r.queryContext(ctx), query, args...)
 	if err != nil {
 		r.logger.ErrorContext(ctx, "unable to execute query", "error", err)
 		span.SetStatus(codes.Error, "unable to execute query")
 		span.RecordError(err)
-		return nil, err
+		return nil, queryError(err)
 	}
 
 	defer func() { _ = rows.Close() }()
@@ -263,13 +619,8 @@ func (r *ClickhouseReader) getTraces(ctx context.Context, traceIDs []string) ([]
 	traceMap := map[string]*ClickhouseOtelTrace{}
 
 	for rows.Next() {
-		var s ClickhouseOtelSpan
-
-		if err := rows.Scan(
-			&s.Timestamp, &s.TraceID, &s.SpanID, &s.ParentSpanID, &s.TraceState, &s.SpanName, &s.SpanKind,
-			&s.ServiceName, &s.ResourceAttributes, &s.ScopeName, &s.ScopeVersion, &s.SpanAttributes, &s.Duration,
-			&s.StatusCode, &s.StatusMessage, &s.EventsTimestamp, &s.EventsName, &s.EventsAttributes,
-		); err != nil {
+		s, err := r.schema.scanSpan(rows)
+		if err != nil {
 			r.logger.ErrorContext(ctx, "unable to map to structure", "error", err)
 			span.SetStatus(codes.Error, "unable to map to structure")
 			span.RecordError(err)
@@ -282,11 +633,89 @@ func (r *ClickhouseReader) getTraces(ctx context.Context, traceIDs []string) ([]
 		traceMap[s.TraceID].Spans = append(traceMap[s.TraceID].Spans, s)
 	}
 
+	if err := rows.Err(); err != nil {
+		r.logger.ErrorContext(ctx, "received errors in rows", "error", err)
+		span.SetStatus(codes.Error, "received errors in rows")
+		span.RecordError(err)
+		return nil, queryError(err)
+	}
+
+	// Traces are returned in the order they were requested in
+	for _, traceID := range traceIDs {
+		if t, ok := traceMap[traceID]; ok {
+			traces = append(traces, t)
+			delete(traceMap, traceID)
+		}
+	}
+
+	// Traces stored with IDs in a different format than requested are appended sorted
+	remaining := make([]*ClickhouseOtelTrace, 0, len(traceMap))
 	for _, t := range traceMap {
-		traces = append(traces, t)
+		remaining = append(remaining, t)
+	}
+	sort.Slice(remaining, func(i, j int) bool { return remaining[i].TraceID < remaining[j].TraceID })
+
+	return append(traces, remaining...), nil
+}
+
+// traceTimeBounds looks up the earliest start and latest end of the given traces in the
+// trace ID to timestamp table. It reports false when the lookup is disabled or fails, or
+// when any of the traces is unknown to the table, such as traces written before the table
+// existed, in which case traces are read unbounded so that none of them is missed. If the
+// table does not exist, lookups are disabled for the lifetime of the reader.
+func (r *ClickhouseReader) traceTimeBounds(ctx context.Context, traceIDs []interface{}) (time.Time, time.Time, bool) {
+	var start, end time.Time
+
+	if r.traceIDTsTable == "" || r.traceIDTsDisabled.Load() {
+		return start, end, false
+	}
+
+	ctx, span := r.tracer.Start(ctx, "clickhousereader:traceTimeBounds")
+	defer span.End()
+
+	query := fmt.Sprintf(
+		"SELECT min(Start), max(End), uniqExact(TraceId) FROM %s WHERE TraceId IN (%s)",
+		r.traceIDTsTable,
+		"?"+strings.Repeat(",?", len(traceIDs)-1),
+	)
+
+	span.SetAttributes(
+		semconv.DBSystemClickhouse,
+		semconv.DBStatement(query),
+		semconv.DBSQLTable(r.traceIDTsTable),
+	)
+
+	var found uint64
+	if err := r.db.QueryRowContext(r.queryContext(ctx), query, traceIDs...).Scan(&start, &end, &found); err != nil {
+		var exception *clickhouse.Exception
+		if errors.As(err, &exception) && exception.Code == errCodeUnknownTable {
+			r.logger.WarnContext(ctx, "trace id lookup table does not exist, disabling lookups", "table", r.traceIDTsTable)
+			r.traceIDTsDisabled.Store(true)
+		} else {
+			r.logger.WarnContext(ctx, "unable to look up trace time bounds", "error", err)
+		}
+		span.SetStatus(codes.Error, "unable to look up trace time bounds")
+		span.RecordError(err)
+		return start, end, false
+	}
+
+	// Aggregating no rows results in zero values rather than NULL
+	if start.Unix() <= 0 || end.Unix() <= 0 {
+		return start, end, false
+	}
+
+	unique := map[interface{}]struct{}{}
+	for _, traceID := range traceIDs {
+		unique[traceID] = struct{}{}
+	}
+	if found < uint64(len(unique)) {
+		span.SetAttributes(attribute.Int64("missing-trace-ids", int64(len(unique))-int64(found)))
+		return start, end, false
 	}
 
-	return traces, nil
+	span.SetAttributes(attribute.String("time-range", end.Sub(start).String()))
+
+	return start, end, true
 }
 
 // Normalize trace IDs to contain 32 characters with zeros prepended
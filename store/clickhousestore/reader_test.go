@@ -1,10 +1,16 @@
 package clickhousestore
 
 import (
+	"context"
+	"database/sql/driver"
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/tagquery"
 	"github.com/stretchr/testify/assert"
 	"go.opentelemetry.io/otel/trace"
+	"regexp"
 	"testing"
+	"time"
 )
 
 func TestClickhouseReader_padTraceIDs(t *testing.T) {
@@ -48,3 +54,684 @@ func TestClickhouseReader_padTraceIDs_skiplen(t *testing.T) {
 	res := cr.padTraceIDs([]string{"0c91fd0eb7e1193f8", "0c91fd0eb7e1193f9"})
 	assert.Equal(t, []string{"0c91fd0eb7e1193f8", "0c91fd0eb7e1193f9"}, res)
 }
+
+func TestClickhouseReader_GetDependencies(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	endTime := time.Now()
+	startTime := endTime.Add(-time.Hour)
+
+	rows := sqlmock.NewRows([]string{"parent", "child", "count"}).
+		AddRow("frontend", "backend", uint64(10)).
+		AddRow("backend", "database", uint64(4))
+
+	mock.ExpectQuery(`INNER JOIN .* ON parent.TraceId = child.TraceId AND parent.SpanId = child.ParentSpanId`).
+		WithArgs(startTime.Unix(), endTime.Unix(), startTime.Unix(), endTime.Unix()).
+		WillReturnRows(rows)
+
+	cr := New("test", false, db, tracer)
+	res, err := cr.GetDependencies(context.Background(), startTime, endTime)
+	assert.NoError(t, err)
+	assert.Equal(t, []ClickhouseDependencyLink{
+		{Parent: "frontend", Child: "backend", CallCount: 10},
+		{Parent: "backend", Child: "database", CallCount: 4},
+	}, res)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_GetDependencies_table(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	// The bucket containing the start time is read as a whole
+	startTime := time.Date(2024, 4, 1, 12, 3, 20, 0, time.UTC)
+	endTime := startTime.Add(time.Hour)
+	bucketStart := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	rows := sqlmock.NewRows([]string{"Parent", "Child", "CallCount"}).
+		AddRow("frontend", "backend", uint64(10))
+
+	mock.ExpectQuery(`SELECT Parent, Child, sum\(CallCount\) FROM test_dependencies FINAL`).
+		WithArgs(bucketStart.Unix(), endTime.Unix()).
+		WillReturnRows(rows)
+
+	cr := New("test", false, db, tracer, WithDependenciesTable("test_dependencies", 5*time.Minute))
+	res, err := cr.GetDependencies(context.Background(), startTime, endTime)
+	assert.NoError(t, err)
+	assert.Equal(t, []ClickhouseDependencyLink{{Parent: "frontend", Child: "backend", CallCount: 10}}, res)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_GetTrace(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(passthroughConverter{}))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	timestamp := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	rows := mock.NewRows([]string{
+		"Timestamp", "TraceId", "SpanId", "ParentSpanId", "TraceState", "SpanName", "SpanKind", "ServiceName",
+		"ResourceAttributes", "ScopeName", "ScopeVersion", "SpanAttributes", "Duration", "StatusCode", "StatusMessage",
+		"Events.Timestamp", "Events.Name", "Events.Attributes",
+		"Links.TraceId", "Links.SpanId", "Links.TraceState", "Links.Attributes",
+	}).AddRow(
+		timestamp, TestDataTraceIDOne, "0d8fd33795ba49aa", "a7d2aa025caa9cb8", "", TestDataSpanNameTwo, "SPAN_KIND_CONSUMER", TestDataServiceNameTwo,
+		map[string]string{}, "", "", map[string]string{}, int64(3600), "STATUS_CODE_UNSET", "",
+		[]time.Time{}, []string{}, []map[string]string{},
+		[]string{TestDataTraceIDTwo}, []string{"a7d2aa025caa9cb8"}, []string{"congo=t61rcWkgMzE"}, []map[string]string{{"messaging.system": "kafka"}},
+	)
+
+	mock.ExpectQuery(`SELECT .*Links.TraceId, Links.SpanId, Links.TraceState, Links.Attributes FROM test PREWHERE TraceId IN \(\?\)`).
+		WithArgs(TestDataTraceIDOne).
+		WillReturnRows(rows)
+
+	cr := New("test", false, db, tracer)
+	res, err := cr.GetTrace(context.Background(), TestDataTraceIDOne)
+	assert.NoError(t, err)
+	assert.Equal(t, TestDataTraceIDOne, res.TraceID)
+	assert.Equal(t, 1, len(res.Spans))
+	assert.Equal(t, []string{TestDataTraceIDTwo}, res.Spans[0].LinksTraceID)
+	assert.Equal(t, []string{"a7d2aa025caa9cb8"}, res.Spans[0].LinksSpanID)
+	assert.Equal(t, []string{"congo=t61rcWkgMzE"}, res.Spans[0].LinksTraceState)
+	assert.Equal(t, []map[string]string{{"messaging.system": "kafka"}}, res.Spans[0].LinksAttributes)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_GetTraces_order(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(passthroughConverter{}))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	timestamp := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	rows := mock.NewRows([]string{
+		"Timestamp", "TraceId", "SpanId", "ParentSpanId", "TraceState", "SpanName", "SpanKind", "ServiceName",
+		"ResourceAttributes", "ScopeName", "ScopeVersion", "SpanAttributes", "Duration", "StatusCode", "StatusMessage",
+		"Events.Timestamp", "Events.Name", "Events.Attributes",
+		"Links.TraceId", "Links.SpanId", "Links.TraceState", "Links.Attributes",
+	})
+	for _, traceID := range []string{TestDataTraceIDTwo, TestDataTraceIDOne, TestDataTraceIDTwo} {
+		rows.AddRow(
+			timestamp, traceID, "0d8fd33795ba49aa", "", "", TestDataSpanNameOne, "SPAN_KIND_SERVER", TestDataServiceNameOne,
+			map[string]string{}, "", "", map[string]string{}, int64(3600), "STATUS_CODE_UNSET", "",
+			[]time.Time{}, []string{}, []map[string]string{},
+			[]string{}, []string{}, []string{}, []map[string]string{},
+		)
+	}
+
+	mock.ExpectQuery(`SELECT .* FROM test PREWHERE TraceId IN \(\?,\?\)`).
+		WithArgs(TestDataTraceIDOne, TestDataTraceIDTwo).
+		WillReturnRows(rows)
+
+	cr := New("test", false, db, tracer)
+	res, err := cr.GetTraces(context.Background(), []string{TestDataTraceIDOne, TestDataTraceIDTwo})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(res))
+	assert.Equal(t, TestDataTraceIDOne, res[0].TraceID)
+	assert.Equal(t, 1, len(res[0].Spans))
+	assert.Equal(t, TestDataTraceIDTwo, res[1].TraceID)
+	assert.Equal(t, 2, len(res[1].Spans))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_SearchTraces_typedAttributes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	endTime := time.Now()
+	startTime := endTime.Add(-time.Hour)
+
+	mock.ExpectQuery(`SELECT TraceId FROM test WHERE ServiceName = \? AND \(Timestamp >= fromUnixTimestamp64Nano\(toInt64\(\?\)\) AND Timestamp <= fromUnixTimestamp64Nano\(toInt64\(\?\)\)\) AND \(toInt64OrNull\(SpanAttributes\[\?\]\) = \? OR toInt64OrNull\(ResourceAttributes\[\?\]\) = \?\) GROUP BY TraceId`).
+		WithArgs(startTime.UnixNano(), endTime.UnixNano(), TestDataServiceNameOne, startTime.UnixNano(), endTime.UnixNano(), "http.status_code", int64(500), "http.status_code", int64(500), 20, 20).
+		WillReturnRows(sqlmock.NewRows([]string{"TraceId"}).AddRow(TestDataTraceIDOne))
+
+	cr := New("test", false, db, tracer)
+	res, err := cr.SearchTraces(context.Background(), TestDataServiceNameOne, startTime, endTime, SearchOptions{
+		Attributes:  map[string]string{"http.status_code": "500"},
+		SearchLimit: 20,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{TestDataTraceIDOne}, res)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_SearchTraces_subSecondRange(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	startTime := time.Date(2024, 4, 1, 12, 0, 0, 123456789, time.UTC)
+	endTime := startTime.Add(250 * time.Millisecond)
+
+	// Matching traces are ordered by the earliest of all their spans rather than of the
+	// spans matching the search
+	mock.ExpectQuery(regexp.QuoteMeta(
+		"SELECT TraceId FROM test WHERE (Timestamp >= fromUnixTimestamp64Nano(toInt64(?)) AND Timestamp <= fromUnixTimestamp64Nano(toInt64(?))) AND TraceId IN ("+
+			"SELECT TraceId FROM test WHERE ServiceName = ? AND SpanName = ? AND (Timestamp >= fromUnixTimestamp64Nano(toInt64(?)) AND Timestamp <= fromUnixTimestamp64Nano(toInt64(?))) GROUP BY TraceId ORDER BY min(Timestamp) DESC, TraceId LIMIT ?"+
+			") GROUP BY TraceId ORDER BY min(Timestamp) DESC, TraceId LIMIT ?",
+	)).
+		WithArgs(int64(1711972800123456789), int64(1711972800373456789), TestDataServiceNameOne, TestDataSpanNameOne, int64(1711972800123456789), int64(1711972800373456789), 20, 20).
+		WillReturnRows(sqlmock.NewRows([]string{"TraceId"}).AddRow(TestDataTraceIDOne))
+
+	cr := New("test", false, db, tracer)
+	res, err := cr.SearchTraces(context.Background(), TestDataServiceNameOne, startTime, endTime, SearchOptions{
+		SpanName:    TestDataSpanNameOne,
+		SearchLimit: 20,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{TestDataTraceIDOne}, res)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_SearchTraces_allServices(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	endTime := time.Now()
+	startTime := endTime.Add(-time.Hour)
+
+	mock.ExpectQuery(`SELECT TraceId FROM test WHERE \(Timestamp >= fromUnixTimestamp64Nano\(toInt64\(\?\)\) AND Timestamp <= fromUnixTimestamp64Nano\(toInt64\(\?\)\)\) AND \(SpanAttributes\[\?\] = \? OR ResourceAttributes\[\?\] = \?\) GROUP BY TraceId`).
+		WithArgs(startTime.UnixNano(), endTime.UnixNano(), startTime.UnixNano(), endTime.UnixNano(), "http.url", "http://example.com", "http.url", "http://example.com", 20, 20).
+		WillReturnRows(sqlmock.NewRows([]string{"TraceId"}).AddRow(TestDataTraceIDOne))
+
+	cr := New("test", false, db, tracer)
+	res, err := cr.SearchTraces(context.Background(), "", startTime, endTime, SearchOptions{
+		Attributes:  map[string]string{"http.url": "http://example.com"},
+		SearchLimit: 20,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{TestDataTraceIDOne}, res)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_SearchTraces_tags(t *testing.T) {
+	tests := []struct {
+		name      string
+		tags      map[string]string
+		condition string
+		args      []driver.Value
+	}{
+		{
+			name:      "span and resource attributes",
+			tags:      map[string]string{"deployment.environment": "prod"},
+			condition: `\(SpanAttributes\[\?\] = \? OR ResourceAttributes\[\?\] = \?\)`,
+			args:      []driver.Value{"deployment.environment", "prod", "deployment.environment", "prod"},
+		},
+		{
+			name:      "resource attributes",
+			tags:      map[string]string{"resource:k8s.pod.name": "frontend-%"},
+			condition: `\(ResourceAttributes\[\?\] LIKE \? AND ResourceAttributes\[\?\] != ''\)`,
+			args:      []driver.Value{"k8s.pod.name", "frontend-%", "k8s.pod.name"},
+		},
+		{
+			name:      "span attributes",
+			tags:      map[string]string{"span:http.route": "~^/api/"},
+			condition: `match\(SpanAttributes\[\?\], \?\)`,
+			args:      []driver.Value{"http.route", "^/api/"},
+		},
+		{
+			name:      "attribute key with scope name",
+			tags:      map[string]string{"span.name": "checkout"},
+			condition: `\(SpanAttributes\[\?\] = \? OR ResourceAttributes\[\?\] = \?\)`,
+			args:      []driver.Value{"span.name", "checkout", "span.name", "checkout"},
+		},
+		{
+			name:      "span kind",
+			tags:      map[string]string{"span.kind": "Server"},
+			condition: `lower\(replaceOne\(SpanKind, 'SPAN_KIND_', ''\)\) = \?`,
+			args:      []driver.Value{"server"},
+		},
+		{
+			name:      "status message column",
+			tags:      map[string]string{"StatusMessage": "timeout"},
+			condition: `StatusMessage = \?`,
+			args:      []driver.Value{"timeout"},
+		},
+		{
+			name:      "numeric comparison",
+			tags:      map[string]string{"http.status_code>": "500"},
+			condition: `\(toInt64OrNull\(SpanAttributes\[\?\]\) >= \? OR toInt64OrNull\(ResourceAttributes\[\?\]\) >= \?\)`,
+			args:      []driver.Value{"http.status_code", int64(500), "http.status_code", int64(500)},
+		},
+		{
+			name:      "not exists",
+			tags:      map[string]string{"!peer.service": ""},
+			condition: `\(SpanAttributes\[\?\] = '' AND ResourceAttributes\[\?\] = ''\)`,
+			args:      []driver.Value{"peer.service", "peer.service"},
+		},
+		{
+			name:      "in list",
+			tags:      map[string]string{"resource:cloud.region": "[us-east-1,us-west-2]"},
+			condition: `ResourceAttributes\[\?\] IN \(\?, \?\)`,
+			args:      []driver.Value{"cloud.region", "us-east-1", "us-west-2"},
+		},
+		{
+			name:      "scope name",
+			tags:      map[string]string{"otel.scope.name": "io.opentelemetry.jdbc"},
+			condition: `ScopeName = \?`,
+			args:      []driver.Value{"io.opentelemetry.jdbc"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+			endTime := time.Now()
+			startTime := endTime.Add(-time.Hour)
+
+			args := append([]driver.Value{startTime.UnixNano(), endTime.UnixNano(), TestDataServiceNameOne, startTime.UnixNano(), endTime.UnixNano()}, tt.args...)
+			mock.ExpectQuery(`SELECT TraceId FROM test WHERE ServiceName = \? AND \(.*\) AND ` + tt.condition + ` GROUP BY TraceId`).
+				WithArgs(append(args, 20, 20)...).
+				WillReturnRows(sqlmock.NewRows([]string{"TraceId"}).AddRow(TestDataTraceIDOne))
+
+			cr := New("test", false, db, tracer)
+			res, err := cr.SearchTraces(context.Background(), TestDataServiceNameOne, startTime, endTime, SearchOptions{
+				Attributes:  tt.tags,
+				SearchLimit: 20,
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, []string{TestDataTraceIDOne}, res)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestClickhouseReader_SearchTraces_tagsMissingColumns(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	// Tables of older exporter versions lack the scope, trace state and status message
+	columns := map[string]string{}
+	for name, columnType := range DefaultSchema().columns {
+		columns[name] = columnType
+	}
+	delete(columns, "ScopeName")
+	delete(columns, "ScopeVersion")
+	delete(columns, "TraceState")
+	delete(columns, "StatusMessage")
+	schema, err := ParseSchema(columns)
+	assert.NoError(t, err)
+
+	endTime := time.Now()
+	startTime := endTime.Add(-time.Hour)
+
+	// Tags of the missing columns are matched against attributes instead
+	mock.ExpectQuery(`SELECT TraceId FROM test WHERE ServiceName = \? AND \(.*\) AND \(SpanAttributes\[\?\] = \? OR ResourceAttributes\[\?\] = \?\) GROUP BY TraceId`).
+		WithArgs(startTime.UnixNano(), endTime.UnixNano(), TestDataServiceNameOne, startTime.UnixNano(), endTime.UnixNano(), "otel.scope.name", "io.opentelemetry.jdbc", "otel.scope.name", "io.opentelemetry.jdbc", 20, 20).
+		WillReturnRows(sqlmock.NewRows([]string{"TraceId"}).AddRow(TestDataTraceIDOne))
+
+	cr := New("test", false, db, tracer)
+	cr.schema = schema
+	res, err := cr.SearchTraces(context.Background(), TestDataServiceNameOne, startTime, endTime, SearchOptions{
+		Attributes:  map[string]string{"otel.scope.name": "io.opentelemetry.jdbc"},
+		SearchLimit: 20,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{TestDataTraceIDOne}, res)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_SearchTraces_child(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	endTime := time.Now()
+	startTime := endTime.Add(-time.Hour)
+
+	mock.ExpectQuery(`SELECT TraceId FROM test INNER JOIN \(SELECT TraceId AS ChildTraceId, ParentSpanId AS ChildParentSpanId FROM test WHERE ServiceName = \? AND SpanName = \? AND \(Timestamp >= .* AND Timestamp <= .*\) AND ParentSpanId != '' AND StatusCode = 'STATUS_CODE_ERROR'\) AS child ON TraceId = ChildTraceId AND SpanId = ChildParentSpanId WHERE ServiceName = \? AND \(Timestamp >= .* AND Timestamp <= .*\) GROUP BY TraceId`).
+		WithArgs(startTime.UnixNano(), endTime.UnixNano(), "payments", "charge", startTime.UnixNano(), endTime.UnixNano(), "checkout", startTime.UnixNano(), endTime.UnixNano(), 20, 20).
+		WillReturnRows(sqlmock.NewRows([]string{"TraceId"}).AddRow(TestDataTraceIDOne))
+
+	cr := New("test", false, db, tracer)
+	res, err := cr.SearchTraces(context.Background(), "checkout", startTime, endTime, SearchOptions{
+		Child: &SpanFilter{
+			ServiceName: "payments",
+			SpanName:    "charge",
+			Attributes:  map[string]string{"error": "true"},
+		},
+		SearchLimit: 20,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{TestDataTraceIDOne}, res)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_SearchTraces_matchTrace(t *testing.T) {
+	endTime := time.Now()
+	startTime := endTime.Add(-time.Hour)
+
+	spanMatch := `\(ServiceName = \? AND SpanName = \? AND Duration >= \?\)`
+	tagMatch := `\(SpanAttributes\[\?\] = \? OR ResourceAttributes\[\?\] = \?\)`
+	existsMatch := `\(SpanAttributes\[\?\] != '' OR ResourceAttributes\[\?\] != ''\)`
+
+	tests := []struct {
+		name  string
+		tags  map[string]string
+		query string
+		args  []driver.Value
+	}{
+		{
+			name:  "any span matches",
+			tags:  map[string]string{"db.system": "postgresql"},
+			query: `AND \(` + spanMatch + ` OR ` + tagMatch + `\) AND TraceId NOT IN \(\?\) GROUP BY TraceId HAVING countIf\(` + spanMatch + `\) > 0 AND countIf\(` + tagMatch + `\) > 0 ORDER BY min\(Timestamp\) DESC, TraceId LIMIT \?\)`,
+			args: []driver.Value{
+				"frontend", "GET /", time.Second.Nanoseconds(), "db.system", "postgresql", "db.system", "postgresql",
+				TestDataTraceIDTwo,
+				"frontend", "GET /", time.Second.Nanoseconds(), "db.system", "postgresql", "db.system", "postgresql",
+			},
+		},
+		{
+			// Spans having the attribute are aggregated, so that traces with any of them
+			// are excluded
+			name:  "no span has attribute",
+			tags:  map[string]string{"!peer.service": ""},
+			query: `AND \(` + spanMatch + ` OR ` + existsMatch + `\) AND TraceId NOT IN \(\?\) GROUP BY TraceId HAVING countIf\(` + spanMatch + `\) > 0 AND countIf\(` + existsMatch + `\) = 0 ORDER BY min\(Timestamp\) DESC, TraceId LIMIT \?\)`,
+			args: []driver.Value{
+				"frontend", "GET /", time.Second.Nanoseconds(), "peer.service", "peer.service",
+				TestDataTraceIDTwo,
+				"frontend", "GET /", time.Second.Nanoseconds(), "peer.service", "peer.service",
+			},
+		},
+		{
+			name:  "no span has value",
+			tags:  map[string]string{"db.system!": "postgresql"},
+			query: `AND \(` + spanMatch + ` OR ` + tagMatch + `\) AND TraceId NOT IN \(\?\) GROUP BY TraceId HAVING countIf\(` + spanMatch + `\) > 0 AND countIf\(` + tagMatch + `\) = 0 ORDER BY min\(Timestamp\) DESC, TraceId LIMIT \?\)`,
+			args: []driver.Value{
+				"frontend", "GET /", time.Second.Nanoseconds(), "db.system", "postgresql", "db.system", "postgresql",
+				TestDataTraceIDTwo,
+				"frontend", "GET /", time.Second.Nanoseconds(), "db.system", "postgresql", "db.system", "postgresql",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+			args := append([]driver.Value{startTime.UnixNano(), endTime.UnixNano(), startTime.UnixNano(), endTime.UnixNano()}, tt.args...)
+			mock.ExpectQuery(`SELECT TraceId FROM test WHERE \(Timestamp >= .* AND Timestamp <= .*\) ` + tt.query + ` GROUP BY TraceId ORDER BY`).
+				WithArgs(append(args, 20, 20)...).
+				WillReturnRows(sqlmock.NewRows([]string{"TraceId"}).AddRow(TestDataTraceIDOne))
+
+			cr := New("test", false, db, tracer)
+			res, err := cr.SearchTraces(context.Background(), "frontend", startTime, endTime, SearchOptions{
+				SpanName:        "GET /",
+				MinDuration:     time.Second,
+				Attributes:      tt.tags,
+				IgnoredTraceIDs: []string{TestDataTraceIDTwo},
+				MatchTrace:      true,
+				SearchLimit:     20,
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, []string{TestDataTraceIDOne}, res)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestClickhouseReader_SearchTraces_matchTraceNegatedOnly(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	endTime := time.Now()
+	startTime := endTime.Add(-time.Hour)
+
+	// Traces without any span having the attribute have no span matching a condition, so
+	// all spans within the time range are aggregated
+	existsMatch := `\(SpanAttributes\[\?\] != '' OR ResourceAttributes\[\?\] != ''\)`
+	mock.ExpectQuery(`SELECT TraceId FROM test WHERE \(Timestamp >= .* AND Timestamp <= .*\) GROUP BY TraceId HAVING countIf\(`+existsMatch+`\) = 0 ORDER BY min\(Timestamp\) DESC, TraceId LIMIT \?\) GROUP BY TraceId ORDER BY`).
+		WithArgs(startTime.UnixNano(), endTime.UnixNano(), startTime.UnixNano(), endTime.UnixNano(), "peer.service", "peer.service", 20, 20).
+		WillReturnRows(sqlmock.NewRows([]string{"TraceId"}).AddRow(TestDataTraceIDOne))
+
+	cr := New("test", false, db, tracer)
+	res, err := cr.SearchTraces(context.Background(), "", startTime, endTime, SearchOptions{
+		Attributes:  map[string]string{"!peer.service": ""},
+		MatchTrace:  true,
+		SearchLimit: 20,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{TestDataTraceIDOne}, res)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_SearchTraces_invalidTag(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	endTime := time.Now()
+	startTime := endTime.Add(-time.Hour)
+
+	cr := New("test", false, db, tracer)
+	_, err = cr.SearchTraces(context.Background(), TestDataServiceNameOne, startTime, endTime, SearchOptions{
+		Attributes:  map[string]string{"http.status_code>": "error"},
+		SearchLimit: 20,
+	})
+	assert.ErrorIs(t, err, tagquery.ErrSyntax)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_SearchTraces_traceFilters(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	endTime := time.Now()
+	startTime := endTime.Add(-time.Hour)
+
+	mock.ExpectQuery(`SELECT TraceId FROM test WHERE \(Timestamp >= .* AND Timestamp <= .*\) AND TraceId IN \(SELECT TraceId FROM test WHERE ServiceName = \? AND .* GROUP BY TraceId ORDER BY min\(Timestamp\) DESC, TraceId LIMIT \?\) GROUP BY TraceId HAVING max\(toUnixTimestamp64Nano\(Timestamp\) \+ toInt64\(Duration\)\) - min\(toUnixTimestamp64Nano\(Timestamp\)\) >= \? AND count\(\) >= \? AND count\(\) <= \? ORDER BY min\(Timestamp\) DESC, TraceId LIMIT \?`).
+		WithArgs(startTime.UnixNano(), endTime.UnixNano(), TestDataServiceNameOne, startTime.UnixNano(), endTime.UnixNano(), 20*traceFilterCandidateFactor, (2 * time.Second).Nanoseconds(), 5, 50, 20).
+		WillReturnRows(sqlmock.NewRows([]string{"TraceId"}).AddRow(TestDataTraceIDOne))
+
+	cr := New("test", false, db, tracer)
+	res, err := cr.SearchTraces(context.Background(), TestDataServiceNameOne, startTime, endTime, SearchOptions{
+		MinTraceDuration: 2 * time.Second,
+		MinSpanCount:     5,
+		MaxSpanCount:     50,
+		SearchLimit:      20,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{TestDataTraceIDOne}, res)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_SearchTraces_traceFiltersOlderTraces(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	endTime := time.Date(2024, 4, 1, 13, 0, 0, 0, time.UTC)
+	startTime := endTime.Add(-time.Hour)
+
+	// The only trace longer than a minute started at the beginning of the range, behind
+	// more recent, shorter traces. Candidate traces are filtered before the limit is
+	// applied, so it is found rather than cut off with the most recent traces.
+	mock.ExpectQuery(regexp.QuoteMeta(
+		"SELECT TraceId FROM test WHERE (Timestamp >= fromUnixTimestamp64Nano(toInt64(?)) AND Timestamp <= fromUnixTimestamp64Nano(toInt64(?))) AND TraceId IN ("+
+			"SELECT TraceId FROM test WHERE ServiceName = ? AND (Timestamp >= fromUnixTimestamp64Nano(toInt64(?)) AND Timestamp <= fromUnixTimestamp64Nano(toInt64(?))) GROUP BY TraceId ORDER BY min(Timestamp) DESC, TraceId LIMIT ?"+
+			") GROUP BY TraceId HAVING max(toUnixTimestamp64Nano(Timestamp) + toInt64(Duration)) - min(toUnixTimestamp64Nano(Timestamp)) >= ? ORDER BY min(Timestamp) DESC, TraceId LIMIT ?",
+	)).
+		WithArgs(startTime.UnixNano(), endTime.UnixNano(), TestDataServiceNameOne, startTime.UnixNano(), endTime.UnixNano(), traceFilterCandidateFactor, time.Minute.Nanoseconds(), 1).
+		WillReturnRows(sqlmock.NewRows([]string{"TraceId"}).AddRow(TestDataTraceIDTwo))
+
+	cr := New("test", false, db, tracer)
+	res, err := cr.SearchTraces(context.Background(), TestDataServiceNameOne, startTime, endTime, SearchOptions{
+		MinTraceDuration: time.Minute,
+		SearchLimit:      1,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{TestDataTraceIDTwo}, res)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_GetTrace_traceIDTsTable(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	start := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	end := start.Add(time.Minute)
+
+	mock.ExpectQuery(`SELECT min\(Start\), max\(End\), uniqExact\(TraceId\) FROM test_trace_id_ts WHERE TraceId IN \(\?\)`).
+		WithArgs(TestDataTraceIDOne).
+		WillReturnRows(sqlmock.NewRows([]string{"Start", "End", "Found"}).AddRow(start, end, uint64(1)))
+	mock.ExpectQuery(`SELECT .* FROM test PREWHERE TraceId IN \(\?\) WHERE Timestamp >= toDateTime\(\?\) AND Timestamp <= toDateTime\(\?\)`).
+		WithArgs(TestDataTraceIDOne, start.Unix(), end.Unix()+1).
+		WillReturnRows(sqlmock.NewRows([]string{"Timestamp"}))
+
+	cr := New("test", false, db, tracer, WithTraceIDTsTable("test_trace_id_ts"))
+	_, err = cr.GetTrace(context.Background(), TestDataTraceIDOne)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_GetTrace_traceIDTsTable_unknownTrace(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	mock.ExpectQuery(`SELECT min\(Start\), max\(End\), uniqExact\(TraceId\) FROM test_trace_id_ts`).
+		WithArgs(TestDataTraceIDOne).
+		WillReturnRows(sqlmock.NewRows([]string{"Start", "End", "Found"}).AddRow(time.Unix(0, 0), time.Unix(0, 0), uint64(0)))
+	mock.ExpectQuery(`SELECT .* FROM test PREWHERE TraceId IN \(\?\)$`).
+		WithArgs(TestDataTraceIDOne).
+		WillReturnRows(sqlmock.NewRows([]string{"Timestamp"}))
+
+	cr := New("test", false, db, tracer, WithTraceIDTsTable("test_trace_id_ts"))
+	_, err = cr.GetTrace(context.Background(), TestDataTraceIDOne)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_GetTraces_traceIDTsTable_partialLookup(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	start := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	end := start.Add(time.Minute)
+
+	// Only one of the traces is known to the lookup table, so bounding the read by its
+	// time range would miss the other trace
+	mock.ExpectQuery(`SELECT min\(Start\), max\(End\), uniqExact\(TraceId\) FROM test_trace_id_ts WHERE TraceId IN \(\?,\?\)`).
+		WithArgs(TestDataTraceIDOne, TestDataTraceIDTwo).
+		WillReturnRows(sqlmock.NewRows([]string{"Start", "End", "Found"}).AddRow(start, end, uint64(1)))
+	mock.ExpectQuery(`SELECT .* FROM test PREWHERE TraceId IN \(\?,\?\)$`).
+		WithArgs(TestDataTraceIDOne, TestDataTraceIDTwo).
+		WillReturnRows(sqlmock.NewRows([]string{"Timestamp"}))
+
+	cr := New("test", false, db, tracer, WithTraceIDTsTable("test_trace_id_ts"))
+	_, err = cr.GetTraces(context.Background(), []string{TestDataTraceIDOne, TestDataTraceIDTwo})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_GetTrace_traceIDTsTable_missingTable(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	mock.ExpectQuery(`SELECT min\(Start\), max\(End\), uniqExact\(TraceId\) FROM test_trace_id_ts`).
+		WithArgs(TestDataTraceIDOne).
+		WillReturnError(&clickhouse.Exception{Code: 60, Message: "Table otel.test_trace_id_ts does not exist"})
+	mock.ExpectQuery(`SELECT .* FROM test PREWHERE TraceId IN \(\?\)$`).
+		WithArgs(TestDataTraceIDOne).
+		WillReturnRows(sqlmock.NewRows([]string{"Timestamp"}))
+	// Lookups are disabled once the table is known to be missing
+	mock.ExpectQuery(`SELECT .* FROM test PREWHERE TraceId IN \(\?\)$`).
+		WithArgs(TestDataTraceIDOne).
+		WillReturnRows(sqlmock.NewRows([]string{"Timestamp"}))
+
+	cr := New("test", false, db, tracer, WithTraceIDTsTable("test_trace_id_ts"))
+	_, err = cr.GetTrace(context.Background(), TestDataTraceIDOne)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = cr.GetTrace(context.Background(), TestDataTraceIDOne)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,185 @@
+package clickhousestore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const (
+	// Suffix of the materialized view feeding the metrics rollup table
+	metricsRollupViewSuffix = "_mv"
+
+	// Resolution of the metrics rollup table
+	metricsRollupInterval = time.Minute
+
+	// Time after the creation of the materialized view during which spans inserted before
+	// it may still be timestamped, as span timestamps are taken from the clocks of the
+	// instrumented services rather than from Clickhouse
+	metricsRollupLateness = 5 * time.Minute
+)
+
+// Quantiles of the span duration aggregated in the metrics rollup table. Other quantiles
+// are computed from spans.
+var metricsRollupQuantiles = []float64{0.5, 0.75, 0.9, 0.95, 0.99}
+
+// MetricsRollup manages a table of per-minute span metrics by service, span name and span
+// kind, which a materialized view aggregates from the spans table as spans are inserted.
+type MetricsRollup struct {
+	table         string
+	rollupTable   string
+	querySettings clickhouse.Settings
+	db            *sql.DB
+	tracer        trace.Tracer
+	logger        *slog.Logger
+}
+
+func NewMetricsRollup(table string, rollupTable string, limits QueryLimits, db *sql.DB, tracer trace.Tracer) *MetricsRollup {
+	return &MetricsRollup{
+		table:         table,
+		rollupTable:   rollupTable,
+		querySettings: limits.settings(),
+		db:            db,
+		tracer:        tracer,
+		logger:        slog.Default(),
+	}
+}
+
+// Init creates the rollup table and the materialized view feeding it if they do not exist
+// yet. Aggregates are stored as states in an AggregatingMergeTree, so that rows of the same
+// minute inserted in different blocks are merged into a single row. The view only sees
+// spans inserted after it has been created, so the rollup does not cover earlier spans.
+func (m *MetricsRollup) Init(ctx context.Context) error {
+	ctx, span := m.tracer.Start(ctx, "metricsrollup:Init")
+	defer span.End()
+
+	table := fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s ("+
+			"Timestamp DateTime CODEC(Delta, ZSTD(1)), "+
+			"ServiceName LowCardinality(String) CODEC(ZSTD(1)), "+
+			"SpanName LowCardinality(String) CODEC(ZSTD(1)), "+
+			"SpanKind LowCardinality(String) CODEC(ZSTD(1)), "+
+			"Latency AggregateFunction(quantiles(%[2]s), Int64), "+
+			"Calls AggregateFunction(count), "+
+			"Errors AggregateFunction(sum, UInt64)"+
+			") ENGINE = AggregatingMergeTree "+
+			"PARTITION BY toDate(Timestamp) "+
+			"ORDER BY (ServiceName, SpanKind, SpanName, Timestamp)",
+		m.rollupTable,
+		metricsRollupLevels(),
+	)
+	if err := m.exec(ctx, table); err != nil {
+		return err
+	}
+
+	view := fmt.Sprintf(
+		"CREATE MATERIALIZED VIEW IF NOT EXISTS %[1]s%[2]s TO %[1]s AS "+
+			"SELECT toStartOfMinute(Timestamp) AS Timestamp, ServiceName, SpanName, SpanKind, "+
+			"quantilesState(%[3]s)(toInt64(Duration)) AS Latency, "+
+			"countState() AS Calls, "+
+			"sumState(toUInt64(%[4]s = 'error')) AS Errors "+
+			"FROM %[5]s GROUP BY Timestamp, ServiceName, SpanName, SpanKind",
+		m.rollupTable,
+		metricsRollupViewSuffix,
+		metricsRollupLevels(),
+		columnTags["otel.status_code"].target.Expression,
+		m.table,
+	)
+	return m.exec(ctx, view)
+}
+
+// WithMetricsRollupTable reads metrics from the rollup table maintained by a MetricsRollup
+// for the time it covers, and from spans otherwise.
+func WithMetricsRollupTable(table string) Option {
+	return func(r *ClickhouseReader) {
+		r.metricsRollupTable = table
+	}
+}
+
+// metricsRollupStart returns the time from which on the rollup table covers all spans, or
+// the zero time if the materialized view feeding it cannot be found. The view only sees
+// spans inserted after it has been created, so coverage starts with the first minute after
+// the creation of the view and metricsRollupLateness, rather than with the earliest row of
+// the rollup, which may stem from a span arriving late. As coverage never starts later, it
+// is cached once known.
+func (r *ClickhouseReader) metricsRollupStart(ctx context.Context) time.Time {
+	if start := r.metricsRollupCovered.Load(); start > 0 {
+		return time.Unix(start, 0)
+	}
+
+	ctx, span := r.tracer.Start(ctx, "clickhousereader:metricsRollupStart")
+	defer span.End()
+
+	view := r.metricsRollupTable + metricsRollupViewSuffix
+	database, args := systemTableArgs(view)
+	query := fmt.Sprintf("SELECT metadata_modification_time FROM system.tables WHERE database = %s AND name = ?", database)
+
+	span.SetAttributes(
+		semconv.DBSystemClickhouse,
+		semconv.DBStatement(query),
+		semconv.DBSQLTable(view),
+	)
+
+	var created time.Time
+	if err := r.db.QueryRowContext(r.queryContext(ctx), query, args...).Scan(&created); err != nil {
+		// The view has not been created yet
+		if errors.Is(err, sql.ErrNoRows) {
+			return time.Time{}
+		}
+		r.logger.WarnContext(ctx, "unable to look up metrics rollup coverage", "error", err)
+		span.SetStatus(codes.Error, "unable to look up metrics rollup coverage")
+		span.RecordError(err)
+		return time.Time{}
+	}
+
+	start := created.Add(metricsRollupLateness).Truncate(metricsRollupInterval).Add(metricsRollupInterval)
+	r.metricsRollupCovered.Store(start.Unix())
+
+	return start
+}
+
+func (m *MetricsRollup) exec(ctx context.Context, query string) error {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		semconv.DBSystemClickhouse,
+		semconv.DBStatement(query),
+		semconv.DBSQLTable(m.rollupTable),
+	)
+
+	if _, err := m.db.ExecContext(withQuerySettings(ctx, m.querySettings), query); err != nil {
+		m.logger.ErrorContext(ctx, "unable to execute query", "error", err)
+		span.SetStatus(codes.Error, "unable to execute query")
+		span.RecordError(err)
+		return queryError(err)
+	}
+
+	return nil
+}
+
+// metricsRollupLevels returns the parameters of the quantiles aggregated in the rollup
+func metricsRollupLevels() string {
+	levels := make([]string, 0, len(metricsRollupQuantiles))
+	for _, quantile := range metricsRollupQuantiles {
+		levels = append(levels, fmt.Sprintf("%v", quantile))
+	}
+	return strings.Join(levels, ", ")
+}
+
+// metricsRollupQuantileIndex returns the index of the quantile in the rollup starting at 1,
+// or 0 if the quantile is not aggregated in the rollup
+func metricsRollupQuantileIndex(quantile float64) int {
+	for i, q := range metricsRollupQuantiles {
+		if q == quantile {
+			return i + 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,199 @@
+package clickhousestore
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestMetricsRollup_Init(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS test_metrics (") + ".*" +
+		regexp.QuoteMeta("Latency AggregateFunction(quantiles(0.5, 0.75, 0.9, 0.95, 0.99), Int64), Calls AggregateFunction(count), Errors AggregateFunction(sum, UInt64)) ENGINE = AggregatingMergeTree")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE MATERIALIZED VIEW IF NOT EXISTS test_metrics_mv TO test_metrics AS SELECT toStartOfMinute(Timestamp) AS Timestamp") + ".*" +
+		regexp.QuoteMeta("FROM test GROUP BY Timestamp, ServiceName, SpanName, SpanKind")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	m := NewMetricsRollup("test", "test_metrics", QueryLimits{}, db, tracer)
+	assert.NoError(t, m.Init(context.Background()))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_metricsRollupStart(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	created := time.Date(2024, 4, 1, 12, 0, 10, 0, time.UTC)
+	lookup := regexp.QuoteMeta("SELECT metadata_modification_time FROM system.tables WHERE database = currentDatabase() AND name = ?")
+
+	// Without the view the rollup covers nothing, and coverage is looked up again
+	mock.ExpectQuery(lookup).
+		WithArgs("test_metrics_mv").
+		WillReturnRows(sqlmock.NewRows([]string{"metadata_modification_time"}))
+	mock.ExpectQuery(lookup).
+		WithArgs("test_metrics_mv").
+		WillReturnRows(sqlmock.NewRows([]string{"metadata_modification_time"}).AddRow(created))
+
+	cr := New("test", false, db, tracer, WithMetricsRollupTable("test_metrics"))
+	assert.True(t, cr.metricsRollupStart(context.Background()).IsZero())
+
+	// Coverage starts with the first minute after the lateness margin, and is cached
+	want := time.Date(2024, 4, 1, 12, 6, 0, 0, time.UTC)
+	assert.Equal(t, want.Unix(), cr.metricsRollupStart(context.Background()).Unix())
+	assert.Equal(t, want.Unix(), cr.metricsRollupStart(context.Background()).Unix())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_GetCallCounts_rollup(t *testing.T) {
+	endTime := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	startTime := endTime.Add(-time.Hour)
+	spansStart := startTime.Add(-5 * time.Minute)
+
+	spansSource := regexp.QuoteMeta("SELECT ServiceName, '' AS Operation, intDiv(toUnixTimestamp64Nano(Timestamp), 60000000000) AS Bucket, count() AS Calls, ") + ".*" +
+		regexp.QuoteMeta("FROM test WHERE ServiceName IN (?) AND Timestamp >= fromUnixTimestamp64Nano(toInt64(?)) AND Timestamp < fromUnixTimestamp64Nano(toInt64(?)) GROUP BY ServiceName, Operation, Bucket")
+	rollupSource := regexp.QuoteMeta("SELECT ServiceName, '' AS Operation, intDiv(toInt64(toUnixTimestamp(Timestamp)), 60) AS Bucket, countMerge(Calls) AS Calls, sumMerge(Errors) AS Errors " +
+		"FROM test_metrics WHERE ServiceName IN (?) AND Timestamp >= toDateTime(?) AND Timestamp <= toDateTime(?) GROUP BY ServiceName, Operation, Bucket")
+
+	tests := []struct {
+		name     string
+		created  time.Time
+		step     time.Duration
+		query    string
+		args     []driver.Value
+		noLookup bool
+	}{
+		{
+			name: "split",
+			// Spans timestamped up to the lateness margin after the creation of the
+			// view may have been inserted before it
+			created: startTime.Add(24*time.Minute + 30*time.Second),
+			step:    time.Minute,
+			query:   "FROM \\(" + spansSource + " UNION ALL " + rollupSource + "\\) ARRAY JOIN range\\(5\\) AS Offset",
+			args: []driver.Value{
+				TestDataServiceNameOne, spansStart.UnixNano(), startTime.Add(30 * time.Minute).UnixNano(),
+				TestDataServiceNameOne, startTime.Add(30 * time.Minute).Unix(), endTime.Unix(),
+				startTime.UnixNano(), endTime.UnixNano(),
+			},
+		},
+		{
+			name:    "covered",
+			created: startTime.Add(-time.Hour),
+			step:    time.Minute,
+			query:   "FROM \\(" + rollupSource + "\\) ARRAY JOIN range\\(5\\) AS Offset",
+			args: []driver.Value{
+				TestDataServiceNameOne, spansStart.Unix(), endTime.Unix(),
+				startTime.UnixNano(), endTime.UnixNano(),
+			},
+		},
+		{
+			name:    "notCovered",
+			created: endTime.Add(time.Minute),
+			step:    time.Minute,
+			query:   "FROM test WHERE .* AND Timestamp <= fromUnixTimestamp64Nano\\(toInt64\\(\\?\\)\\) GROUP BY ServiceName, Operation, Bucket\\) ARRAY JOIN",
+			args: []driver.Value{
+				TestDataServiceNameOne, spansStart.UnixNano(), endTime.UnixNano(),
+				startTime.UnixNano(), endTime.UnixNano(),
+			},
+		},
+		{
+			name:     "partialMinuteStep",
+			step:     30 * time.Second,
+			query:    "FROM test WHERE .* GROUP BY ServiceName, Operation, Bucket\\) ARRAY JOIN range\\(10\\) AS Offset",
+			noLookup: true,
+			args: []driver.Value{
+				TestDataServiceNameOne, spansStart.UnixNano(), endTime.UnixNano(),
+				startTime.UnixNano(), endTime.UnixNano(),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+			if !tt.noLookup {
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT metadata_modification_time FROM system.tables WHERE database = currentDatabase() AND name = ?")).
+					WithArgs("test_metrics_mv").
+					WillReturnRows(sqlmock.NewRows([]string{"metadata_modification_time"}).AddRow(tt.created))
+			}
+			mock.ExpectQuery(tt.query).
+				WithArgs(tt.args...).
+				WillReturnRows(sqlmock.NewRows([]string{"ServiceName", "Operation", "Point", "sum(Calls)", "sum(Errors)"}).
+					AddRow(TestDataServiceNameOne, "", endTime.UnixNano(), uint64(300), uint64(3)))
+
+			cr := New("test", false, db, tracer, WithMetricsRollupTable("test_metrics"))
+			res, err := cr.GetCallCounts(context.Background(), MetricsQuery{
+				ServiceNames: []string{TestDataServiceNameOne},
+				StartTime:    startTime,
+				EndTime:      endTime,
+				Step:         tt.step,
+				Window:       5 * time.Minute,
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, 1, len(res))
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestClickhouseReader_GetLatencies_rollup(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	endTime := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	startTime := endTime.Add(-time.Hour)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT metadata_modification_time FROM system.tables WHERE database = ? AND name = ?")).
+		WithArgs("otel", "test_metrics_mv").
+		WillReturnRows(sqlmock.NewRows([]string{"metadata_modification_time"}).AddRow(startTime.Add(-2 * time.Hour)))
+	mock.ExpectQuery(regexp.QuoteMeta("quantilesMerge(0.5, 0.75, 0.9, 0.95, 0.99)(State)[4] / 1e6 FROM (SELECT ServiceName, '' AS Operation, intDiv(toInt64(toUnixTimestamp(Timestamp)), 60) AS Bucket, quantilesMergeState(0.5, 0.75, 0.9, 0.95, 0.99)(Latency) AS State FROM otel.test_metrics")).
+		WillReturnRows(sqlmock.NewRows([]string{"ServiceName", "Operation", "Point", "Latency"}))
+	// Quantiles missing from the rollup are computed from spans, without looking up the
+	// coverage again
+	mock.ExpectQuery(regexp.QuoteMeta("quantileMerge(0.42)(State) / 1e6 FROM (SELECT ServiceName, '' AS Operation, intDiv(toUnixTimestamp64Nano(Timestamp), 60000000000) AS Bucket, quantileState(0.42)(Duration) AS State FROM test WHERE")).
+		WillReturnRows(sqlmock.NewRows([]string{"ServiceName", "Operation", "Point", "Latency"}))
+
+	cr := New("test", false, db, tracer, WithMetricsRollupTable("otel.test_metrics"))
+	query := MetricsQuery{
+		ServiceNames: []string{TestDataServiceNameOne},
+		StartTime:    startTime,
+		EndTime:      endTime,
+		Step:         time.Minute,
+		Window:       time.Minute,
+	}
+
+	_, err = cr.GetLatencies(context.Background(), query, 0.95)
+	assert.NoError(t, err)
+	_, err = cr.GetLatencies(context.Background(), query, 0.42)
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
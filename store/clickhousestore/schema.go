@@ -0,0 +1,538 @@
+package clickhousestore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
+)
+
+var (
+	ErrIncompatibleSchema = errors.New("incompatible table schema")
+)
+
+// SchemaVersion identifies the variant of the OpenTelemetry Clickhouse exporter schema
+// a table has been created with.
+type SchemaVersion string
+
+const (
+	// SchemaVersionMap stores attributes in Map(LowCardinality(String), String) or
+	// Map(String, String) columns.
+	SchemaVersionMap SchemaVersion = "map"
+	// SchemaVersionJSON stores attributes in JSON columns.
+	SchemaVersionJSON SchemaVersion = "json"
+)
+
+type columnKind int
+
+const (
+	columnKindString columnKind = iota
+	columnKindTime
+	columnKindInt
+	columnKindAttributes
+	columnKindStringArray
+	columnKindTimeArray
+	columnKindAttributesArray
+)
+
+type schemaColumn struct {
+	name     string
+	kind     columnKind
+	required bool
+}
+
+// spanColumns lists the columns read for every span, in the order they are selected.
+// Optional columns were added in later versions of the exporter and are read as empty
+// values when missing.
+var spanColumns = []schemaColumn{
+	{name: "Timestamp", kind: columnKindTime, required: true},
+	{name: "TraceId", kind: columnKindString, required: true},
+	{name: "SpanId", kind: columnKindString, required: true},
+	{name: "ParentSpanId", kind: columnKindString, required: true},
+	{name: "TraceState", kind: columnKindString},
+	{name: "SpanName", kind: columnKindString, required: true},
+	{name: "SpanKind", kind: columnKindString, required: true},
+	{name: "ServiceName", kind: columnKindString, required: true},
+	{name: "ResourceAttributes", kind: columnKindAttributes, required: true},
+	{name: "ScopeName", kind: columnKindString},
+	{name: "ScopeVersion", kind: columnKindString},
+	{name: "SpanAttributes", kind: columnKindAttributes, required: true},
+	{name: "Duration", kind: columnKindInt, required: true},
+	{name: "StatusCode", kind: columnKindString, required: true},
+	{name: "StatusMessage", kind: columnKindString},
+	{name: "Events.Timestamp", kind: columnKindTimeArray},
+	{name: "Events.Name", kind: columnKindStringArray},
+	{name: "Events.Attributes", kind: columnKindAttributesArray},
+	{name: "Links.TraceId", kind: columnKindStringArray},
+	{name: "Links.SpanId", kind: columnKindStringArray},
+	{name: "Links.TraceState", kind: columnKindStringArray},
+	{name: "Links.Attributes", kind: columnKindAttributesArray},
+}
+
+// Schema describes the columns of a spans table and how to read them.
+type Schema struct {
+	Version SchemaVersion
+	columns map[string]string
+}
+
+// DefaultSchema returns the schema created by the OpenTelemetry Clickhouse exporter
+// with attributes stored in maps, which is assumed until a schema has been detected.
+func DefaultSchema() *Schema {
+	return &Schema{
+		Version: SchemaVersionMap,
+		columns: map[string]string{
+			"Timestamp":          "DateTime64(9)",
+			"TraceId":            "String",
+			"SpanId":             "String",
+			"ParentSpanId":       "String",
+			"TraceState":         "String",
+			"SpanName":           "LowCardinality(String)",
+			"SpanKind":           "LowCardinality(String)",
+			"ServiceName":        "LowCardinality(String)",
+			"ResourceAttributes": "Map(LowCardinality(String), String)",
+			"ScopeName":          "String",
+			"ScopeVersion":       "String",
+			"SpanAttributes":     "Map(LowCardinality(String), String)",
+			"Duration":           "Int64",
+			"StatusCode":         "LowCardinality(String)",
+			"StatusMessage":      "String",
+			"Events.Timestamp":   "Array(DateTime64(9))",
+			"Events.Name":        "Array(LowCardinality(String))",
+			"Events.Attributes":  "Array(Map(LowCardinality(String), String))",
+			"Links.TraceId":      "Array(String)",
+			"Links.SpanId":       "Array(String)",
+			"Links.TraceState":   "Array(String)",
+			"Links.Attributes":   "Array(Map(LowCardinality(String), String))",
+		},
+	}
+}
+
+// ParseSchema validates the columns of a spans table, given as a map of column names to
+// Clickhouse types, and determines the schema version.
+func ParseSchema(columns map[string]string) (*Schema, error) {
+	schema := &Schema{Version: SchemaVersionMap, columns: columns}
+
+	for _, column := range spanColumns {
+		columnType, ok := columns[column.name]
+		if !ok {
+			if column.required {
+				return nil, fmt.Errorf("%w: missing column %s", ErrIncompatibleSchema, column.name)
+			}
+			continue
+		}
+
+		if !column.compatible(columnType) {
+			return nil, fmt.Errorf("%w: column %s has unsupported type %s", ErrIncompatibleSchema, column.name, columnType)
+		}
+	}
+
+	if isJSONType(columns["SpanAttributes"]) {
+		schema.Version = SchemaVersionJSON
+	}
+
+	return schema, nil
+}
+
+// DetectSchema reads the columns of the spans table from system.columns and uses the
+// detected schema for all subsequent queries.
+func (r *ClickhouseReader) DetectSchema(ctx context.Context) (*Schema, error) {
+	ctx, span := r.tracer.Start(ctx, "clickhousereader:DetectSchema")
+	defer span.End()
+
+	schema, err := r.readSchema(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r.schema = schema
+
+	return schema, nil
+}
+
+// CheckSchema reads the columns of the spans table like DetectSchema does, without
+// changing the schema used for queries, to check that the table is still compatible.
+func (r *ClickhouseReader) CheckSchema(ctx context.Context) (*Schema, error) {
+	ctx, span := r.tracer.Start(ctx, "clickhousereader:CheckSchema")
+	defer span.End()
+
+	return r.readSchema(ctx)
+}
+
+func (r *ClickhouseReader) readSchema(ctx context.Context) (*Schema, error) {
+	span := trace.SpanFromContext(ctx)
+
+	database, args := systemTableArgs(r.table)
+	query := fmt.Sprintf("SELECT name, type FROM system.columns WHERE database = %s AND table = ?", database)
+
+	span.SetAttributes(
+		semconv.DBSystemClickhouse,
+		semconv.DBStatement(query),
+		semconv.DBSQLTable(r.table),
+	)
+
+	rows, err := r.db.QueryContext(r.queryContext(ctx), query, args...)
+	if err != nil {
+		r.logger.ErrorContext(ctx, "unable to execute query", "error", err)
+		span.SetStatus(codes.Error, "unable to execute query")
+		span.RecordError(err)
+		return nil, err
+	}
+
+	defer func() { _ = rows.Close() }()
+
+	columns := map[string]string{}
+	for rows.Next() {
+		var name, columnType string
+		if err := rows.Scan(&name, &columnType); err != nil {
+			r.logger.ErrorContext(ctx, "unable to scan row results", "error", err)
+			span.SetStatus(codes.Error, "unable to scan row results")
+			span.RecordError(err)
+			return nil, err
+		}
+		columns[name] = columnType
+	}
+
+	if err := rows.Err(); err != nil {
+		r.logger.ErrorContext(ctx, "received errors in rows", "error", err)
+		span.SetStatus(codes.Error, "received errors in rows")
+		span.RecordError(err)
+		return nil, err
+	}
+
+	if len(columns) == 0 {
+		err := fmt.Errorf("%w: table %s does not exist", ErrIncompatibleSchema, r.table)
+		span.SetStatus(codes.Error, "table does not exist")
+		span.RecordError(err)
+		return nil, err
+	}
+
+	schema, err := ParseSchema(columns)
+	if err != nil {
+		err = fmt.Errorf("table %s: %w", r.table, err)
+		span.SetStatus(codes.Error, "incompatible table schema")
+		span.RecordError(err)
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.String("schema-version", string(schema.Version)))
+
+	return schema, nil
+}
+
+// systemTableArgs returns the database expression and the arguments to look up a table,
+// which may be qualified with its database, in the system tables
+func systemTableArgs(table string) (string, []interface{}) {
+	if idx := strings.LastIndex(table, "."); idx >= 0 {
+		return "?", []interface{}{table[:idx], table[idx+1:]}
+	}
+	return "currentDatabase()", []interface{}{table}
+}
+
+// selectColumns returns the expressions selecting every span column, converting JSON
+// attributes to strings and replacing missing optional columns with empty values.
+func (s *Schema) selectColumns() string {
+	expressions := make([]string, 0, len(spanColumns))
+	for _, column := range spanColumns {
+		columnType, ok := s.columns[column.name]
+		if !ok {
+			expressions = append(expressions, column.empty())
+			continue
+		}
+
+		switch {
+		case column.kind == columnKindInt:
+			expressions = append(expressions, fmt.Sprintf("toInt64(%s)", column.name))
+		case column.kind == columnKindAttributes && isJSONType(columnType):
+			expressions = append(expressions, fmt.Sprintf("toJSONString(%s)", column.name))
+		case column.kind == columnKindAttributesArray && isJSONType(columnType):
+			expressions = append(expressions, fmt.Sprintf("arrayMap(a -> toJSONString(a), %s)", column.name))
+		default:
+			expressions = append(expressions, column.name)
+		}
+	}
+	return strings.Join(expressions, ", ")
+}
+
+// hasColumn returns whether the table has the column.
+func (s *Schema) hasColumn(column string) bool {
+	_, ok := s.columns[column]
+	return ok
+}
+
+// attribute returns an expression reading a single attribute from an attributes column,
+// with the key as its only argument. Missing attributes evaluate to an empty string.
+func (s *Schema) attribute(column string) string {
+	if isJSONType(s.columns[column]) {
+		return fmt.Sprintf("ifNull(toString(getSubcolumn(%s, ?)), '')", column)
+	}
+	return column + "[?]"
+}
+
+// scanSpan scans a row selected with selectColumns into a span.
+func (s *Schema) scanSpan(rows *sql.Rows) (ClickhouseOtelSpan, error) {
+	var sp ClickhouseOtelSpan
+
+	var resourceAttributes, spanAttributes string
+	var eventsAttributes, linksAttributes []string
+
+	dest := []interface{}{
+		&sp.Timestamp, &sp.TraceID, &sp.SpanID, &sp.ParentSpanID, &sp.TraceState, &sp.SpanName, &sp.SpanKind,
+		&sp.ServiceName, &sp.ResourceAttributes, &sp.ScopeName, &sp.ScopeVersion, &sp.SpanAttributes, &sp.Duration,
+		&sp.StatusCode, &sp.StatusMessage, &sp.EventsTimestamp, &sp.EventsName, &sp.EventsAttributes,
+		&sp.LinksTraceID, &sp.LinksSpanID, &sp.LinksTraceState, &sp.LinksAttributes,
+	}
+
+	// JSON attributes are selected as strings and decoded after scanning
+	jsonDest := map[string]interface{}{
+		"ResourceAttributes": &resourceAttributes,
+		"SpanAttributes":     &spanAttributes,
+		"Events.Attributes":  &eventsAttributes,
+		"Links.Attributes":   &linksAttributes,
+	}
+	for i, column := range spanColumns {
+		if d, ok := jsonDest[column.name]; ok && isJSONType(s.columns[column.name]) {
+			dest[i] = d
+		}
+	}
+
+	if err := rows.Scan(dest...); err != nil {
+		return sp, err
+	}
+
+	var err error
+	if isJSONType(s.columns["ResourceAttributes"]) {
+		if sp.ResourceAttributes, err = decodeJSONAttributes(resourceAttributes); err != nil {
+			return sp, err
+		}
+	}
+	if isJSONType(s.columns["SpanAttributes"]) {
+		if sp.SpanAttributes, err = decodeJSONAttributes(spanAttributes); err != nil {
+			return sp, err
+		}
+	}
+	if isJSONType(s.columns["Events.Attributes"]) {
+		if sp.EventsAttributes, err = decodeJSONAttributesArray(eventsAttributes); err != nil {
+			return sp, err
+		}
+	}
+	if isJSONType(s.columns["Links.Attributes"]) {
+		if sp.LinksAttributes, err = decodeJSONAttributesArray(linksAttributes); err != nil {
+			return sp, err
+		}
+	}
+
+	return sp, nil
+}
+
+func (c schemaColumn) compatible(columnType string) bool {
+	switch c.kind {
+	case columnKindTime:
+		// Timestamps are compared and bucketed with nanosecond precision, which DateTime
+		// does not support
+		return strings.HasPrefix(columnType, "DateTime64(")
+	case columnKindInt:
+		return strings.Contains(columnType, "Int")
+	case columnKindString:
+		return strings.Contains(columnType, "String")
+	case columnKindAttributes:
+		return strings.HasPrefix(columnType, "Map(") || isJSONType(columnType)
+	case columnKindStringArray:
+		return strings.HasPrefix(columnType, "Array(") && strings.Contains(columnType, "String")
+	case columnKindTimeArray:
+		return strings.HasPrefix(columnType, "Array(DateTime")
+	case columnKindAttributesArray:
+		return strings.HasPrefix(columnType, "Array(Map(") || (strings.HasPrefix(columnType, "Array(") && isJSONType(columnType))
+	}
+	return false
+}
+
+// insertColumns returns the span columns present in the table, which spans are inserted
+// into.
+func (s *Schema) insertColumns() []string {
+	columns := make([]string, 0, len(spanColumns))
+	for _, column := range spanColumns {
+		if _, ok := s.columns[column.name]; ok {
+			columns = append(columns, column.name)
+		}
+	}
+	return columns
+}
+
+// insertValues returns the values of a span for the insert columns. Attributes stored in
+// JSON columns are encoded as JSON objects.
+func (s *Schema) insertValues(sp *ClickhouseOtelSpan) ([]interface{}, error) {
+	values := make([]interface{}, 0, len(spanColumns))
+	for _, column := range spanColumns {
+		columnType, ok := s.columns[column.name]
+		if !ok {
+			continue
+		}
+
+		value := spanColumnValue(sp, column.name)
+
+		if isJSONType(columnType) {
+			var err error
+			switch v := value.(type) {
+			case map[string]string:
+				value, err = encodeJSONAttributes(v)
+			case []map[string]string:
+				value, err = encodeJSONAttributesArray(v)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", column.name, err)
+			}
+		}
+
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// spanColumnValue returns the value of a span for a span column
+func spanColumnValue(sp *ClickhouseOtelSpan, column string) interface{} {
+	switch column {
+	case "Timestamp":
+		return sp.Timestamp
+	case "TraceId":
+		return sp.TraceID
+	case "SpanId":
+		return sp.SpanID
+	case "ParentSpanId":
+		return sp.ParentSpanID
+	case "TraceState":
+		return sp.TraceState
+	case "SpanName":
+		return sp.SpanName
+	case "SpanKind":
+		return sp.SpanKind
+	case "ServiceName":
+		return sp.ServiceName
+	case "ResourceAttributes":
+		return sp.ResourceAttributes
+	case "ScopeName":
+		return sp.ScopeName
+	case "ScopeVersion":
+		return sp.ScopeVersion
+	case "SpanAttributes":
+		return sp.SpanAttributes
+	case "Duration":
+		return sp.Duration
+	case "StatusCode":
+		return sp.StatusCode
+	case "StatusMessage":
+		return sp.StatusMessage
+	case "Events.Timestamp":
+		return sp.EventsTimestamp
+	case "Events.Name":
+		return sp.EventsName
+	case "Events.Attributes":
+		return sp.EventsAttributes
+	case "Links.TraceId":
+		return sp.LinksTraceID
+	case "Links.SpanId":
+		return sp.LinksSpanID
+	case "Links.TraceState":
+		return sp.LinksTraceState
+	case "Links.Attributes":
+		return sp.LinksAttributes
+	}
+	return nil
+}
+
+// empty returns a typed empty value for a missing column.
+func (c schemaColumn) empty() string {
+	switch c.kind {
+	case columnKindStringArray:
+		return "CAST([], 'Array(String)')"
+	case columnKindTimeArray:
+		return "CAST([], 'Array(DateTime64(9))')"
+	case columnKindAttributesArray:
+		return "CAST([], 'Array(Map(String, String))')"
+	}
+	return "''"
+}
+
+func isJSONType(columnType string) bool {
+	return strings.Contains(columnType, "JSON") || strings.Contains(columnType, "Object('json')")
+}
+
+// decodeJSONAttributes decodes attributes serialized as a JSON object. Clickhouse splits
+// dotted keys into nested objects, which are flattened back into dotted keys.
+func decodeJSONAttributes(value string) (map[string]string, error) {
+	attributes := map[string]string{}
+	if value == "" {
+		return attributes, nil
+	}
+
+	var object map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	if err := decoder.Decode(&object); err != nil {
+		return nil, err
+	}
+
+	flattenJSONAttributes("", object, attributes)
+	return attributes, nil
+}
+
+// encodeJSONAttributes encodes attributes as a JSON object with dotted keys, which
+// Clickhouse splits into nested objects.
+func encodeJSONAttributes(attributes map[string]string) (string, error) {
+	if attributes == nil {
+		attributes = map[string]string{}
+	}
+	encoded, err := json.Marshal(attributes)
+	return string(encoded), err
+}
+
+func encodeJSONAttributesArray(attributes []map[string]string) ([]string, error) {
+	values := make([]string, 0, len(attributes))
+	for _, a := range attributes {
+		encoded, err := encodeJSONAttributes(a)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, encoded)
+	}
+	return values, nil
+}
+
+func decodeJSONAttributesArray(values []string) ([]map[string]string, error) {
+	attributes := make([]map[string]string, 0, len(values))
+	for _, value := range values {
+		decoded, err := decodeJSONAttributes(value)
+		if err != nil {
+			return nil, err
+		}
+		attributes = append(attributes, decoded)
+	}
+	return attributes, nil
+}
+
+func flattenJSONAttributes(prefix string, object map[string]interface{}, attributes map[string]string) {
+	for key, value := range object {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flattenJSONAttributes(key, v, attributes)
+		case string:
+			attributes[key] = v
+		case nil:
+			attributes[key] = ""
+		case []interface{}:
+			encoded, _ := json.Marshal(v)
+			attributes[key] = string(encoded)
+		default:
+			attributes[key] = fmt.Sprint(v)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package clickhousestore
+
+import (
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+	"testing"
+	"time"
+)
+
+func schemaColumnsRows(mock sqlmock.Sqlmock, columns map[string]string) *sqlmock.Rows {
+	rows := mock.NewRows([]string{"name", "type"})
+	for _, column := range spanColumns {
+		if columnType, ok := columns[column.name]; ok {
+			rows.AddRow(column.name, columnType)
+		}
+	}
+	return rows
+}
+
+func TestClickhouseReader_DetectSchema(t *testing.T) {
+	mapColumns := DefaultSchema().columns
+
+	withoutLinks := map[string]string{}
+	for name, columnType := range mapColumns {
+		withoutLinks[name] = columnType
+	}
+	delete(withoutLinks, "Links.TraceId")
+	delete(withoutLinks, "Links.SpanId")
+	delete(withoutLinks, "Links.TraceState")
+	delete(withoutLinks, "Links.Attributes")
+
+	jsonColumns := map[string]string{}
+	for name, columnType := range mapColumns {
+		jsonColumns[name] = columnType
+	}
+	jsonColumns["Duration"] = "UInt64"
+	jsonColumns["ResourceAttributes"] = "JSON"
+	jsonColumns["SpanAttributes"] = "JSON"
+	jsonColumns["Events.Attributes"] = "Array(JSON)"
+	jsonColumns["Links.Attributes"] = "Array(JSON)"
+
+	missingAttributes := map[string]string{}
+	for name, columnType := range mapColumns {
+		missingAttributes[name] = columnType
+	}
+	delete(missingAttributes, "SpanAttributes")
+
+	invalidTimestamp := map[string]string{}
+	for name, columnType := range mapColumns {
+		invalidTimestamp[name] = columnType
+	}
+	invalidTimestamp["Timestamp"] = "String"
+
+	secondsTimestamp := map[string]string{}
+	for name, columnType := range mapColumns {
+		secondsTimestamp[name] = columnType
+	}
+	secondsTimestamp["Timestamp"] = "DateTime('UTC')"
+
+	tests := []struct {
+		name    string
+		columns map[string]string
+		want    SchemaVersion
+		wantErr bool
+	}{
+		{name: "map attributes", columns: mapColumns, want: SchemaVersionMap},
+		{name: "map attributes without links", columns: withoutLinks, want: SchemaVersionMap},
+		{name: "json attributes", columns: jsonColumns, want: SchemaVersionJSON},
+		{name: "missing required column", columns: missingAttributes, wantErr: true},
+		{name: "incompatible column type", columns: invalidTimestamp, wantErr: true},
+		{name: "timestamp without sub-second precision", columns: secondsTimestamp, wantErr: true},
+		{name: "missing table", columns: map[string]string{}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+
+			tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+			mock.ExpectQuery(`SELECT name, type FROM system.columns WHERE database = currentDatabase\(\) AND table = \?`).
+				WithArgs("test").
+				WillReturnRows(schemaColumnsRows(mock, tt.columns))
+
+			cr := New("test", false, db, tracer)
+			got, err := cr.DetectSchema(context.Background())
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrIncompatibleSchema)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got.Version)
+			assert.Same(t, got, cr.schema)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestClickhouseReader_DetectSchema_database(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	mock.ExpectQuery(`SELECT name, type FROM system.columns WHERE database = \? AND table = \?`).
+		WithArgs("otel", "test").
+		WillReturnRows(schemaColumnsRows(mock, DefaultSchema().columns))
+
+	cr := New("otel.test", false, db, tracer)
+	_, err = cr.DetectSchema(context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseReader_CheckSchema(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	jsonColumns := map[string]string{}
+	for name, columnType := range DefaultSchema().columns {
+		jsonColumns[name] = columnType
+	}
+	jsonColumns["SpanAttributes"] = "JSON"
+
+	mock.ExpectQuery(`SELECT name, type FROM system.columns WHERE database = currentDatabase\(\) AND table = \?`).
+		WithArgs("test").
+		WillReturnRows(schemaColumnsRows(mock, jsonColumns))
+
+	cr := New("test", false, db, tracer)
+	got, err := cr.CheckSchema(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, SchemaVersionJSON, got.Version)
+	assert.Equal(t, SchemaVersionMap, cr.schema.Version)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSchema_selectColumns(t *testing.T) {
+	columns := map[string]string{}
+	for name, columnType := range DefaultSchema().columns {
+		columns[name] = columnType
+	}
+	delete(columns, "Links.TraceId")
+	columns["SpanAttributes"] = "JSON"
+	columns["Events.Attributes"] = "Array(JSON)"
+
+	schema, err := ParseSchema(columns)
+	assert.NoError(t, err)
+
+	got := schema.selectColumns()
+	assert.Contains(t, got, "ResourceAttributes, ScopeName")
+	assert.Contains(t, got, "toJSONString(SpanAttributes), toInt64(Duration)")
+	assert.Contains(t, got, "arrayMap(a -> toJSONString(a), Events.Attributes)")
+	assert.Contains(t, got, "CAST([], 'Array(String)'), Links.SpanId")
+	assert.Equal(t, "ifNull(toString(getSubcolumn(SpanAttributes, ?)), '')", schema.attribute("SpanAttributes"))
+	assert.Equal(t, "ResourceAttributes[?]", schema.attribute("ResourceAttributes"))
+}
+
+func TestClickhouseReader_GetTrace_jsonSchema(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(passthroughConverter{}))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	columns := map[string]string{}
+	for name, columnType := range DefaultSchema().columns {
+		columns[name] = columnType
+	}
+	columns["ResourceAttributes"] = "JSON"
+	columns["SpanAttributes"] = "JSON"
+	columns["Events.Attributes"] = "Array(JSON)"
+	columns["Links.Attributes"] = "Array(JSON)"
+
+	schema, err := ParseSchema(columns)
+	assert.NoError(t, err)
+
+	timestamp := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	rows := mock.NewRows([]string{
+		"Timestamp", "TraceId", "SpanId", "ParentSpanId", "TraceState", "SpanName", "SpanKind", "ServiceName",
+		"ResourceAttributes", "ScopeName", "ScopeVersion", "SpanAttributes", "Duration", "StatusCode", "StatusMessage",
+		"Events.Timestamp", "Events.Name", "Events.Attributes",
+		"Links.TraceId", "Links.SpanId", "Links.TraceState", "Links.Attributes",
+	}).AddRow(
+		timestamp, TestDataTraceIDOne, "a7d2aa025caa9cb8", "", "", TestDataSpanNameOne, "Server", TestDataServiceNameOne,
+		`{"service":{"name":"test-client"}}`, "", "", `{"http":{"method":"GET","status_code":500},"retry":true}`, int64(3600), "Unset", "",
+		[]time.Time{timestamp}, []string{"exception"}, []string{`{"exception":{"message":"boom"}}`},
+		[]string{}, []string{}, []string{}, []string{},
+	)
+
+	mock.ExpectQuery(`SELECT .*toJSONString\(ResourceAttributes\).* FROM test PREWHERE TraceId IN \(\?\)`).
+		WithArgs(TestDataTraceIDOne).
+		WillReturnRows(rows)
+
+	cr := New("test", false, db, tracer)
+	cr.schema = schema
+
+	res, err := cr.GetTrace(context.Background(), TestDataTraceIDOne)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(res.Spans))
+	assert.Equal(t, map[string]string{"service.name": "test-client"}, res.Spans[0].ResourceAttributes)
+	assert.Equal(t, map[string]string{"http.method": "GET", "http.status_code": "500", "retry": "true"}, res.Spans[0].SpanAttributes)
+	assert.Equal(t, []map[string]string{{"exception.message": "boom"}}, res.Spans[0].EventsAttributes)
+	assert.Equal(t, []map[string]string{}, res.Spans[0].LinksAttributes)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,74 @@
+package clickhousestore
+
+import (
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/tagquery"
+	"strings"
+)
+
+// Prefixes restricting a tag to a single attributes column. Tags without a prefix match
+// either span or resource attributes. The prefixes end with ':' rather than '.', so that
+// they cannot be confused with attribute keys like "span.name".
+const (
+	tagPrefixSpan     = "span:"
+	tagPrefixResource = "resource:"
+)
+
+// Tags matching top-level columns, either by the name of the tag the column is translated
+// into or by the name of the column itself. Translated tags are compared to the value of
+// the column without its enum prefix and case-insensitively, so that "span.kind=server"
+// matches both "SPAN_KIND_SERVER" and "Server".
+var columnTags = map[string]columnTag{
+	"span.kind":               {"SpanKind", tagquery.Target{Expression: "lower(replaceOne(SpanKind, 'SPAN_KIND_', ''))", Lower: true}},
+	"otel.status_code":        {"StatusCode", tagquery.Target{Expression: "lower(replaceOne(StatusCode, 'STATUS_CODE_', ''))", Lower: true}},
+	"otel.status_description": {"StatusMessage", tagquery.Target{Expression: "StatusMessage"}},
+	"otel.scope.name":         {"ScopeName", tagquery.Target{Expression: "ScopeName"}},
+	"otel.scope.version":      {"ScopeVersion", tagquery.Target{Expression: "ScopeVersion"}},
+	"w3c.tracestate":          {"TraceState", tagquery.Target{Expression: "TraceState"}},
+	"SpanKind":                {"SpanKind", tagquery.Target{Expression: "SpanKind"}},
+	"StatusCode":              {"StatusCode", tagquery.Target{Expression: "StatusCode"}},
+	"StatusMessage":           {"StatusMessage", tagquery.Target{Expression: "StatusMessage"}},
+	"ScopeName":               {"ScopeName", tagquery.Target{Expression: "ScopeName"}},
+	"ScopeVersion":            {"ScopeVersion", tagquery.Target{Expression: "ScopeVersion"}},
+	"TraceState":              {"TraceState", tagquery.Target{Expression: "TraceState"}},
+}
+
+// columnTag is the target of a tag matching a top-level column, along with the column,
+// which tables created by older exporter versions may lack.
+type columnTag struct {
+	column string
+	target tagquery.Target
+}
+
+// tagTargets returns the expressions a tag is compared to. Tags of columns missing from
+// the table are matched against attributes like any other tag.
+func (r *ClickhouseReader) tagTargets(key string) []tagquery.Target {
+	if tag, ok := columnTags[key]; ok && r.schema.hasColumn(tag.column) {
+		return []tagquery.Target{tag.target}
+	}
+
+	attributeTarget := func(column string, key string) tagquery.Target {
+		return tagquery.Target{
+			Expression: r.schema.attribute(column),
+			Args:       []interface{}{key},
+			Type:       r.attributeTypes.Lookup(key),
+		}
+	}
+
+	if strings.HasPrefix(key, tagPrefixSpan) {
+		return []tagquery.Target{attributeTarget("SpanAttributes", strings.TrimPrefix(key, tagPrefixSpan))}
+	}
+
+	if strings.HasPrefix(key, tagPrefixResource) {
+		return []tagquery.Target{attributeTarget("ResourceAttributes", strings.TrimPrefix(key, tagPrefixResource))}
+	}
+
+	return []tagquery.Target{
+		attributeTarget("SpanAttributes", key),
+		attributeTarget("ResourceAttributes", key),
+	}
+}
+
+// tagCondition returns a condition matching a tag against all of its targets.
+func (r *ClickhouseReader) tagCondition(expr tagquery.Expr) (string, []interface{}, error) {
+	return tagquery.Compile(expr, r.tagTargets(expr.Key))
+}
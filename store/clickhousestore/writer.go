@@ -0,0 +1,386 @@
+package clickhousestore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of batches a writer buffers while inserting fails, before rejecting spans
+	maxBufferedBatches = 4
+
+	// Number of times inserting a batch is attempted before its spans are dropped
+	maxInsertAttempts = 5
+)
+
+// Clickhouse error codes of inserts that may succeed when retried
+const (
+	errCodeTooManySimultaneousQueries = 202
+	errCodeSocketTimeout              = 209
+	errCodeNetworkError               = 210
+	errCodeMemoryLimitExceeded        = 241
+	errCodeTooManyParts               = 252
+)
+
+var (
+	ErrWriterClosed     = errors.New("writer is closed")
+	ErrWriterBufferFull = errors.New("writer buffer is full")
+	ErrSpansDropped     = errors.New("spans dropped")
+
+	// errBatchRejected marks batches that fail the same way on every attempt
+	errBatchRejected = errors.New("batch rejected")
+)
+
+type ClickhouseSpanWriter interface {
+	WriteSpan(ctx context.Context, span *ClickhouseOtelSpan) error
+	Close() error
+}
+
+// ClickhouseWriter buffers spans and inserts them in batches into a table using the
+// schema of the OpenTelemetry Clickhouse exporter. A batch is flushed when it reaches
+// the batch size, when the flush interval elapses or when the writer is closed. A batch
+// that fails to be inserted for a transient reason, such as a network error, is retried
+// with the next flush until it has been attempted maxInsertAttempts times. Batches that
+// Clickhouse rejects, and spans that cannot be encoded, are dropped.
+type ClickhouseWriter struct {
+	table         string
+	schema        *Schema
+	batchSize     int
+	flushInterval time.Duration
+	db            *sql.DB
+	tracer        trace.Tracer
+	logger        *slog.Logger
+
+	// Batches are shared by the spans of all requests, so they are inserted with a context
+	// of the writer rather than of the request that filled them
+	ctx    context.Context
+	cancel context.CancelFunc
+	// closeTimeout bounds the final flush on close, unless zero
+	closeTimeout time.Duration
+
+	// Flushes are serialized, so that only one failed batch is retried at a time
+	flushMu sync.Mutex
+
+	mu     sync.Mutex
+	buffer []*ClickhouseOtelSpan
+	failed *pendingBatch
+	closed bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// pendingBatch is a batch of spans along with the number of attempts to insert it
+type pendingBatch struct {
+	spans    []*ClickhouseOtelSpan
+	attempts int
+}
+
+func NewWriter(table string, batchSize int, flushInterval time.Duration, db *sql.DB, tracer trace.Tracer) *ClickhouseWriter {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w := &ClickhouseWriter{
+		table:         table,
+		schema:        DefaultSchema(),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		db:            db,
+		tracer:        tracer,
+		logger:        slog.Default(),
+		ctx:           ctx,
+		cancel:        cancel,
+		buffer:        make([]*ClickhouseOtelSpan, 0, batchSize),
+		done:          make(chan struct{}),
+	}
+
+	w.wg.Add(1)
+	go w.flushPeriodically()
+
+	return w
+}
+
+// UseSchema inserts spans into the columns of a schema detected by a ClickhouseReader of
+// the table, rather than into those of the default schema.
+func (w *ClickhouseWriter) UseSchema(schema *Schema) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.schema = schema
+}
+
+// SetCloseTimeout bounds the time Close takes to insert the remaining spans, so that an
+// unreachable Clickhouse does not hold up shutting down. Spans not inserted in time are
+// lost.
+func (w *ClickhouseWriter) SetCloseTimeout(timeout time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closeTimeout = timeout
+}
+
+// WriteSpan buffers a span and flushes the buffer once it holds a batch. Flushing does not
+// fail the write of a buffered span, so flush errors are only logged. Spans are rejected
+// once the writer is closed, or while inserting fails and the buffer is full.
+func (w *ClickhouseWriter) WriteSpan(ctx context.Context, span *ClickhouseOtelSpan) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrWriterClosed
+	}
+	buffered := len(w.buffer)
+	if w.failed != nil {
+		buffered += len(w.failed.spans)
+	}
+	if buffered >= w.batchSize*maxBufferedBatches {
+		w.mu.Unlock()
+		return ErrWriterBufferFull
+	}
+	w.buffer = append(w.buffer, span)
+	full := len(w.buffer) >= w.batchSize
+	w.mu.Unlock()
+
+	if full {
+		if err := w.Flush(w.ctx); err != nil {
+			w.logger.ErrorContext(ctx, "unable to flush spans", "error", err)
+		}
+	}
+
+	return nil
+}
+
+// Close stops the periodic flushing and inserts the batch that failed to be inserted, if
+// any, and the spans remaining in the buffer, within the close timeout. Closing a closed
+// writer does nothing.
+func (w *ClickhouseWriter) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	timeout := w.closeTimeout
+	w.mu.Unlock()
+
+	close(w.done)
+	w.wg.Wait()
+
+	defer w.cancel()
+
+	ctx := w.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	return w.flushRemaining(ctx)
+}
+
+// Flush retries the batch that failed to be inserted with the previous flush, if any, and
+// then inserts all buffered spans in a single batch. Buffered spans are kept until the
+// failed batch has been inserted or dropped.
+func (w *ClickhouseWriter) Flush(ctx context.Context) error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.mu.Lock()
+	failed := w.failed
+	w.failed = nil
+	w.mu.Unlock()
+
+	var failedErr error
+	if failed != nil {
+		failedErr = w.insertBatch(ctx, failed)
+		if failedErr != nil && !errors.Is(failedErr, ErrSpansDropped) {
+			return failedErr
+		}
+	}
+
+	w.mu.Lock()
+	batch := w.buffer
+	w.buffer = make([]*ClickhouseOtelSpan, 0, w.batchSize)
+	w.mu.Unlock()
+
+	if len(batch) == 0 {
+		return failedErr
+	}
+
+	return errors.Join(failedErr, w.insertBatch(ctx, &pendingBatch{spans: batch}))
+}
+
+// flushRemaining attempts to insert the failed batch and the buffered spans once each, as
+// they cannot be retried after the writer is closed. Unlike Flush, the buffered spans are
+// inserted even if the failed batch fails again, and spans that fail to be inserted are
+// lost.
+func (w *ClickhouseWriter) flushRemaining(ctx context.Context) error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.mu.Lock()
+	var batches [][]*ClickhouseOtelSpan
+	if w.failed != nil {
+		batches = append(batches, w.failed.spans)
+		w.failed = nil
+	}
+	if len(w.buffer) > 0 {
+		batches = append(batches, w.buffer)
+		w.buffer = nil
+	}
+	w.mu.Unlock()
+
+	var errs []error
+	var lost int
+	for _, batch := range batches {
+		if err := w.insert(ctx, batch); err != nil {
+			errs = append(errs, err)
+			lost += len(batch)
+		}
+	}
+
+	if lost > 0 {
+		w.logger.ErrorContext(ctx, "spans lost on close", "spans", lost, "error", errors.Join(errs...))
+		return fmt.Errorf("%w: %d lost on close: %w", ErrSpansDropped, lost, errors.Join(errs...))
+	}
+	return nil
+}
+
+// insertBatch inserts a batch, keeping it to be retried with the next flush if inserting
+// fails for a transient reason. The batch is dropped once it has been rejected or has
+// been attempted maxInsertAttempts times.
+func (w *ClickhouseWriter) insertBatch(ctx context.Context, batch *pendingBatch) error {
+	batch.attempts++
+
+	err := w.insert(ctx, batch.spans)
+	if err == nil {
+		return nil
+	}
+
+	if !transientError(err) || batch.attempts >= maxInsertAttempts {
+		w.logger.ErrorContext(ctx, "dropping spans that cannot be inserted", "spans", len(batch.spans), "attempts", batch.attempts, "error", err)
+		return fmt.Errorf("%w: %w", ErrSpansDropped, err)
+	}
+
+	w.mu.Lock()
+	w.failed = batch
+	w.mu.Unlock()
+
+	return err
+}
+
+// transientError returns whether inserting a batch that failed with the error may succeed
+// when retried. Errors not returned by the server, such as network errors and timeouts,
+// are transient.
+func transientError(err error) bool {
+	if errors.Is(err, errBatchRejected) {
+		return false
+	}
+
+	var exception *clickhouse.Exception
+	if !errors.As(err, &exception) {
+		return true
+	}
+
+	switch exception.Code {
+	case errCodeTimeoutExceeded, errCodeTooManySimultaneousQueries, errCodeSocketTimeout, errCodeNetworkError, errCodeMemoryLimitExceeded, errCodeTooManyParts:
+		return true
+	}
+
+	return false
+}
+
+func (w *ClickhouseWriter) flushPeriodically() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			if err := w.Flush(w.ctx); err != nil {
+				w.logger.ErrorContext(w.ctx, "unable to flush spans", "error", err)
+			}
+		}
+	}
+}
+
+func (w *ClickhouseWriter) insert(ctx context.Context, batch []*ClickhouseOtelSpan) error {
+	ctx, span := w.tracer.Start(ctx, "clickhousewriter:insert")
+	span.SetAttributes(attribute.Int("batch-size", len(batch)))
+	defer span.End()
+
+	w.mu.Lock()
+	schema := w.schema
+	w.mu.Unlock()
+
+	// Only the columns of the table are inserted, as tables created by older exporter
+	// versions lack some of them
+	query := fmt.Sprintf("INSERT INTO %s (%s)", w.table, strings.Join(schema.insertColumns(), ", "))
+
+	span.SetAttributes(
+		semconv.DBSystemClickhouse,
+		semconv.DBStatement(query),
+		semconv.DBSQLTable(w.table),
+	)
+
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		w.logger.ErrorContext(ctx, "unable to begin batch", "error", err)
+		span.SetStatus(codes.Error, "unable to begin batch")
+		span.RecordError(err)
+		return err
+	}
+
+	// Rollback is a no-op once the batch has been committed
+	defer func() { _ = tx.Rollback() }()
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		w.logger.ErrorContext(ctx, "unable to prepare batch", "error", err)
+		span.SetStatus(codes.Error, "unable to prepare batch")
+		span.RecordError(err)
+		return err
+	}
+
+	defer func() { _ = stmt.Close() }()
+
+	for _, s := range batch {
+		// A span that cannot be encoded never can, so it is dropped rather than failing
+		// the batch
+		values, err := schema.insertValues(s)
+		if err != nil {
+			w.logger.ErrorContext(ctx, "dropping span that cannot be encoded", "trace-id", s.TraceID, "span-id", s.SpanID, "error", err)
+			span.RecordError(err)
+			continue
+		}
+
+		// The driver invalidates the batch when a value does not match its column
+		if _, err := stmt.ExecContext(ctx, values...); err != nil {
+			w.logger.ErrorContext(ctx, "unable to append span to batch", "error", err)
+			span.SetStatus(codes.Error, "unable to append span to batch")
+			span.RecordError(err)
+			return fmt.Errorf("%w: %w", errBatchRejected, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		w.logger.ErrorContext(ctx, "unable to send batch", "error", err)
+		span.SetStatus(codes.Error, "unable to send batch")
+		span.RecordError(err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,331 @@
+package clickhousestore
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// passthroughConverter accepts the maps and slices the Clickhouse driver supports but
+// database/sql does not.
+type passthroughConverter struct{}
+
+func (passthroughConverter) ConvertValue(v interface{}) (driver.Value, error) {
+	return v, nil
+}
+
+func TestClickhouseWriter_WriteSpan_batchSize(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(passthroughConverter{}))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	mock.ExpectBegin()
+	prepare := mock.ExpectPrepare(`INSERT INTO test \(Timestamp, TraceId, SpanId, .*Links.Attributes\)`)
+	prepare.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	prepare.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	w := NewWriter("test", 2, time.Hour, db, tracer)
+	ctx := context.Background()
+
+	assert.NoError(t, w.WriteSpan(ctx, &ClickhouseOtelSpan{TraceID: TestDataTraceIDOne, SpanID: "a7d2aa025caa9cb8"}))
+	assert.NoError(t, w.WriteSpan(ctx, &ClickhouseOtelSpan{TraceID: TestDataTraceIDOne, SpanID: "0d8fd33795ba49aa"}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// Closing with an empty buffer does not send another batch
+	assert.NoError(t, w.Close())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseWriter_Close(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(passthroughConverter{}))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	mock.ExpectBegin()
+	prepare := mock.ExpectPrepare(`INSERT INTO test`)
+	prepare.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	w := NewWriter("test", 100, time.Hour, db, tracer)
+
+	assert.NoError(t, w.WriteSpan(context.Background(), &ClickhouseOtelSpan{TraceID: TestDataTraceIDOne, SpanID: "a7d2aa025caa9cb8"}))
+	assert.NoError(t, w.Close())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseWriter_Flush_retry(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(passthroughConverter{}))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	// The first batch fails and is retried on its own before the spans written since
+	mock.ExpectBegin()
+	prepare := mock.ExpectPrepare(`INSERT INTO test`)
+	prepare.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	prepare.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit().WillReturnError(errors.New("connection reset"))
+	mock.ExpectBegin()
+	prepare = mock.ExpectPrepare(`INSERT INTO test`)
+	prepare.ExpectExec().WithArgs(spanArgs(TestDataTraceIDOne, "a7d2aa025caa9cb8")...).WillReturnResult(sqlmock.NewResult(0, 1))
+	prepare.ExpectExec().WithArgs(spanArgs(TestDataTraceIDOne, "0d8fd33795ba49aa")...).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	prepare = mock.ExpectPrepare(`INSERT INTO test`)
+	prepare.ExpectExec().WithArgs(spanArgs(TestDataTraceIDOne, "5b8aa5a2d2c872e8")...).WillReturnResult(sqlmock.NewResult(0, 1))
+	prepare.ExpectExec().WithArgs(spanArgs(TestDataTraceIDOne, "9c2d5e0b7a1f3e64")...).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	w := NewWriter("test", 2, time.Hour, db, tracer)
+
+	// Flushing full batches is not bound to the requests writing the spans
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.NoError(t, w.WriteSpan(ctx, &ClickhouseOtelSpan{TraceID: TestDataTraceIDOne, SpanID: "a7d2aa025caa9cb8"}))
+	assert.NoError(t, w.WriteSpan(ctx, &ClickhouseOtelSpan{TraceID: TestDataTraceIDOne, SpanID: "0d8fd33795ba49aa"}))
+	assert.NoError(t, w.WriteSpan(ctx, &ClickhouseOtelSpan{TraceID: TestDataTraceIDOne, SpanID: "5b8aa5a2d2c872e8"}))
+	assert.NoError(t, w.WriteSpan(ctx, &ClickhouseOtelSpan{TraceID: TestDataTraceIDOne, SpanID: "9c2d5e0b7a1f3e64"}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	assert.NoError(t, w.Close())
+}
+
+func TestClickhouseWriter_Flush_keepsFailing(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(passthroughConverter{}))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	// The batch is attempted until it is dropped, after which spans are accepted again
+	for i := 0; i < maxInsertAttempts; i++ {
+		mock.ExpectBegin().WillReturnError(errors.New("connection refused"))
+	}
+	mock.ExpectBegin()
+	mock.ExpectPrepare(`INSERT INTO test`).
+		ExpectExec().WithArgs(spanArgs(TestDataTraceIDTwo, "0d8fd33795ba49aa")...).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	w := NewWriter("test", 100, time.Hour, db, tracer)
+	ctx := context.Background()
+
+	assert.NoError(t, w.WriteSpan(ctx, &ClickhouseOtelSpan{TraceID: TestDataTraceIDOne, SpanID: "a7d2aa025caa9cb8"}))
+	for i := 1; i < maxInsertAttempts; i++ {
+		assert.ErrorContains(t, w.Flush(ctx), "connection refused")
+	}
+	assert.ErrorIs(t, w.Flush(ctx), ErrSpansDropped)
+
+	assert.NoError(t, w.WriteSpan(ctx, &ClickhouseOtelSpan{TraceID: TestDataTraceIDTwo, SpanID: "0d8fd33795ba49aa"}))
+	assert.NoError(t, w.Flush(ctx))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	assert.NoError(t, w.Close())
+}
+
+func TestClickhouseWriter_Flush_rejected(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(passthroughConverter{}))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	// A batch rejected by Clickhouse is dropped at once and does not fill the buffer
+	for i := 0; i <= maxBufferedBatches; i++ {
+		mock.ExpectBegin()
+		mock.ExpectPrepare(`INSERT INTO test`).
+			ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit().WillReturnError(&clickhouse.Exception{Code: 53, Message: "type mismatch"})
+	}
+
+	w := NewWriter("test", 1, time.Hour, db, tracer)
+	ctx := context.Background()
+
+	for i := 0; i <= maxBufferedBatches; i++ {
+		assert.NoError(t, w.WriteSpan(ctx, &ClickhouseOtelSpan{TraceID: TestDataTraceIDOne}))
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	assert.NoError(t, w.Close())
+}
+
+func TestClickhouseWriter_WriteSpan_bufferFull(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(passthroughConverter{}))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	for i := 0; i < maxBufferedBatches; i++ {
+		mock.ExpectBegin().WillReturnError(errors.New("connection refused"))
+	}
+
+	w := NewWriter("test", 1, time.Hour, db, tracer)
+	ctx := context.Background()
+
+	for i := 0; i < maxBufferedBatches; i++ {
+		assert.NoError(t, w.WriteSpan(ctx, &ClickhouseOtelSpan{TraceID: TestDataTraceIDOne}))
+	}
+	assert.ErrorIs(t, w.WriteSpan(ctx, &ClickhouseOtelSpan{TraceID: TestDataTraceIDOne}), ErrWriterBufferFull)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseWriter_Close_failedBatch(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(passthroughConverter{}))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	// The failed batch fails again on close, which does not keep the buffered spans from
+	// being inserted
+	mock.ExpectBegin().WillReturnError(errors.New("connection refused"))
+	mock.ExpectBegin().WillReturnError(errors.New("connection refused"))
+	mock.ExpectBegin()
+	mock.ExpectPrepare(`INSERT INTO test`).
+		ExpectExec().WithArgs(spanArgs(TestDataTraceIDTwo, "0d8fd33795ba49aa")...).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	w := NewWriter("test", 100, time.Hour, db, tracer)
+	ctx := context.Background()
+
+	assert.NoError(t, w.WriteSpan(ctx, &ClickhouseOtelSpan{TraceID: TestDataTraceIDOne, SpanID: "a7d2aa025caa9cb8"}))
+	assert.ErrorContains(t, w.Flush(ctx), "connection refused")
+	assert.NoError(t, w.WriteSpan(ctx, &ClickhouseOtelSpan{TraceID: TestDataTraceIDTwo, SpanID: "0d8fd33795ba49aa"}))
+
+	err = w.Close()
+	assert.ErrorIs(t, err, ErrSpansDropped)
+	assert.ErrorContains(t, err, "1 lost on close")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClickhouseWriter_Close_timeout(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(passthroughConverter{}))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	// An unresponsive Clickhouse does not hold up closing past the timeout
+	mock.ExpectBegin().WillDelayFor(time.Minute)
+
+	w := NewWriter("test", 100, time.Hour, db, tracer)
+	w.SetCloseTimeout(50 * time.Millisecond)
+
+	assert.NoError(t, w.WriteSpan(context.Background(), &ClickhouseOtelSpan{TraceID: TestDataTraceIDOne}))
+
+	start := time.Now()
+	assert.ErrorIs(t, w.Close(), ErrSpansDropped)
+	assert.Less(t, time.Since(start), 10*time.Second)
+}
+
+func TestClickhouseWriter_Close_idempotent(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(passthroughConverter{}))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	w := NewWriter("test", 100, time.Hour, db, tracer)
+
+	assert.NoError(t, w.Close())
+	assert.NoError(t, w.Close())
+	assert.ErrorIs(t, w.WriteSpan(context.Background(), &ClickhouseOtelSpan{TraceID: TestDataTraceIDOne}), ErrWriterClosed)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// spanArgs returns the arguments of an inserted span, matching only its trace and span ID
+func spanArgs(traceID string, spanID string) []driver.Value {
+	args := make([]driver.Value, 22)
+	for i := range args {
+		args[i] = sqlmock.AnyArg()
+	}
+	args[1] = traceID
+	args[2] = spanID
+	return args
+}
+
+func TestClickhouseWriter_UseSchema(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(passthroughConverter{}))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	tracer := trace.NewNoopTracerProvider().Tracer("test-tracer")
+
+	// A table with JSON attributes, created by an exporter version without links
+	columns := map[string]string{}
+	for name, columnType := range DefaultSchema().columns {
+		if !strings.HasPrefix(name, "Links.") {
+			columns[name] = strings.ReplaceAll(columnType, "Map(LowCardinality(String), String)", "JSON")
+		}
+	}
+	schema, err := ParseSchema(columns)
+	assert.NoError(t, err)
+
+	timestamp := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	prepare := mock.ExpectPrepare(regexp.QuoteMeta("INSERT INTO test (Timestamp, TraceId, SpanId, ParentSpanId, TraceState, SpanName, SpanKind, ServiceName, ResourceAttributes, ScopeName, ScopeVersion, SpanAttributes, Duration, StatusCode, StatusMessage, Events.Timestamp, Events.Name, Events.Attributes)"))
+	prepare.ExpectExec().
+		WithArgs(
+			timestamp, TestDataTraceIDOne, "a7d2aa025caa9cb8", "", "", TestDataSpanNameOne, "Server", TestDataServiceNameOne,
+			`{"host.name":"a"}`, "", "", `{}`, int64(0), "Ok", "",
+			[]time.Time{timestamp}, []string{"event"}, []string{`{"key":"value"}`},
+		).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	w := NewWriter("test", 1, time.Hour, db, tracer)
+	w.UseSchema(schema)
+
+	assert.NoError(t, w.WriteSpan(context.Background(), &ClickhouseOtelSpan{
+		Timestamp:          timestamp,
+		TraceID:            TestDataTraceIDOne,
+		SpanID:             "a7d2aa025caa9cb8",
+		SpanName:           TestDataSpanNameOne,
+		SpanKind:           "Server",
+		ServiceName:        TestDataServiceNameOne,
+		ResourceAttributes: map[string]string{"host.name": "a"},
+		StatusCode:         "Ok",
+		EventsTimestamp:    []time.Time{timestamp},
+		EventsName:         []string{"event"},
+		EventsAttributes:   []map[string]string{{"key": "value"}},
+		LinksTraceID:       []string{TestDataTraceIDTwo},
+	}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.NoError(t, w.Close())
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"fmt"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/clickhousestore"
 	"github.com/spf13/viper"
 )
 
@@ -9,6 +10,33 @@ const (
 	defaultDatabase = "otel"
 	defaultTable    = "otel_traces"
 	defaultUser     = "default"
+
+	defaultTraceIDTsTableSuffix = "_trace_id_ts"
+
+	defaultWriterBatchSize           = 10000
+	defaultWriterFlushIntervalMillis = 5000
+
+	defaultDependenciesTableSuffix     = "_dependencies"
+	defaultDependenciesIntervalSeconds = 60
+	defaultDependenciesBucketSeconds   = 300
+	defaultDependenciesLookbackSeconds = 3600
+	defaultDependenciesLagSeconds      = 300
+	// Parent spans of requests taking longer than this are not joined to their child spans
+	defaultDependenciesParentWindowSeconds = 300
+
+	defaultMetricsQueryPort         = 14484
+	defaultMetricsRollupTableSuffix = "_metrics"
+
+	defaultArchiveTableSuffix = "_archive"
+
+	// Together with the cleanup time, fits the termination grace period of 40 seconds the
+	// Helm chart sets
+	defaultShutdownDrainTimeoutSeconds = 25
+	// Covers flushing buffered spans and exporting the traces of the backend
+	defaultShutdownCleanupSeconds = 15
+
+	defaultHealthPort                 = 14483
+	defaultHealthCheckIntervalSeconds = 10
 )
 
 type Config struct {
@@ -27,6 +55,48 @@ type Config struct {
 	DBConnMaxIdleTimeMillis uint   `yaml:"db_conn_max_idle_time_millis"`
 	PadTraceID              bool   `yaml:"pad_trace_id"`
 	EnableTracing           bool   `yaml:"enable_tracing"`
+
+	AttributeTypes []string `yaml:"attribute_types"`
+
+	ProgressiveSearchSteps                uint   `yaml:"progressive_search_steps"`
+	ProgressiveSearchInitialWindowSeconds uint   `yaml:"progressive_search_initial_window_seconds"`
+	SearchTimeBudgetMillis                uint   `yaml:"search_time_budget_millis"`
+	SearchAllServicesMaxRangeSeconds      uint   `yaml:"search_all_services_max_range_seconds"`
+	SearchDurationScope                   string `yaml:"search_duration_scope"`
+	SearchMatchScope                      string `yaml:"search_match_scope"`
+
+	QueryMaxExecutionTimeSeconds uint   `yaml:"query_max_execution_time_seconds"`
+	QueryMaxRowsToRead           uint64 `yaml:"query_max_rows_to_read"`
+	QueryMaxBytesToRead          uint64 `yaml:"query_max_bytes_to_read"`
+	QueryTimeoutOverflowMode     string `yaml:"query_timeout_overflow_mode"`
+
+	TraceIDTsEnabled bool   `yaml:"trace_id_ts_enabled"`
+	TraceIDTsTable   string `yaml:"trace_id_ts_table"`
+
+	WriterBatchSize           uint `yaml:"writer_batch_size"`
+	WriterFlushIntervalMillis uint `yaml:"writer_flush_interval_millis"`
+
+	DependenciesEnabled             bool   `yaml:"dependencies_enabled"`
+	DependenciesTable               string `yaml:"dependencies_table"`
+	DependenciesIntervalSeconds     uint   `yaml:"dependencies_interval_seconds"`
+	DependenciesBucketSeconds       uint   `yaml:"dependencies_bucket_seconds"`
+	DependenciesLookbackSeconds     uint   `yaml:"dependencies_lookback_seconds"`
+	DependenciesLagSeconds          uint   `yaml:"dependencies_lag_seconds"`
+	DependenciesParentWindowSeconds uint   `yaml:"dependencies_parent_window_seconds"`
+
+	MetricsQueryEnabled  bool   `yaml:"metrics_query_enabled"`
+	MetricsQueryPort     int    `yaml:"metrics_query_port"`
+	MetricsRollupEnabled bool   `yaml:"metrics_rollup_enabled"`
+	MetricsRollupTable   string `yaml:"metrics_rollup_table"`
+
+	ArchiveEnabled bool   `yaml:"archive_enabled"`
+	ArchiveTable   string `yaml:"archive_table"`
+
+	ShutdownDrainTimeoutSeconds uint `yaml:"shutdown_drain_timeout_seconds"`
+	ShutdownCleanupSeconds      uint `yaml:"shutdown_cleanup_seconds"`
+
+	HealthPort                 int  `yaml:"health_port"`
+	HealthCheckIntervalSeconds uint `yaml:"health_check_interval_seconds"`
 }
 
 func NewConfig(v *viper.Viper) (*Config, error) {
@@ -56,6 +126,42 @@ func (c *Config) initFromViper(v *viper.Viper) {
 	c.DBConnMaxIdleTimeMillis = v.GetUint("db_conn_max_idle_time_millis")
 	c.PadTraceID = v.GetBool("pad_trace_id")
 	c.EnableTracing = v.GetBool("enable_tracing")
+	c.AttributeTypes = v.GetStringSlice("attribute_types")
+	c.ProgressiveSearchSteps = v.GetUint("progressive_search_steps")
+	c.ProgressiveSearchInitialWindowSeconds = v.GetUint("progressive_search_initial_window_seconds")
+	c.SearchTimeBudgetMillis = v.GetUint("search_time_budget_millis")
+	// Zero disables the limit, so only an unset range defaults
+	c.SearchAllServicesMaxRangeSeconds = uint(defaultAllServicesMaxRange.Seconds())
+	if v.IsSet("search_all_services_max_range_seconds") {
+		c.SearchAllServicesMaxRangeSeconds = v.GetUint("search_all_services_max_range_seconds")
+	}
+	c.SearchDurationScope = v.GetString("search_duration_scope")
+	c.SearchMatchScope = v.GetString("search_match_scope")
+	c.QueryMaxExecutionTimeSeconds = v.GetUint("query_max_execution_time_seconds")
+	c.QueryMaxRowsToRead = v.GetUint64("query_max_rows_to_read")
+	c.QueryMaxBytesToRead = v.GetUint64("query_max_bytes_to_read")
+	c.QueryTimeoutOverflowMode = v.GetString("query_timeout_overflow_mode")
+	c.TraceIDTsEnabled = v.GetBool("trace_id_ts_enabled")
+	c.TraceIDTsTable = v.GetString("trace_id_ts_table")
+	c.WriterBatchSize = v.GetUint("writer_batch_size")
+	c.WriterFlushIntervalMillis = v.GetUint("writer_flush_interval_millis")
+	c.DependenciesEnabled = v.GetBool("dependencies_enabled")
+	c.DependenciesTable = v.GetString("dependencies_table")
+	c.DependenciesIntervalSeconds = v.GetUint("dependencies_interval_seconds")
+	c.DependenciesBucketSeconds = v.GetUint("dependencies_bucket_seconds")
+	c.DependenciesLookbackSeconds = v.GetUint("dependencies_lookback_seconds")
+	c.DependenciesLagSeconds = v.GetUint("dependencies_lag_seconds")
+	c.DependenciesParentWindowSeconds = v.GetUint("dependencies_parent_window_seconds")
+	c.MetricsQueryEnabled = v.GetBool("metrics_query_enabled")
+	c.MetricsQueryPort = v.GetInt("metrics_query_port")
+	c.MetricsRollupEnabled = v.GetBool("metrics_rollup_enabled")
+	c.MetricsRollupTable = v.GetString("metrics_rollup_table")
+	c.ArchiveEnabled = v.GetBool("archive_enabled")
+	c.ArchiveTable = v.GetString("archive_table")
+	c.ShutdownDrainTimeoutSeconds = v.GetUint("shutdown_drain_timeout_seconds")
+	c.ShutdownCleanupSeconds = v.GetUint("shutdown_cleanup_seconds")
+	c.HealthPort = v.GetInt("health_port")
+	c.HealthCheckIntervalSeconds = v.GetUint("health_check_interval_seconds")
 }
 
 func (c *Config) validate() error {
@@ -75,5 +181,95 @@ func (c *Config) validate() error {
 		c.DBTable = defaultTable
 	}
 
+	if c.ProgressiveSearchSteps == 0 {
+		c.ProgressiveSearchSteps = defaultProgressiveSearchSteps
+	}
+
+	if c.ProgressiveSearchInitialWindowSeconds == 0 {
+		c.ProgressiveSearchInitialWindowSeconds = uint(defaultProgressiveSearchInitialWindow.Seconds())
+	}
+
+	durationScope, err := ParseScope(c.SearchDurationScope)
+	if err != nil {
+		return fmt.Errorf("search_duration_scope: %w", err)
+	}
+	c.SearchDurationScope = string(durationScope)
+
+	matchScope, err := ParseScope(c.SearchMatchScope)
+	if err != nil {
+		return fmt.Errorf("search_match_scope: %w", err)
+	}
+	c.SearchMatchScope = string(matchScope)
+
+	switch c.QueryTimeoutOverflowMode {
+	case "", clickhousestore.TimeoutOverflowModeThrow, clickhousestore.TimeoutOverflowModeBreak:
+	default:
+		return fmt.Errorf("query_timeout_overflow_mode must be %s or %s", clickhousestore.TimeoutOverflowModeThrow, clickhousestore.TimeoutOverflowModeBreak)
+	}
+
+	if c.TraceIDTsTable == "" {
+		c.TraceIDTsTable = c.DBTable + defaultTraceIDTsTableSuffix
+	}
+
+	if c.WriterBatchSize == 0 {
+		c.WriterBatchSize = defaultWriterBatchSize
+	}
+
+	if c.WriterFlushIntervalMillis == 0 {
+		c.WriterFlushIntervalMillis = defaultWriterFlushIntervalMillis
+	}
+
+	if c.DependenciesTable == "" {
+		c.DependenciesTable = c.DBTable + defaultDependenciesTableSuffix
+	}
+
+	if c.DependenciesIntervalSeconds == 0 {
+		c.DependenciesIntervalSeconds = defaultDependenciesIntervalSeconds
+	}
+
+	if c.DependenciesBucketSeconds == 0 {
+		c.DependenciesBucketSeconds = defaultDependenciesBucketSeconds
+	}
+
+	if c.DependenciesLookbackSeconds == 0 {
+		c.DependenciesLookbackSeconds = defaultDependenciesLookbackSeconds
+	}
+
+	if c.DependenciesLagSeconds == 0 {
+		c.DependenciesLagSeconds = defaultDependenciesLagSeconds
+	}
+
+	if c.DependenciesParentWindowSeconds == 0 {
+		c.DependenciesParentWindowSeconds = defaultDependenciesParentWindowSeconds
+	}
+
+	if c.MetricsQueryPort == 0 {
+		c.MetricsQueryPort = defaultMetricsQueryPort
+	}
+
+	if c.MetricsRollupTable == "" {
+		c.MetricsRollupTable = c.DBTable + defaultMetricsRollupTableSuffix
+	}
+
+	if c.ArchiveTable == "" {
+		c.ArchiveTable = c.DBTable + defaultArchiveTableSuffix
+	}
+
+	if c.ShutdownDrainTimeoutSeconds == 0 {
+		c.ShutdownDrainTimeoutSeconds = defaultShutdownDrainTimeoutSeconds
+	}
+
+	if c.ShutdownCleanupSeconds == 0 {
+		c.ShutdownCleanupSeconds = defaultShutdownCleanupSeconds
+	}
+
+	if c.HealthPort == 0 {
+		c.HealthPort = defaultHealthPort
+	}
+
+	if c.HealthCheckIntervalSeconds == 0 {
+		c.HealthCheckIntervalSeconds = defaultHealthCheckIntervalSeconds
+	}
+
 	return nil
 }
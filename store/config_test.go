@@ -0,0 +1,34 @@
+package store
+
+import (
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNewConfig_searchAllServicesMaxRange(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  uint
+	}{
+		{name: "unset", value: nil, want: 3600},
+		{name: "set", value: 900, want: 900},
+		{name: "disabled", value: 0, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := viper.New()
+			v.Set("db_host", "localhost")
+			v.Set("db_port", 9000)
+			if tt.value != nil {
+				v.Set("search_all_services_max_range_seconds", tt.value)
+			}
+
+			config, err := NewConfig(v)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, config.SearchAllServicesMaxRangeSeconds)
+		})
+	}
+}
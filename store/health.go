@@ -0,0 +1,185 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/clickhousestore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	errNotChecked   = errors.New("clickhouse has not been checked yet")
+	errShuttingDown = errors.New("server is shutting down")
+)
+
+// Pinger checks the connection to Clickhouse, as implemented by sql.DB.
+type Pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// SchemaChecker checks the schema of the spans table, as implemented by ClickhouseReader.
+type SchemaChecker interface {
+	CheckSchema(ctx context.Context) (*clickhousestore.Schema, error)
+}
+
+// Health reports the health of the backend through the gRPC health service and through
+// HTTP endpoints. The backend is live while the gRPC server is serving, and ready while
+// Clickhouse is reachable and the spans table has a compatible schema, which is checked
+// periodically.
+type Health struct {
+	db       Pinger
+	schema   SchemaChecker
+	interval time.Duration
+	server   *health.Server
+	logger   *slog.Logger
+
+	mu       sync.RWMutex
+	live     bool
+	readyErr error
+	shutdown bool
+}
+
+func NewHealth(db Pinger, schema SchemaChecker, interval time.Duration) *Health {
+	h := &Health{
+		db:       db,
+		schema:   schema,
+		interval: interval,
+		server:   health.NewServer(),
+		logger:   slog.Default(),
+		readyErr: errNotChecked,
+	}
+
+	// Not serving until Clickhouse has been checked
+	h.server.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	return h
+}
+
+// Register registers the grpc.health.v1 service with a gRPC server. The status of the
+// server as a whole, the empty service name, reflects readiness.
+func (h *Health) Register(server *grpc.Server) {
+	healthpb.RegisterHealthServer(server, h.server)
+}
+
+// Run checks Clickhouse every interval until the context is cancelled.
+func (h *Health) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		_ = h.Check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check pings Clickhouse and checks the schema of the spans table, updating readiness.
+// Each check is limited to the interval, so that a hanging connection is reported as not
+// ready before the next check is due.
+func (h *Health) Check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, h.interval)
+	defer cancel()
+
+	err := h.db.PingContext(ctx)
+	if err != nil {
+		err = fmt.Errorf("unable to ping clickhouse: %w", err)
+	} else if _, schemaErr := h.schema.CheckSchema(ctx); schemaErr != nil {
+		err = fmt.Errorf("unable to check table schema: %w", schemaErr)
+	}
+
+	h.setReady(ctx, err)
+
+	return err
+}
+
+// SetLive sets whether the gRPC server is serving.
+func (h *Health) SetLive(live bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.live = live
+}
+
+// Shutdown reports the backend as not ready from then on, so that no new requests are
+// routed to it while in-flight requests are drained.
+func (h *Health) Shutdown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.shutdown = true
+	h.server.Shutdown()
+}
+
+// Handler returns the HTTP handler serving /healthz for liveness and /readyz for readiness.
+func (h *Health) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !h.Live() {
+			http.Error(w, "server is not serving", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := h.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+// Live returns whether the gRPC server is serving.
+func (h *Health) Live() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.live
+}
+
+// Ready returns the reason the backend is not ready, or nil if it is ready.
+func (h *Health) Ready() error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.shutdown {
+		return errShuttingDown
+	}
+	return h.readyErr
+}
+
+func (h *Health) setReady(ctx context.Context, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.shutdown {
+		return
+	}
+
+	// Only log changes, as checks run continuously
+	if err != nil && (h.readyErr == nil || h.readyErr.Error() != err.Error()) {
+		h.logger.WarnContext(ctx, "backend is not ready", "error", err)
+	} else if err == nil && h.readyErr != nil {
+		h.logger.InfoContext(ctx, "backend is ready")
+	}
+
+	h.readyErr = err
+
+	if err != nil {
+		h.server.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	} else {
+		h.server.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	}
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/clickhousestore"
+	"github.com/stretchr/testify/assert"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type mockPinger struct {
+	err error
+}
+
+func (p *mockPinger) PingContext(_ context.Context) error {
+	return p.err
+}
+
+type mockSchemaChecker struct {
+	err error
+}
+
+func (c *mockSchemaChecker) CheckSchema(_ context.Context) (*clickhousestore.Schema, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return clickhousestore.DefaultSchema(), nil
+}
+
+func TestHealth(t *testing.T) {
+	pinger := &mockPinger{}
+	schemaChecker := &mockSchemaChecker{}
+	h := NewHealth(pinger, schemaChecker, time.Second)
+	ctx := context.Background()
+
+	status := func() healthpb.HealthCheckResponse_ServingStatus {
+		res, err := h.server.Check(ctx, &healthpb.HealthCheckRequest{})
+		assert.NoError(t, err)
+		return res.Status
+	}
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		h.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	// Neither live nor ready before serving and checking
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, status())
+	assert.Equal(t, http.StatusServiceUnavailable, get("/healthz"))
+	assert.Equal(t, http.StatusServiceUnavailable, get("/readyz"))
+
+	h.SetLive(true)
+	assert.NoError(t, h.Check(ctx))
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, status())
+	assert.Equal(t, http.StatusOK, get("/healthz"))
+	assert.Equal(t, http.StatusOK, get("/readyz"))
+
+	pinger.err = errors.New("connection refused")
+	assert.ErrorIs(t, h.Check(ctx), pinger.err)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, status())
+	assert.Equal(t, http.StatusOK, get("/healthz"))
+	assert.Equal(t, http.StatusServiceUnavailable, get("/readyz"))
+
+	pinger.err = nil
+	schemaChecker.err = clickhousestore.ErrIncompatibleSchema
+	assert.ErrorIs(t, h.Check(ctx), clickhousestore.ErrIncompatibleSchema)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, status())
+	assert.Equal(t, http.StatusServiceUnavailable, get("/readyz"))
+
+	schemaChecker.err = nil
+	assert.NoError(t, h.Check(ctx))
+	assert.Equal(t, http.StatusOK, get("/readyz"))
+
+	// Not ready once shutting down, even if Clickhouse is reachable
+	h.Shutdown()
+	assert.NoError(t, h.Check(ctx))
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, status())
+	assert.Equal(t, http.StatusOK, get("/healthz"))
+	assert.Equal(t, http.StatusServiceUnavailable, get("/readyz"))
+
+	h.SetLive(false)
+	assert.Equal(t, http.StatusServiceUnavailable, get("/healthz"))
+}
@@ -0,0 +1,239 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gogo/protobuf/types"
+	"github.com/jaegertracing/jaeger/proto-gen/api_v2/metrics"
+	"github.com/jaegertracing/jaeger/storage/metricsstore"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/clickhousestore"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Defaults of metrics queries, matching the defaults of Jaeger Query
+const (
+	defaultMetricsLookback = time.Hour
+	defaultMetricsStep     = 5 * time.Second
+	defaultMetricsRatePer  = 10 * time.Minute
+
+	// Points closer than a second would aggregate a few spans each only
+	minMetricsStep = time.Second
+)
+
+var defaultMetricsSpanKinds = []string{metrics.SpanKind_SPAN_KIND_SERVER.String()}
+
+var (
+	ErrServiceNamesRequired = clickhousestore.ErrServiceNamesRequired
+	ErrInvalidQuantile      = errors.New("quantile must be greater than 0 and at most 1")
+)
+
+// MetricsReader implements the metrics store reader of Jaeger, computing the RED metrics,
+// the rate, errors and duration of calls to services, from the spans stored in Clickhouse.
+type MetricsReader struct {
+	clickhousestore clickhousestore.ClickhouseMetricsStore
+	tracer          trace.Tracer
+	logger          *slog.Logger
+}
+
+func NewMetricsReader(store clickhousestore.ClickhouseMetricsStore, tracer trace.Tracer) *MetricsReader {
+	return &MetricsReader{
+		clickhousestore: store,
+		tracer:          tracer,
+		logger:          slog.Default(),
+	}
+}
+
+// GetLatencies returns the quantile of the duration of calls in milliseconds.
+func (m *MetricsReader) GetLatencies(ctx context.Context, params *metricsstore.LatenciesQueryParameters) (*metrics.MetricFamily, error) {
+	ctx, span := m.tracer.Start(ctx, "metrics:GetLatencies")
+	defer span.End()
+
+	if params.Quantile <= 0 || params.Quantile > 1 {
+		return nil, ErrInvalidQuantile
+	}
+
+	query, err := metricsQuery(params.BaseQueryParameters)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.String("time-range", query.EndTime.Sub(query.StartTime).String()))
+
+	points, err := m.clickhousestore.GetLatencies(ctx, query, params.Quantile)
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	family := newMetricFamily(
+		"service_latencies",
+		fmt.Sprintf("%.2fth quantile latency, grouped by service", params.Quantile),
+		query.GroupByOperation,
+	)
+	for _, point := range points {
+		family.add(point.ServiceName, point.Operation, point.Timestamp, point.Value)
+	}
+
+	return family.MetricFamily, nil
+}
+
+// GetCallRates returns the number of calls per second.
+func (m *MetricsReader) GetCallRates(ctx context.Context, params *metricsstore.CallRateQueryParameters) (*metrics.MetricFamily, error) {
+	ctx, span := m.tracer.Start(ctx, "metrics:GetCallRates")
+	defer span.End()
+
+	query, err := metricsQuery(params.BaseQueryParameters)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.String("time-range", query.EndTime.Sub(query.StartTime).String()))
+
+	counts, err := m.clickhousestore.GetCallCounts(ctx, query)
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	family := newMetricFamily("service_call_rate", "calls/sec, grouped by service", query.GroupByOperation)
+	for _, count := range counts {
+		family.add(count.ServiceName, count.Operation, count.Timestamp, float64(count.Calls)/query.Window.Seconds())
+	}
+
+	return family.MetricFamily, nil
+}
+
+// GetErrorRates returns the fraction of calls with an error status.
+func (m *MetricsReader) GetErrorRates(ctx context.Context, params *metricsstore.ErrorRateQueryParameters) (*metrics.MetricFamily, error) {
+	ctx, span := m.tracer.Start(ctx, "metrics:GetErrorRates")
+	defer span.End()
+
+	query, err := metricsQuery(params.BaseQueryParameters)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.String("time-range", query.EndTime.Sub(query.StartTime).String()))
+
+	counts, err := m.clickhousestore.GetCallCounts(ctx, query)
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	family := newMetricFamily(
+		"service_error_rate",
+		"error rate, computed as a fraction of errors/sec over calls/sec, grouped by service",
+		query.GroupByOperation,
+	)
+	for _, count := range counts {
+		family.add(count.ServiceName, count.Operation, count.Timestamp, float64(count.Errors)/float64(count.Calls))
+	}
+
+	return family.MetricFamily, nil
+}
+
+// GetMinStepDuration returns the minimum time between points of metrics.
+func (m *MetricsReader) GetMinStepDuration(_ context.Context, _ *metricsstore.MinStepDurationQueryParameters) (time.Duration, error) {
+	return minMetricsStep, nil
+}
+
+// metricsQuery converts the parameters of Jaeger into a query, using the defaults of Jaeger
+// Query for missing parameters. The window aggregated into each point covers the rate
+// duration in whole steps.
+func metricsQuery(params metricsstore.BaseQueryParameters) (clickhousestore.MetricsQuery, error) {
+	if len(params.ServiceNames) == 0 {
+		return clickhousestore.MetricsQuery{}, ErrServiceNamesRequired
+	}
+
+	endTime := time.Now()
+	if params.EndTime != nil {
+		endTime = *params.EndTime
+	}
+
+	lookback := defaultMetricsLookback
+	if params.Lookback != nil {
+		lookback = *params.Lookback
+	}
+
+	step := defaultMetricsStep
+	if params.Step != nil {
+		step = *params.Step
+	}
+	if step < minMetricsStep {
+		step = minMetricsStep
+	}
+
+	ratePer := defaultMetricsRatePer
+	if params.RatePer != nil {
+		ratePer = *params.RatePer
+	}
+
+	window := step
+	if ratePer > step {
+		window = step * ((ratePer + step - 1) / step)
+	}
+
+	spanKinds := params.SpanKinds
+	if len(spanKinds) == 0 {
+		spanKinds = defaultMetricsSpanKinds
+	}
+
+	return clickhousestore.MetricsQuery{
+		ServiceNames:     params.ServiceNames,
+		GroupByOperation: params.GroupByOperation,
+		SpanKinds:        spanKinds,
+		StartTime:        endTime.Add(-lookback),
+		EndTime:          endTime,
+		Step:             step,
+		Window:           window,
+	}, nil
+}
+
+// metricFamily collects points into the metrics of services or their operations
+type metricFamily struct {
+	*metrics.MetricFamily
+	groupByOperation bool
+	metrics          map[string]*metrics.Metric
+}
+
+// newMetricFamily returns a family of gauges, named after service operations rather than
+// services when grouped by operation, as Jaeger UI expects them.
+func newMetricFamily(name string, help string, groupByOperation bool) *metricFamily {
+	if groupByOperation {
+		name = strings.Replace(name, "service", "service_operation", 1)
+		help += " & operation"
+	}
+
+	return &metricFamily{
+		MetricFamily: &metrics.MetricFamily{
+			Name:    name,
+			Type:    metrics.MetricType_GAUGE,
+			Help:    help,
+			Metrics: []*metrics.Metric{},
+		},
+		groupByOperation: groupByOperation,
+		metrics:          map[string]*metrics.Metric{},
+	}
+}
+
+// add appends a point to the metric of the service, or of the operation of the service
+func (f *metricFamily) add(serviceName string, operation string, timestamp time.Time, value float64) {
+	key := serviceName + "\x00" + operation
+
+	metric, ok := f.metrics[key]
+	if !ok {
+		metric = &metrics.Metric{Labels: []*metrics.Label{{Name: "service_name", Value: serviceName}}}
+		if f.groupByOperation {
+			metric.Labels = append(metric.Labels, &metrics.Label{Name: "operation", Value: operation})
+		}
+		f.metrics[key] = metric
+		f.Metrics = append(f.Metrics, metric)
+	}
+
+	metric.MetricPoints = append(metric.MetricPoints, &metrics.MetricPoint{
+		Timestamp: &types.Timestamp{Seconds: timestamp.Unix(), Nanos: int32(timestamp.Nanosecond())},
+		Value: &metrics.MetricPoint_GaugeValue{
+			GaugeValue: &metrics.GaugeValue{Value: &metrics.GaugeValue_DoubleValue{DoubleValue: value}},
+		},
+	})
+}
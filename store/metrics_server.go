@@ -0,0 +1,102 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/jaegertracing/jaeger/proto-gen/api_v2/metrics"
+	"github.com/jaegertracing/jaeger/storage/metricsstore"
+	"google.golang.org/grpc"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MetricsQueryServer serves a metrics reader as the MetricsQueryService of the Jaeger API,
+// which the storage plugin API does not provide a service for. Jaeger Query does not call
+// it, as it reads metrics through the PrometheusAPI, so it serves clients connecting to
+// the backend directly.
+type MetricsQueryServer struct {
+	reader metricsstore.Reader
+}
+
+func NewMetricsQueryServer(reader metricsstore.Reader) *MetricsQueryServer {
+	return &MetricsQueryServer{reader: reader}
+}
+
+// Register registers the MetricsQueryService with a gRPC server.
+func (s *MetricsQueryServer) Register(server *grpc.Server) {
+	metrics.RegisterMetricsQueryServiceServer(server, s)
+}
+
+func (s *MetricsQueryServer) GetMinStepDuration(ctx context.Context, _ *metrics.GetMinStepDurationRequest) (*metrics.GetMinStepDurationResponse, error) {
+	minStep, err := s.reader.GetMinStepDuration(ctx, &metricsstore.MinStepDurationQueryParameters{})
+	if err != nil {
+		return nil, metricsStatusError(err)
+	}
+	return &metrics.GetMinStepDurationResponse{MinStep: minStep}, nil
+}
+
+func (s *MetricsQueryServer) GetLatencies(ctx context.Context, r *metrics.GetLatenciesRequest) (*metrics.GetMetricsResponse, error) {
+	family, err := s.reader.GetLatencies(ctx, &metricsstore.LatenciesQueryParameters{
+		BaseQueryParameters: baseQueryParameters(r.GetBaseRequest()),
+		Quantile:            r.GetQuantile(),
+	})
+	if err != nil {
+		return nil, metricsStatusError(err)
+	}
+	return &metrics.GetMetricsResponse{Metrics: *family}, nil
+}
+
+func (s *MetricsQueryServer) GetCallRates(ctx context.Context, r *metrics.GetCallRatesRequest) (*metrics.GetMetricsResponse, error) {
+	family, err := s.reader.GetCallRates(ctx, &metricsstore.CallRateQueryParameters{
+		BaseQueryParameters: baseQueryParameters(r.GetBaseRequest()),
+	})
+	if err != nil {
+		return nil, metricsStatusError(err)
+	}
+	return &metrics.GetMetricsResponse{Metrics: *family}, nil
+}
+
+func (s *MetricsQueryServer) GetErrorRates(ctx context.Context, r *metrics.GetErrorRatesRequest) (*metrics.GetMetricsResponse, error) {
+	family, err := s.reader.GetErrorRates(ctx, &metricsstore.ErrorRateQueryParameters{
+		BaseQueryParameters: baseQueryParameters(r.GetBaseRequest()),
+	})
+	if err != nil {
+		return nil, metricsStatusError(err)
+	}
+	return &metrics.GetMetricsResponse{Metrics: *family}, nil
+}
+
+// baseQueryParameters converts a request into parameters, leaving missing parameters to
+// the defaults of the reader
+func baseQueryParameters(r *metrics.MetricsQueryBaseRequest) metricsstore.BaseQueryParameters {
+	if r == nil {
+		return metricsstore.BaseQueryParameters{}
+	}
+
+	spanKinds := make([]string, 0, len(r.SpanKinds))
+	for _, spanKind := range r.SpanKinds {
+		spanKinds = append(spanKinds, spanKind.String())
+	}
+
+	return metricsstore.BaseQueryParameters{
+		ServiceNames:     r.ServiceNames,
+		GroupByOperation: r.GroupByOperation,
+		EndTime:          r.EndTime,
+		Lookback:         r.Lookback,
+		Step:             r.Step,
+		RatePer:          r.RatePer,
+		SpanKinds:        spanKinds,
+	}
+}
+
+// metricsStatusError converts invalid parameters into an InvalidArgument status and other
+// errors without a status into an Internal status
+func metricsStatusError(err error) error {
+	if errors.Is(err, ErrServiceNamesRequired) || errors.Is(err, ErrInvalidQuantile) {
+		return status.Error(grpccodes.InvalidArgument, err.Error())
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(grpccodes.Internal, err.Error())
+}
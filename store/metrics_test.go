@@ -0,0 +1,163 @@
+package store
+
+import (
+	"context"
+	"github.com/jaegertracing/jaeger/proto-gen/api_v2/metrics"
+	"github.com/jaegertracing/jaeger/storage/metricsstore"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/clickhousestore"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestMetricsReader_GetCallRates(t *testing.T) {
+	mockReader := clickhousestore.NewMockClickhouseReader(2)
+	reader := NewMetricsReader(mockReader, noop.Tracer{})
+
+	endTime := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	lookback := 30 * time.Minute
+	step := time.Minute
+	ratePer := 5 * time.Minute
+
+	got, err := reader.GetCallRates(context.Background(), &metricsstore.CallRateQueryParameters{
+		BaseQueryParameters: metricsstore.BaseQueryParameters{
+			ServiceNames: []string{clickhousestore.TestDataServiceNameOne},
+			EndTime:      &endTime,
+			Lookback:     &lookback,
+			Step:         &step,
+			RatePer:      &ratePer,
+		},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []clickhousestore.MetricsQuery{{
+		ServiceNames: []string{clickhousestore.TestDataServiceNameOne},
+		SpanKinds:    []string{"SPAN_KIND_SERVER"},
+		StartTime:    endTime.Add(-lookback),
+		EndTime:      endTime,
+		Step:         step,
+		Window:       ratePer,
+	}}, mockReader.MetricsCalls)
+
+	assert.Equal(t, "service_call_rate", got.Name)
+	assert.Equal(t, metrics.MetricType_GAUGE, got.Type)
+	assert.Equal(t, 1, len(got.Metrics))
+	assert.Equal(t, []*metrics.Label{{Name: "service_name", Value: clickhousestore.TestDataServiceNameOne}}, got.Metrics[0].Labels)
+	assert.Equal(t, 1, len(got.Metrics[0].MetricPoints))
+	assert.Equal(t, endTime.Unix(), got.Metrics[0].MetricPoints[0].Timestamp.Seconds)
+	assert.Equal(t, 2.0, got.Metrics[0].MetricPoints[0].GetGaugeValue().GetDoubleValue())
+}
+
+func TestMetricsReader_GetErrorRates(t *testing.T) {
+	mockReader := clickhousestore.NewMockClickhouseReader(2)
+	reader := NewMetricsReader(mockReader, noop.Tracer{})
+
+	got, err := reader.GetErrorRates(context.Background(), &metricsstore.ErrorRateQueryParameters{
+		BaseQueryParameters: metricsstore.BaseQueryParameters{
+			ServiceNames:     []string{clickhousestore.TestDataServiceNameOne, clickhousestore.TestDataServiceNameTwo},
+			GroupByOperation: true,
+		},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "service_operation_error_rate", got.Name)
+	assert.Equal(t, 2, len(got.Metrics))
+	assert.Equal(t, []*metrics.Label{
+		{Name: "service_name", Value: clickhousestore.TestDataServiceNameTwo},
+		{Name: "operation", Value: clickhousestore.TestDataSpanNameOne},
+	}, got.Metrics[1].Labels)
+	assert.Equal(t, 0.1, got.Metrics[1].MetricPoints[0].GetGaugeValue().GetDoubleValue())
+}
+
+func TestMetricsReader_GetLatencies(t *testing.T) {
+	mockReader := clickhousestore.NewMockClickhouseReader(2)
+	reader := NewMetricsReader(mockReader, noop.Tracer{})
+
+	got, err := reader.GetLatencies(context.Background(), &metricsstore.LatenciesQueryParameters{
+		BaseQueryParameters: metricsstore.BaseQueryParameters{
+			ServiceNames: []string{clickhousestore.TestDataServiceNameOne},
+			SpanKinds:    []string{"SPAN_KIND_CLIENT"},
+		},
+		Quantile: 0.5,
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"SPAN_KIND_CLIENT"}, mockReader.MetricsCalls[0].SpanKinds)
+	assert.Equal(t, "service_latencies", got.Name)
+	assert.Equal(t, 5.0, got.Metrics[0].MetricPoints[0].GetGaugeValue().GetDoubleValue())
+
+	_, err = reader.GetLatencies(context.Background(), &metricsstore.LatenciesQueryParameters{
+		BaseQueryParameters: metricsstore.BaseQueryParameters{ServiceNames: []string{clickhousestore.TestDataServiceNameOne}},
+	})
+	assert.ErrorIs(t, err, ErrInvalidQuantile)
+}
+
+func TestMetricsQuery(t *testing.T) {
+	endTime := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	step := 100 * time.Millisecond
+	ratePer := 90 * time.Second
+	minuteStep := time.Minute
+
+	tests := []struct {
+		name   string
+		params metricsstore.BaseQueryParameters
+		step   time.Duration
+		window time.Duration
+	}{
+		{
+			name:   "defaults",
+			params: metricsstore.BaseQueryParameters{ServiceNames: []string{"svc"}, EndTime: &endTime},
+			step:   defaultMetricsStep,
+			window: defaultMetricsRatePer,
+		},
+		{
+			name:   "minStep",
+			params: metricsstore.BaseQueryParameters{ServiceNames: []string{"svc"}, EndTime: &endTime, Step: &step},
+			step:   minMetricsStep,
+			window: defaultMetricsRatePer,
+		},
+		{
+			name:   "windowInSteps",
+			params: metricsstore.BaseQueryParameters{ServiceNames: []string{"svc"}, EndTime: &endTime, Step: &minuteStep, RatePer: &ratePer},
+			step:   time.Minute,
+			window: 2 * time.Minute,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := metricsQuery(tt.params)
+			assert.NoError(t, err)
+			assert.Equal(t, endTime.Add(-defaultMetricsLookback), query.StartTime)
+			assert.Equal(t, tt.step, query.Step)
+			assert.Equal(t, tt.window, query.Window)
+		})
+	}
+
+	_, err := metricsQuery(metricsstore.BaseQueryParameters{})
+	assert.ErrorIs(t, err, ErrServiceNamesRequired)
+}
+
+func TestMetricsQueryServer(t *testing.T) {
+	server := NewMetricsQueryServer(NewMetricsReader(clickhousestore.NewMockClickhouseReader(2), noop.Tracer{}))
+	ctx := context.Background()
+
+	res, err := server.GetCallRates(ctx, &metrics.GetCallRatesRequest{
+		BaseRequest: &metrics.MetricsQueryBaseRequest{
+			ServiceNames: []string{clickhousestore.TestDataServiceNameOne},
+			SpanKinds:    []metrics.SpanKind{metrics.SpanKind_SPAN_KIND_SERVER},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "service_call_rate", res.Metrics.Name)
+
+	_, err = server.GetErrorRates(ctx, &metrics.GetErrorRatesRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	minStep, err := server.GetMinStepDuration(ctx, &metrics.GetMinStepDurationRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, minMetricsStep, minStep.MinStep)
+}
@@ -0,0 +1,251 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jaegertracing/jaeger/proto-gen/api_v2/metrics"
+	"github.com/jaegertracing/jaeger/storage/metricsstore"
+	"log/slog"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errUnsupportedQuery = errors.New("unsupported query")
+
+// Expressions of the PromQL queries the Prometheus metrics storage of Jaeger Query sends.
+// Each rate is summed by the service name, optionally by the operation label and, for
+// latencies, by the histogram bucket:
+//
+//	histogram_quantile(0.95, sum(rate(duration_bucket{service_name =~ "a|b", span_kind =~ "SPAN_KIND_SERVER"}[10m])) by (service_name,le))
+//	sum(rate(calls{service_name =~ "a|b", span_kind =~ "SPAN_KIND_SERVER"}[10m])) by (service_name)
+//	sum(rate(calls{service_name =~ "a|b", status_code = "STATUS_CODE_ERROR", span_kind =~ "SPAN_KIND_SERVER"}[10m])) by (service_name) / sum(rate(calls{service_name =~ "a|b", span_kind =~ "SPAN_KIND_SERVER"}[10m])) by (service_name)
+const promRateExpression = `sum\(rate\(\w+\{([^}]*)\}\[(\w+)\]\)\) by \(([\w,]*)\)`
+
+var (
+	promLatenciesRegexp = regexp.MustCompile(`^histogram_quantile\(([0-9.]+), ` + promRateExpression + `\)$`)
+	promCallRateRegexp  = regexp.MustCompile(`^` + promRateExpression + `$`)
+	promErrorRateRegexp = regexp.MustCompile(`^` + promRateExpression + ` / ` + promRateExpression + `$`)
+	promMatcherRegexp   = regexp.MustCompile(`(\w+) (=~|=) "([^"]*)"`)
+)
+
+// PrometheusAPI serves a metrics reader through the range query endpoint of the Prometheus
+// HTTP API, so that Jaeger Query can read the metrics of the "Monitor" tab from the backend
+// with its Prometheus metrics storage. Only the queries Jaeger Query sends are supported.
+type PrometheusAPI struct {
+	reader metricsstore.Reader
+	logger *slog.Logger
+}
+
+func NewPrometheusAPI(reader metricsstore.Reader) *PrometheusAPI {
+	return &PrometheusAPI{
+		reader: reader,
+		logger: slog.Default(),
+	}
+}
+
+// Handler returns the HTTP handler serving /api/v1/query_range.
+func (p *PrometheusAPI) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/query_range", p.queryRange)
+	return mux
+}
+
+// promQuery is a query of Jaeger Query converted into the parameters of the metrics reader
+type promQuery struct {
+	params         metricsstore.BaseQueryParameters
+	quantile       float64
+	errorRate      bool
+	operationLabel string
+}
+
+func (p *PrometheusAPI) queryRange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := parsePromQuery(r.FormValue("query"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	if err := parsePromRange(r, &query.params); err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+
+	var family *metrics.MetricFamily
+	switch {
+	case query.quantile > 0:
+		family, err = p.reader.GetLatencies(r.Context(), &metricsstore.LatenciesQueryParameters{
+			BaseQueryParameters: query.params,
+			Quantile:            query.quantile,
+		})
+	case query.errorRate:
+		family, err = p.reader.GetErrorRates(r.Context(), &metricsstore.ErrorRateQueryParameters{
+			BaseQueryParameters: query.params,
+		})
+	default:
+		family, err = p.reader.GetCallRates(r.Context(), &metricsstore.CallRateQueryParameters{
+			BaseQueryParameters: query.params,
+		})
+	}
+	if errors.Is(err, ErrServiceNamesRequired) || errors.Is(err, ErrInvalidQuantile) {
+		writePromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	if err != nil {
+		p.logger.ErrorContext(r.Context(), "unable to query metrics", "error", err)
+		writePromError(w, http.StatusUnprocessableEntity, "execution", err)
+		return
+	}
+
+	writePromMatrix(w, family, query.operationLabel)
+}
+
+// parsePromQuery parses a query of Jaeger Query, rejecting other queries
+func parsePromQuery(expression string) (promQuery, error) {
+	var query promQuery
+	var matchers, rate, groupBy string
+
+	if m := promLatenciesRegexp.FindStringSubmatch(expression); m != nil {
+		quantile, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			return promQuery{}, fmt.Errorf("%w: invalid quantile %q", errUnsupportedQuery, m[1])
+		}
+		query.quantile = quantile
+		matchers, rate, groupBy = m[2], m[3], m[4]
+	} else if m := promErrorRateRegexp.FindStringSubmatch(expression); m != nil {
+		// The denominator selects the same calls as the numerator without the status code
+		query.errorRate = true
+		matchers, rate, groupBy = m[4], m[5], m[6]
+	} else if m := promCallRateRegexp.FindStringSubmatch(expression); m != nil {
+		matchers, rate, groupBy = m[1], m[2], m[3]
+	} else {
+		return promQuery{}, fmt.Errorf("%w: %s", errUnsupportedQuery, expression)
+	}
+
+	for _, m := range promMatcherRegexp.FindAllStringSubmatch(matchers, -1) {
+		switch m[1] {
+		case "service_name":
+			query.params.ServiceNames = strings.Split(m[3], "|")
+		case "span_kind":
+			query.params.SpanKinds = strings.Split(m[3], "|")
+		default:
+			return promQuery{}, fmt.Errorf("%w: unsupported label %s", errUnsupportedQuery, m[1])
+		}
+	}
+
+	ratePer, err := time.ParseDuration(rate)
+	if err != nil {
+		return promQuery{}, fmt.Errorf("%w: invalid rate duration %q", errUnsupportedQuery, rate)
+	}
+	query.params.RatePer = &ratePer
+
+	// Any label besides the service name and the histogram bucket is the operation, which
+	// Jaeger Query names "span_name" or "operation" depending on its configuration
+	for _, label := range strings.Split(groupBy, ",") {
+		if label != "service_name" && label != "le" {
+			query.params.GroupByOperation = true
+			query.operationLabel = label
+		}
+	}
+
+	return query, nil
+}
+
+// parsePromRange sets the time range and step of a range query
+func parsePromRange(r *http.Request, params *metricsstore.BaseQueryParameters) error {
+	start, err := parsePromTime(r.FormValue("start"))
+	if err != nil {
+		return fmt.Errorf("invalid start: %w", err)
+	}
+	end, err := parsePromTime(r.FormValue("end"))
+	if err != nil {
+		return fmt.Errorf("invalid end: %w", err)
+	}
+	if end.Before(start) {
+		return errors.New("end is before start")
+	}
+	step, err := parsePromDuration(r.FormValue("step"))
+	if err != nil {
+		return fmt.Errorf("invalid step: %w", err)
+	}
+
+	lookback := end.Sub(start)
+	params.EndTime = &end
+	params.Lookback = &lookback
+	params.Step = &step
+	return nil
+}
+
+// parsePromTime parses a time as Unix seconds or RFC 3339, like Prometheus does
+func parsePromTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		whole, fraction := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(math.Round(fraction*1e9))).UTC(), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// parsePromDuration parses a duration as seconds or a duration string, like Prometheus does
+func parsePromDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(value)
+}
+
+// writePromMatrix writes the metrics as the matrix result of a range query, naming the
+// operation label as the query did
+func writePromMatrix(w http.ResponseWriter, family *metrics.MetricFamily, operationLabel string) {
+	type series struct {
+		Metric map[string]string `json:"metric"`
+		Values [][2]interface{}  `json:"values"`
+	}
+
+	result := make([]series, 0, len(family.Metrics))
+	for _, metric := range family.Metrics {
+		s := series{Metric: map[string]string{}, Values: [][2]interface{}{}}
+		for _, label := range metric.Labels {
+			name := label.Name
+			if name == "operation" && operationLabel != "" {
+				name = operationLabel
+			}
+			s.Metric[name] = label.Value
+		}
+		for _, point := range metric.MetricPoints {
+			timestamp := float64(point.Timestamp.Seconds) + float64(point.Timestamp.Nanos)/1e9
+			value := strconv.FormatFloat(point.GetGaugeValue().GetDoubleValue(), 'f', -1, 64)
+			s.Values = append(s.Values, [2]interface{}{timestamp, value})
+		}
+		result = append(result, s)
+	}
+
+	writePromResponse(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"resultType": "matrix",
+			"result":     result,
+		},
+	})
+}
+
+func writePromError(w http.ResponseWriter, code int, errorType string, err error) {
+	writePromResponse(w, code, map[string]interface{}{
+		"status":    "error",
+		"errorType": errorType,
+		"error":     err.Error(),
+	})
+}
+
+func writePromResponse(w http.ResponseWriter, code int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(response)
+}
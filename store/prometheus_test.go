@@ -0,0 +1,129 @@
+package store
+
+import (
+	"encoding/json"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/clickhousestore"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace/noop"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type promResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Data      struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			Values [][2]interface{}  `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+func TestPrometheusAPI(t *testing.T) {
+	endTime := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	one := clickhousestore.TestDataServiceNameOne
+	two := clickhousestore.TestDataServiceNameTwo
+
+	// Queries as built by the Prometheus metrics storage of Jaeger Query
+	tests := []struct {
+		name      string
+		query     string
+		groupBy   bool
+		spanKinds []string
+		labels    map[string]string
+		value     string
+	}{
+		{
+			name:      "latencies",
+			query:     `histogram_quantile(0.95, sum(rate(duration_bucket{service_name =~ "` + one + `", span_kind =~ "SPAN_KIND_SERVER"}[10m])) by (service_name,le))`,
+			spanKinds: []string{"SPAN_KIND_SERVER"},
+			labels:    map[string]string{"service_name": one},
+			value:     "9.5",
+		},
+		{
+			name:      "callRates",
+			query:     `sum(rate(calls{service_name =~ "` + one + `|` + two + `", span_kind =~ "SPAN_KIND_SERVER|SPAN_KIND_CLIENT"}[10m])) by (service_name,span_name)`,
+			groupBy:   true,
+			spanKinds: []string{"SPAN_KIND_SERVER", "SPAN_KIND_CLIENT"},
+			labels:    map[string]string{"service_name": one, "span_name": clickhousestore.TestDataSpanNameOne},
+			value:     "1",
+		},
+		{
+			name:   "errorRates",
+			query:  `sum(rate(calls{service_name =~ "` + one + `", status_code = "STATUS_CODE_ERROR", }[10m])) by (service_name) / sum(rate(calls{service_name =~ "` + one + `", }[10m])) by (service_name)`,
+			labels: map[string]string{"service_name": one},
+			value:  "0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockReader := clickhousestore.NewMockClickhouseReader(2)
+			api := NewPrometheusAPI(NewMetricsReader(mockReader, noop.Tracer{}))
+
+			form := url.Values{
+				"query": {tt.query},
+				"start": {"1711969200"},
+				"end":   {"1711972800"},
+				"step":  {"60"},
+			}
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/query_range", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			api.Handler().ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusOK, rec.Code)
+
+			var res promResponse
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+			assert.Equal(t, "success", res.Status)
+			assert.Equal(t, "matrix", res.Data.ResultType)
+			assert.Equal(t, tt.labels, res.Data.Result[0].Metric)
+			assert.Equal(t, []interface{}{float64(endTime.Unix()), tt.value}, res.Data.Result[0].Values[0][:])
+
+			query := mockReader.MetricsCalls[0]
+			assert.Equal(t, endTime.Add(-time.Hour), query.StartTime)
+			assert.Equal(t, endTime, query.EndTime)
+			assert.Equal(t, time.Minute, query.Step)
+			assert.Equal(t, 10*time.Minute, query.Window)
+			assert.Equal(t, tt.groupBy, query.GroupByOperation)
+			if tt.spanKinds != nil {
+				assert.Equal(t, tt.spanKinds, query.SpanKinds)
+			}
+		})
+	}
+}
+
+func TestPrometheusAPI_BadData(t *testing.T) {
+	api := NewPrometheusAPI(NewMetricsReader(clickhousestore.NewMockClickhouseReader(2), noop.Tracer{}))
+
+	tests := []struct {
+		name  string
+		query string
+		start string
+	}{
+		{name: "unsupportedQuery", query: `up`, start: "1711969200"},
+		{name: "unsupportedLabel", query: `sum(rate(calls{http_method = "GET"}[10m])) by (service_name)`, start: "1711969200"},
+		{name: "missingServiceNames", query: `sum(rate(calls{}[10m])) by (service_name)`, start: "1711969200"},
+		{name: "invalidStart", query: `sum(rate(calls{service_name =~ "svc"}[10m])) by (service_name)`, start: "yesterday"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := url.Values{"query": {tt.query}, "start": {tt.start}, "end": {"1711972800"}, "step": {"60"}}
+			rec := httptest.NewRecorder()
+			api.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query_range?"+params.Encode(), nil))
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+			var res promResponse
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+			assert.Equal(t, "error", res.Status)
+			assert.Equal(t, "bad_data", res.ErrorType)
+		})
+	}
+}
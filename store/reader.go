@@ -7,19 +7,44 @@ import (
 	"github.com/jaegertracing/jaeger/model"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
 	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/clickhousestore"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/tagquery"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
-	minTimespanForProgressiveSearch       = time.Hour
+	defaultNumTraces                      = 100
 	minTimespanForProgressiveSearchMargin = time.Minute
-	maxProgressiveSteps                   = 4
+)
+
+// Search tags control how a search is applied and are not matched against span attributes
+const (
+	searchTagDurationScope = "search.duration_scope"
+	searchTagMatchScope    = "search.match_scope"
+	searchTagMinSpans      = "search.min_spans"
+	searchTagMaxSpans      = "search.max_spans"
+
+	// Tags selecting the child spans of structural searches
+	searchTagChildService   = "search.child.service"
+	searchTagChildOperation = "search.child.operation"
+	searchTagChildPrefix    = "search.child."
 )
 
 var (
 	ErrStartTimeRequired = errors.New("start time is required for search queries")
+	ErrTimeRangeTooLarge = errors.New("time range is too large for search queries without a service name")
+	ErrInvalidSearchTag  = errors.New("invalid search tag")
+
+	// Structural searches match all conditions against the calling span, so child spans
+	// cannot be searched for with the trace match scope
+	errChildMatchTrace = fmt.Errorf("%w search.child.*: child spans require the span match scope", ErrInvalidSearchTag)
 )
 
 func (s *Store) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
@@ -31,7 +56,7 @@ func (s *Store) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Tra
 		s.logger.WarnContext(ctx, "no trace found", "traceId", traceID.String())
 		return nil, spanstore.ErrTraceNotFound
 	} else if err != nil {
-		return nil, err
+		return nil, statusError(err)
 	}
 
 	return s.convertClickhouseToJaegerTrace(ctx, trace)
@@ -41,7 +66,8 @@ func (s *Store) GetServices(ctx context.Context) ([]string, error) {
 	ctx, span := s.tracer.Start(ctx, "grpc:GetServices")
 	defer span.End()
 
-	return s.clickhousestore.GetServices(ctx)
+	services, err := s.clickhousestore.GetServices(ctx)
+	return services, statusError(err)
 }
 
 func (s *Store) GetOperations(ctx context.Context, query spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
@@ -50,7 +76,7 @@ func (s *Store) GetOperations(ctx context.Context, query spanstore.OperationQuer
 
 	names, err := s.clickhousestore.GetSpanNames(ctx, query.ServiceName)
 	if err != nil {
-		return nil, err
+		return nil, statusError(err)
 	}
 
 	operations := make([]spanstore.Operation, 0, len(names))
@@ -70,6 +96,13 @@ func (s *Store) FindTraces(ctx context.Context, query *spanstore.TraceQueryParam
 		return nil, err
 	}
 
+	return s.loadTraces(ctx, traceIDs)
+}
+
+// loadTraces reads and converts the traces of the given IDs, sorted by their start time.
+func (s *Store) loadTraces(ctx context.Context, traceIDs []model.TraceID) ([]*model.Trace, error) {
+	span := trace.SpanFromContext(ctx)
+
 	traceIDStrings := make([]string, 0, len(traceIDs))
 	for _, traceID := range traceIDs {
 		traceIDStrings = append(traceIDStrings, traceID.String())
@@ -80,6 +113,9 @@ func (s *Store) FindTraces(ctx context.Context, query *spanstore.TraceQueryParam
 		s.logger.ErrorContext(ctx, "unable to get traces from clickhousestore", "error", err)
 		span.SetStatus(codes.Error, "unable to get traces from clickhousestore")
 		span.RecordError(err)
+		if errors.Is(err, clickhousestore.ErrQueryLimitExceeded) {
+			return nil, statusError(err)
+		}
 	}
 
 	jaegerTraces := make([]*model.Trace, 0, len(traces))
@@ -91,6 +127,8 @@ func (s *Store) FindTraces(ctx context.Context, query *spanstore.TraceQueryParam
 		jaegerTraces = append(jaegerTraces, jaegerTrace)
 	}
 
+	sortTracesByStartTime(jaegerTraces)
+
 	return jaegerTraces, nil
 }
 
@@ -98,14 +136,68 @@ func (s *Store) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryPar
 	ctx, span := s.tracer.Start(ctx, "grpc:FindTraceIDs")
 	defer span.End()
 
-	searchOptions := clickhousestore.SearchOptions{
-		SpanName:    query.OperationName,
-		Attributes:  query.Tags,
-		MinDuration: query.DurationMin,
-		MaxDuration: query.DurationMax,
-		SearchLimit: query.NumTraces,
+	limit := query.NumTraces
+	if limit <= 0 {
+		limit = defaultNumTraces
+	}
+
+	searchOptions, err := s.searchOptions(query, limit)
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	traceIDs, err := s.findTraceIDs(ctx, query, searchOptions)
+	return traceIDs, statusError(err)
+}
+
+// FindTracesByRelation finds traces containing a span matching the query which directly
+// calls a span matching the child query, like traces where one service calls another.
+func (s *Store) FindTracesByRelation(ctx context.Context, query *spanstore.TraceQueryParameters, child SpanQuery) ([]*model.Trace, error) {
+	ctx, span := s.tracer.Start(ctx, "store:FindTracesByRelation")
+	defer span.End()
+
+	traceIDs, err := s.FindTraceIDsByRelation(ctx, query, child)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.loadTraces(ctx, traceIDs)
+}
+
+// FindTraceIDsByRelation finds the IDs of traces containing a span matching the query
+// which directly calls a span matching the child query.
+func (s *Store) FindTraceIDsByRelation(ctx context.Context, query *spanstore.TraceQueryParameters, child SpanQuery) ([]model.TraceID, error) {
+	ctx, span := s.tracer.Start(ctx, "store:FindTraceIDsByRelation")
+	defer span.End()
+
+	limit := query.NumTraces
+	if limit <= 0 {
+		limit = defaultNumTraces
 	}
 
+	searchOptions, err := s.searchOptions(query, limit)
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	if searchOptions.MatchTrace {
+		return nil, statusError(errChildMatchTrace)
+	}
+
+	searchOptions.Child = &clickhousestore.SpanFilter{
+		ServiceName: child.ServiceName,
+		SpanName:    child.OperationName,
+		Attributes:  child.Tags,
+	}
+
+	traceIDs, err := s.findTraceIDs(ctx, query, searchOptions)
+	return traceIDs, statusError(err)
+}
+
+func (s *Store) findTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters, searchOptions clickhousestore.SearchOptions) ([]model.TraceID, error) {
+	span := trace.SpanFromContext(ctx)
+	limit := searchOptions.SearchLimit
+
 	if query.StartTimeMin.IsZero() {
 		return nil, ErrStartTimeRequired
 	}
@@ -117,13 +209,31 @@ func (s *Store) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryPar
 
 	fullTimeSpan := end.Sub(query.StartTimeMin)
 
-	if fullTimeSpan < minTimespanForProgressiveSearch+minTimespanForProgressiveSearchMargin {
+	// Searches across all services scan the whole table within the time range
+	if query.ServiceName == "" && s.allServicesMaxRange > 0 && fullTimeSpan > s.allServicesMaxRange {
+		return nil, fmt.Errorf("%w: %s exceeds the maximum of %s", ErrTimeRangeTooLarge, fullTimeSpan, s.allServicesMaxRange)
+	}
+
+	steps := s.progressiveSearch.Steps
+
+	timeSpan := fullTimeSpan
+	for step := 0; step < steps; step++ {
+		timeSpan /= 2
+	}
+
+	if timeSpan < s.progressiveSearch.InitialWindow {
+		timeSpan = s.progressiveSearch.InitialWindow
+	}
+
+	// Short time ranges are searched at once, as are searches with trace filters, which
+	// would otherwise only aggregate the spans of a trace within the window of a step
+	if steps <= 1 || searchOptions.HasTraceFilters() || fullTimeSpan < s.progressiveSearch.InitialWindow+minTimespanForProgressiveSearchMargin {
 		traces, err := s.clickhousestore.SearchTraces(ctx, query.ServiceName, query.StartTimeMin, end, searchOptions)
 		if err != nil {
 			return nil, err
 		}
 
-		jaegerTraces := []model.TraceID{}
+		jaegerTraces := make([]model.TraceID, 0, len(traces))
 		for _, traceID := range traces {
 			jaegerTraceID, err := s.traceStringToID(ctx, traceID)
 			if err != nil {
@@ -131,49 +241,69 @@ func (s *Store) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryPar
 			}
 			jaegerTraces = append(jaegerTraces, jaegerTraceID)
 		}
-	}
 
-	timeSpan := fullTimeSpan
-	for step := 0; step < maxProgressiveSteps; step++ {
-		timeSpan /= 2
+		return jaegerTraces, nil
 	}
 
-	if timeSpan < minTimespanForProgressiveSearch {
-		timeSpan = minTimespanForProgressiveSearch
+	// The search stops early when its time budget or the deadline of the request would
+	// be exceeded, returning the traces found so far.
+	var deadline time.Time
+	if s.progressiveSearch.TimeBudget > 0 {
+		deadline = time.Now().Add(s.progressiveSearch.TimeBudget)
+	}
+	if ctxDeadline, ok := ctx.Deadline(); ok && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+		deadline = ctxDeadline
 	}
 
-	found := []model.TraceID{}
+	found := make([]model.TraceID, 0, limit)
+	seen := map[string]struct{}{}
+	var previousStepTraceIDs []string
+	var previousStepDuration time.Duration
 
-	for step := 0; step < maxProgressiveSteps; step++ {
-		if len(found) >= query.NumTraces {
+	for step := 0; step < steps && len(found) < limit; step++ {
+		// Assume the next step takes at least as long as the previous, smaller one
+		if !deadline.IsZero() && time.Until(deadline) < previousStepDuration {
+			s.logger.WarnContext(ctx, "search time budget exhausted, returning partial results", "step", step, "found", len(found))
+			span.SetAttributes(attribute.Int("skipped-steps", steps-step))
 			break
 		}
 
-		// last step has to take care of the whole remainder
-		if step == maxProgressiveSteps-1 {
-			timeSpan = fullTimeSpan
-		}
-
 		start := end.Add(-timeSpan)
-		if start.Before(query.StartTimeMin) {
+
+		// last step has to take care of the whole remainder
+		if step == steps-1 || start.Before(query.StartTimeMin) {
 			start = query.StartTimeMin
 		}
 
-		if start.After(end) {
+		if !start.Before(end) {
 			break
 		}
 
-		// Add trace IDs
-		for _, trace := range found {
-			searchOptions.IgnoredTraceIDs = append(searchOptions.IgnoredTraceIDs, trace.String())
-		}
+		// Traces found in the previous, adjacent time range are the ones most likely to
+		// have spans in this range as well. Excluding only those keeps the list of ignored
+		// trace IDs bounded by the limit, while any other duplicates are skipped below. As
+		// every other trace found before may be returned again, the step searches for as
+		// many more traces, so that duplicates do not count toward the limit.
+		searchOptions.IgnoredTraceIDs = previousStepTraceIDs
+		searchOptions.SearchLimit = limit - len(found) + len(seen) - len(previousStepTraceIDs)
 
+		stepStart := time.Now()
 		foundInRange, err := s.clickhousestore.SearchTraces(ctx, query.ServiceName, start, end, searchOptions)
 		if err != nil {
 			return nil, err
 		}
+		previousStepDuration = time.Since(stepStart)
+		previousStepTraceIDs = foundInRange
 
 		for _, traceID := range foundInRange {
+			if len(found) >= limit {
+				break
+			}
+			if _, ok := seen[traceID]; ok {
+				continue
+			}
+			seen[traceID] = struct{}{}
+
 			jaegerTraceID, err := s.traceStringToID(ctx, traceID)
 			if err != nil {
 				return nil, err
@@ -188,11 +318,138 @@ func (s *Store) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryPar
 	return found, nil
 }
 
+// searchOptions converts the query into search options, applying the duration filters to
+// spans or traces depending on the duration scope.
+func (s *Store) searchOptions(query *spanstore.TraceQueryParameters, limit int) (clickhousestore.SearchOptions, error) {
+	searchOptions := clickhousestore.SearchOptions{
+		SpanName:    query.OperationName,
+		Attributes:  make(map[string]string, len(query.Tags)),
+		SearchLimit: limit,
+	}
+
+	durationScope := s.durationScope
+	matchScope := s.matchScope
+
+	child := func() *clickhousestore.SpanFilter {
+		if searchOptions.Child == nil {
+			searchOptions.Child = &clickhousestore.SpanFilter{Attributes: map[string]string{}}
+		}
+		return searchOptions.Child
+	}
+
+	for key, value := range query.Tags {
+		var err error
+		switch key {
+		case searchTagDurationScope:
+			durationScope, err = ParseScope(value)
+		case searchTagMatchScope:
+			matchScope, err = ParseScope(value)
+		case searchTagMinSpans:
+			searchOptions.MinSpanCount, err = strconv.Atoi(value)
+		case searchTagMaxSpans:
+			searchOptions.MaxSpanCount, err = strconv.Atoi(value)
+		case searchTagChildService:
+			child().ServiceName = value
+		case searchTagChildOperation:
+			child().SpanName = value
+		default:
+			if childKey, ok := childTagKey(key); ok {
+				child().Attributes[childKey] = value
+			} else {
+				searchOptions.Attributes[key] = value
+			}
+		}
+		if err != nil {
+			return searchOptions, fmt.Errorf("%w %s: %w", ErrInvalidSearchTag, key, err)
+		}
+	}
+
+	searchOptions.MatchTrace = matchScope == ScopeTrace
+	if searchOptions.MatchTrace && searchOptions.Child != nil {
+		return searchOptions, errChildMatchTrace
+	}
+
+	if durationScope == ScopeTrace {
+		searchOptions.MinTraceDuration = query.DurationMin
+		searchOptions.MaxTraceDuration = query.DurationMax
+	} else {
+		searchOptions.MinDuration = query.DurationMin
+		searchOptions.MaxDuration = query.DurationMax
+	}
+
+	return searchOptions, nil
+}
+
+// childTagKey returns the key of a tag applying to child spans without its prefix, keeping
+// a leading '!' of negated tags.
+func childTagKey(key string) (string, bool) {
+	negation := ""
+	if strings.HasPrefix(key, "!") {
+		negation = "!"
+		key = key[1:]
+	}
+
+	if !strings.HasPrefix(key, searchTagChildPrefix) {
+		return "", false
+	}
+	return negation + strings.TrimPrefix(key, searchTagChildPrefix), true
+}
+
 func (s *Store) GetDependencies(ctx context.Context, endTime time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
 	ctx, span := s.tracer.Start(ctx, "grpc:GetDependencies")
 	defer span.End()
 
-	return nil, nil
+	links, err := s.clickhousestore.GetDependencies(ctx, endTime.Add(-lookback), endTime)
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	dependencies := make([]model.DependencyLink, 0, len(links))
+	for _, link := range links {
+		dependencies = append(dependencies, model.DependencyLink{
+			Parent:    link.Parent,
+			Child:     link.Child,
+			CallCount: link.CallCount,
+		})
+	}
+
+	return dependencies, nil
+}
+
+// statusError converts errors of queries exceeding their limits into a ResourceExhausted
+// status, searches over too large a time range or with invalid search tags or tag queries
+// into an InvalidArgument status and traces missing from the spans table into a NotFound
+// status, which Jaeger reports to the user rather than as an unknown error.
+func statusError(err error) error {
+	if errors.Is(err, clickhousestore.ErrQueryLimitExceeded) {
+		return status.Error(grpccodes.ResourceExhausted, err.Error())
+	}
+	if errors.Is(err, ErrTimeRangeTooLarge) || errors.Is(err, ErrInvalidSearchTag) || errors.Is(err, tagquery.ErrSyntax) {
+		return status.Error(grpccodes.InvalidArgument, err.Error())
+	}
+	if errors.Is(err, clickhousestore.ErrNotFound) {
+		return status.Error(grpccodes.NotFound, err.Error())
+	}
+	return err
+}
+
+// sortTracesByStartTime sorts traces by the start of their earliest span, most recent
+// first. Traces starting at the same time keep the order they were found in.
+func sortTracesByStartTime(traces []*model.Trace) {
+	startTimes := make(map[*model.Trace]time.Time, len(traces))
+	for _, t := range traces {
+		var start time.Time
+		for _, sp := range t.Spans {
+			if start.IsZero() || sp.StartTime.Before(start) {
+				start = sp.StartTime
+			}
+		}
+		startTimes[t] = start
+	}
+
+	sort.SliceStable(traces, func(i, j int) bool {
+		return startTimes[traces[i]].After(startTimes[traces[j]])
+	})
 }
 
 func (s *Store) traceStringToID(ctx context.Context, traceIDString string) (model.TraceID, error) {
@@ -211,6 +468,36 @@ func (s *Store) traceStringToID(ctx context.Context, traceIDString string) (mode
 	return traceID, nil
 }
 
+// mergeSharedSpanReferences returns the references of the server half of a span shared by
+// a Zipkin client and server, which are the parent references of the client half followed
+// by the links of both halves.
+func mergeSharedSpanReferences(client []model.SpanRef, server []model.SpanRef) []model.SpanRef {
+	references := make([]model.SpanRef, 0, len(client)+len(server))
+	for _, ref := range client {
+		if ref.RefType == model.SpanRefType_CHILD_OF {
+			references = append(references, ref)
+		}
+	}
+
+	for _, ref := range append(append([]model.SpanRef{}, client...), server...) {
+		if ref.RefType != model.SpanRefType_FOLLOWS_FROM {
+			continue
+		}
+		duplicate := false
+		for _, existing := range references {
+			if existing.TraceID == ref.TraceID && existing.SpanID == ref.SpanID && existing.RefType == ref.RefType {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			references = append(references, ref)
+		}
+	}
+
+	return references
+}
+
 func (s *Store) convertClickhouseToJaegerTrace(ctx context.Context, chTrace *clickhousestore.ClickhouseOtelTrace) (*model.Trace, error) {
 	ctx, span := s.tracer.Start(ctx, "store:convertClickhouseToJaegerTrace")
 	span.SetAttributes(attribute.String("trace-id", chTrace.TraceID))
@@ -226,6 +513,8 @@ func (s *Store) convertClickhouseToJaegerTrace(ctx context.Context, chTrace *cli
 		return nil, err
 	}
 
+	processes := newProcessTable()
+
 	for _, sp := range chTrace.Spans {
 
 		spanID, err := model.SpanIDFromString(sp.SpanID)
@@ -262,67 +551,82 @@ func (s *Store) convertClickhouseToJaegerTrace(ctx context.Context, chTrace *cli
 			}
 		}
 
+		// Links are represented as FOLLOWS_FROM references, which may point to spans
+		// in other traces. Links with IDs that cannot be parsed are skipped so that a
+		// single malformed link does not prevent the trace from being displayed.
+		for idx, linkTraceIDString := range sp.LinksTraceID {
+			if idx >= len(sp.LinksSpanID) {
+				break
+			}
+
+			linkTraceID, err := model.TraceIDFromString(linkTraceIDString)
+			if err != nil {
+				s.logger.WarnContext(ctx, "unable to normalize link trace id", "error", err)
+				continue
+			}
+
+			linkSpanID, err := model.SpanIDFromString(sp.LinksSpanID[idx])
+			if err != nil {
+				s.logger.WarnContext(ctx, "unable to normalize link span id", "error", err)
+				continue
+			}
+
+			newSpan.References = append(newSpan.References, model.SpanRef{
+				TraceID: linkTraceID,
+				SpanID:  linkSpanID,
+				RefType: model.SpanRefType_FOLLOWS_FROM,
+			})
+		}
+
 		// Deduplicate spans caused by a Zipkin behavior where a server span extends a client span
 		// by using the same span ID instead of creating a new span ID. Zipkin would resolve this
 		// duplication by combining the two spans, while favoring some details in the server span
 		// but treating it as a special extension. The ultimate result would be a single span in
 		// the Zipkin UI, even though the duplicate spans are still recorded in the datastore.
 		// The following workaround tries to mimic the Zipkin behavior for old instrumentations.
+		isSharedClientSpan := false
 		for i, recordedSpan := range jaegerTrace.Spans {
-			if recordedSpan.SpanID == spanID && sp.SpanKind == "SPAN_KIND_SERVER" {
+			if recordedSpan.SpanID == spanID && convertSpanKind(sp.SpanKind) == "server" {
 				// If the span of the current loop is a duplicate and it's the server span, take the
 				// parent span references from the client. These references are unavailable in the server
-				// span otherwise. Finally, delete the client span.
-				newSpan.References = recordedSpan.References
+				// span otherwise. Links of both spans are kept. Finally, delete the client span.
+				newSpan.References = mergeSharedSpanReferences(recordedSpan.References, newSpan.References)
 				jaegerTrace.Spans = append(jaegerTrace.Spans[:i], jaegerTrace.Spans[i+1:]...)
-			} else if recordedSpan.SpanID == spanID && sp.SpanKind == "SPAN_KIND_CLIENT" {
+				break
+			} else if recordedSpan.SpanID == spanID && convertSpanKind(sp.SpanKind) == "client" {
 				// If the span of the current loop is a duplicate and a client span, update the already
 				// recorded server span with the parent span references to ensure proper hierarchy.
-				// Finally, ignore the current client span altogether.
-				jaegerTrace.Spans[i].References = newSpan.References
-				continue
+				// Links of both spans are kept. Finally, ignore the current client span altogether.
+				jaegerTrace.Spans[i].References = mergeSharedSpanReferences(newSpan.References, recordedSpan.References)
+				isSharedClientSpan = true
+				break
 			}
 		}
-
-		if len(sp.SpanAttributes) > 0 {
-			tags := make([]model.KeyValue, 0, len(sp.SpanAttributes))
-			for key, value := range sp.SpanAttributes {
-				tags = append(tags, model.String(key, value))
-			}
-			if sp.StatusCode == "STATUS_CODE_ERROR" {
-				tags = append(tags, model.Bool("error", true))
-			}
-			newSpan.Tags = tags
+		if isSharedClientSpan {
+			continue
 		}
 
-		if len(sp.EventsName) > 0 {
-			logs := make([]model.Log, 0, len(sp.EventsName))
-			for idx, value := range sp.EventsName {
-				log := model.Log{}
-				log.Timestamp = sp.EventsTimestamp[idx]
-				log.Fields = make([]model.KeyValue, 0, len(sp.EventsAttributes)+1)
-				log.Fields = append(log.Fields, model.String("event", value))
-				for i := range sp.EventsAttributes {
-					for k, v := range sp.EventsAttributes[i] {
-						log.Fields = append(log.Fields, model.String(k, v))
-					}
-				}
-				logs = append(logs, log)
-			}
-			newSpan.Logs = logs
+		newSpan.Tags = convertSpanTags(&sp, s.attributeTypes)
+
+		if eventsAreMalformed(sp.EventsTimestamp, sp.EventsName, sp.EventsAttributes) {
+			s.logger.WarnContext(ctx, "span events have mismatched lengths", "spanId", sp.SpanID)
 		}
+		newSpan.Logs = convertEventsToLogs(sp.EventsTimestamp, sp.EventsName, sp.EventsAttributes, s.attributeTypes)
 
-		if len(sp.ResourceAttributes) > 0 {
-			process := &model.Process{ServiceName: sp.ServiceName}
-			process.Tags = make([]model.KeyValue, 0, len(sp.ResourceAttributes))
-			for key, value := range sp.ResourceAttributes {
-				process.Tags = append(process.Tags, model.String(key, value))
-			}
-			newSpan.Process = process
+		processID, process, err := processes.add(convertProcess(&sp, s.attributeTypes))
+		if err != nil {
+			s.logger.ErrorContext(ctx, "unable to hash process", "error", err)
+			span.SetStatus(codes.Error, fmt.Sprintf("unable to hash process of span %s", sp.SpanID))
+			span.RecordError(err)
+			return nil, err
 		}
+		newSpan.ProcessID = processID
+		newSpan.Process = process
 
 		jaegerTrace.Spans = append(jaegerTrace.Spans, newSpan)
 	}
 
+	jaegerTrace.ProcessMap = processes.mappings
+
 	return jaegerTrace, nil
 }
@@ -2,11 +2,16 @@ package store
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/jaegertracing/jaeger/model"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
 	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/clickhousestore"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/tagquery"
 	"github.com/stretchr/testify/assert"
 	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"testing"
 	"time"
 )
@@ -15,7 +20,7 @@ func TestStore_GetTrace(t *testing.T) {
 	mockReader := clickhousestore.NewMockClickhouseReader(2)
 	tracer := noop.Tracer{}
 
-	store := New(mockReader, tracer)
+	store := New(mockReader, clickhousestore.NewMockClickhouseWriter(), tracer)
 	ctx := context.Background()
 
 	traceIDOne, _ := model.TraceIDFromString(clickhousestore.TestDataTraceIDOne)
@@ -30,7 +35,7 @@ func TestStore_GetTrace(t *testing.T) {
 	assert.Equal(t, traceIDOne, got.Spans[0].TraceID)
 	assert.Equal(t, clickhousestore.TestDataSpanNameOne, got.Spans[0].OperationName)
 	assert.Equal(t, time.Duration(3600), got.Spans[0].Duration)
-	assert.Equal(t, 2, len(got.Spans[0].Tags))
+	assert.Equal(t, 4, len(got.Spans[0].Tags))
 	assert.Contains(t, got.Spans[0].Tags[0].Key, "attr")
 	assert.Contains(t, got.Spans[0].Tags[0].Value(), "value")
 	assert.Contains(t, got.Spans[0].Tags[1].Key, "attr")
@@ -38,14 +43,17 @@ func TestStore_GetTrace(t *testing.T) {
 	assert.Equal(t, traceIDOne, got.Spans[1].TraceID)
 	assert.Equal(t, clickhousestore.TestDataSpanNameTwo, got.Spans[1].OperationName)
 	assert.Equal(t, time.Duration(3600), got.Spans[1].Duration)
-	assert.Equal(t, 0, len(got.Spans[1].Tags))
+	assert.Equal(t, []model.KeyValue{
+		model.String("span.kind", "client"),
+		model.String("otel.scope.name", clickhousestore.TestDataServiceNameOne),
+	}, got.Spans[1].Tags)
 }
 
 func TestStore_GetServices(t *testing.T) {
 	mockReader := clickhousestore.NewMockClickhouseReader(2)
 	tracer := noop.Tracer{}
 
-	store := New(mockReader, tracer)
+	store := New(mockReader, clickhousestore.NewMockClickhouseWriter(), tracer)
 	ctx := context.Background()
 
 	got, err := store.GetServices(ctx)
@@ -63,7 +71,7 @@ func TestStore_GetOperations(t *testing.T) {
 	mockReader := clickhousestore.NewMockClickhouseReader(2)
 	tracer := noop.Tracer{}
 
-	store := New(mockReader, tracer)
+	store := New(mockReader, clickhousestore.NewMockClickhouseWriter(), tracer)
 	ctx := context.Background()
 
 	query := spanstore.OperationQueryParameters{
@@ -86,7 +94,7 @@ func TestStore_GetFindTraces(t *testing.T) {
 	mockReader := clickhousestore.NewMockClickhouseReader(1)
 	tracer := noop.Tracer{}
 
-	store := New(mockReader, tracer)
+	store := New(mockReader, clickhousestore.NewMockClickhouseWriter(), tracer)
 	ctx := context.Background()
 
 	query := &spanstore.TraceQueryParameters{
@@ -108,9 +116,637 @@ func TestStore_GetFindTraces(t *testing.T) {
 	assert.Equal(t, traceIDOne, got[0].Spans[0].TraceID)
 	assert.Equal(t, clickhousestore.TestDataSpanNameOne, got[0].Spans[0].OperationName)
 	assert.Equal(t, time.Duration(3600), got[0].Spans[0].Duration)
-	assert.Equal(t, 2, len(got[0].Spans[0].Tags))
+	assert.Equal(t, 4, len(got[0].Spans[0].Tags))
 	assert.Contains(t, got[0].Spans[0].Tags[0].Key, "attr")
 	assert.Contains(t, got[0].Spans[0].Tags[0].Value(), "value")
 	assert.Contains(t, got[0].Spans[0].Tags[1].Key, "attr")
 	assert.Contains(t, got[0].Spans[0].Tags[1].Value(), "value")
 }
+
+func TestStore_FindTraceIDs_shortRange(t *testing.T) {
+	mockReader := clickhousestore.NewMockClickhouseReader(2)
+	tracer := noop.Tracer{}
+
+	store := New(mockReader, clickhousestore.NewMockClickhouseWriter(), tracer)
+	ctx := context.Background()
+
+	end := time.Now()
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:  clickhousestore.TestDataServiceNameOne,
+		StartTimeMin: end.Add(-30 * time.Minute),
+		StartTimeMax: end,
+	}
+
+	got, err := store.FindTraceIDs(ctx, query)
+	if err != nil {
+		t.Errorf("Store.FindTraceIDs() error = %v", err)
+		return
+	}
+
+	assert.Equal(t, 2, len(got))
+	assert.Equal(t, 1, len(mockReader.SearchCalls))
+	assert.Equal(t, query.StartTimeMin, mockReader.SearchCalls[0].StartTime)
+	assert.Equal(t, end, mockReader.SearchCalls[0].EndTime)
+	assert.Equal(t, defaultNumTraces, mockReader.SearchCalls[0].Options.SearchLimit)
+}
+
+func TestStore_FindTraceIDs_progressive(t *testing.T) {
+	mockReader := clickhousestore.NewMockClickhouseReader(2)
+	tracer := noop.Tracer{}
+
+	store := New(mockReader, clickhousestore.NewMockClickhouseWriter(), tracer)
+	ctx := context.Background()
+
+	end := time.Now()
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:  clickhousestore.TestDataServiceNameOne,
+		StartTimeMin: end.AddDate(0, 0, -7),
+		StartTimeMax: end,
+		NumTraces:    10,
+	}
+
+	got, err := store.FindTraceIDs(ctx, query)
+	if err != nil {
+		t.Errorf("Store.FindTraceIDs() error = %v", err)
+		return
+	}
+
+	// the mock returns the same traces for every time range
+	assert.Equal(t, 2, len(got))
+	assert.Equal(t, defaultProgressiveSearchSteps, len(mockReader.SearchCalls))
+
+	// windows are adjacent, grow towards the past and cover the whole range
+	assert.Equal(t, end, mockReader.SearchCalls[0].EndTime)
+	assert.Equal(t, 10, mockReader.SearchCalls[0].Options.SearchLimit)
+	assert.Equal(t, query.StartTimeMin, mockReader.SearchCalls[len(mockReader.SearchCalls)-1].StartTime)
+	for i := 1; i < len(mockReader.SearchCalls); i++ {
+		previous, current := mockReader.SearchCalls[i-1], mockReader.SearchCalls[i]
+		assert.Equal(t, previous.StartTime, current.EndTime)
+		assert.True(t, current.EndTime.Sub(current.StartTime) >= previous.EndTime.Sub(previous.StartTime))
+		assert.Equal(t, 8, current.Options.SearchLimit)
+		assert.Equal(t, 2, len(current.Options.IgnoredTraceIDs))
+	}
+}
+
+func TestStore_FindTraceIDs_progressiveDuplicates(t *testing.T) {
+	traceIDs := []string{
+		"10000000000000000000000000000001",
+		"10000000000000000000000000000002",
+		"10000000000000000000000000000003",
+		"10000000000000000000000000000004",
+		"10000000000000000000000000000005",
+	}
+
+	// The first trace has spans in the first and last step, which are not adjacent
+	mockReader := clickhousestore.NewMockClickhouseReader(2)
+	mockReader.SearchResults = [][]string{
+		{traceIDs[0], traceIDs[1]},
+		{traceIDs[2]},
+		{traceIDs[0], traceIDs[3], traceIDs[4]},
+	}
+	tracer := noop.Tracer{}
+
+	store := New(mockReader, clickhousestore.NewMockClickhouseWriter(), tracer, WithProgressiveSearch(ProgressiveSearch{Steps: 3, InitialWindow: time.Hour}))
+	ctx := context.Background()
+
+	end := time.Now()
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:  clickhousestore.TestDataServiceNameOne,
+		StartTimeMin: end.AddDate(0, 0, -7),
+		StartTimeMax: end,
+		NumTraces:    4,
+	}
+
+	got, err := store.FindTraceIDs(ctx, query)
+	if err != nil {
+		t.Errorf("Store.FindTraceIDs() error = %v", err)
+		return
+	}
+
+	// the duplicate does not count toward the limit
+	gotStrings := make([]string, 0, len(got))
+	for _, traceID := range got {
+		gotStrings = append(gotStrings, traceID.String())
+	}
+	assert.Equal(t, traceIDs[:4], gotStrings)
+	assert.Equal(t, 3, len(mockReader.SearchCalls))
+	assert.Equal(t, 3, mockReader.SearchCalls[2].Options.SearchLimit)
+}
+
+func TestStore_FindTraceIDs_progressiveLimit(t *testing.T) {
+	mockReader := clickhousestore.NewMockClickhouseReader(2)
+	tracer := noop.Tracer{}
+
+	store := New(mockReader, clickhousestore.NewMockClickhouseWriter(), tracer)
+	ctx := context.Background()
+
+	end := time.Now()
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:  clickhousestore.TestDataServiceNameOne,
+		StartTimeMin: end.AddDate(0, 0, -7),
+		StartTimeMax: end,
+		NumTraces:    2,
+	}
+
+	got, err := store.FindTraceIDs(ctx, query)
+	if err != nil {
+		t.Errorf("Store.FindTraceIDs() error = %v", err)
+		return
+	}
+
+	assert.Equal(t, 2, len(got))
+	assert.Equal(t, 1, len(mockReader.SearchCalls))
+}
+
+func TestStore_FindTraceIDs_progressiveTraceFilters(t *testing.T) {
+	mockReader := clickhousestore.NewMockClickhouseReader(2)
+	tracer := noop.Tracer{}
+
+	store := New(mockReader, clickhousestore.NewMockClickhouseWriter(), tracer)
+	ctx := context.Background()
+
+	end := time.Now()
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:  clickhousestore.TestDataServiceNameOne,
+		Tags:         map[string]string{"search.min_spans": "5"},
+		StartTimeMin: end.AddDate(0, 0, -7),
+		StartTimeMax: end,
+		NumTraces:    10,
+	}
+
+	_, err := store.FindTraceIDs(ctx, query)
+	if err != nil {
+		t.Errorf("Store.FindTraceIDs() error = %v", err)
+		return
+	}
+
+	// trace filters count the spans of a trace within the whole time range
+	assert.Equal(t, 1, len(mockReader.SearchCalls))
+	assert.Equal(t, query.StartTimeMin, mockReader.SearchCalls[0].StartTime)
+	assert.Equal(t, end, mockReader.SearchCalls[0].EndTime)
+	assert.Equal(t, 5, mockReader.SearchCalls[0].Options.MinSpanCount)
+}
+
+func TestStore_FindTraceIDs_disabled(t *testing.T) {
+	mockReader := clickhousestore.NewMockClickhouseReader(2)
+	tracer := noop.Tracer{}
+
+	store := New(mockReader, clickhousestore.NewMockClickhouseWriter(), tracer, WithProgressiveSearch(ProgressiveSearch{Steps: 1}))
+	ctx := context.Background()
+
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:  clickhousestore.TestDataServiceNameOne,
+		StartTimeMin: time.Now().AddDate(0, 0, -7),
+	}
+
+	got, err := store.FindTraceIDs(ctx, query)
+	if err != nil {
+		t.Errorf("Store.FindTraceIDs() error = %v", err)
+		return
+	}
+
+	assert.Equal(t, 2, len(got))
+	assert.Equal(t, 1, len(mockReader.SearchCalls))
+	assert.Equal(t, query.StartTimeMin, mockReader.SearchCalls[0].StartTime)
+}
+
+func TestStore_FindTraceIDs_allServices(t *testing.T) {
+	mockReader := clickhousestore.NewMockClickhouseReader(2)
+	tracer := noop.Tracer{}
+
+	store := New(mockReader, clickhousestore.NewMockClickhouseWriter(), tracer)
+	ctx := context.Background()
+
+	query := &spanstore.TraceQueryParameters{
+		Tags:         map[string]string{"http.url": "http://example.com"},
+		StartTimeMin: time.Now().Add(-30 * time.Minute),
+	}
+
+	got, err := store.FindTraceIDs(ctx, query)
+	if err != nil {
+		t.Errorf("Store.FindTraceIDs() error = %v", err)
+		return
+	}
+
+	assert.Equal(t, 2, len(got))
+	assert.Equal(t, 1, len(mockReader.SearchCalls))
+}
+
+func TestStore_FindTraceIDs_allServicesMaxRange(t *testing.T) {
+	mockReader := clickhousestore.NewMockClickhouseReader(2)
+	tracer := noop.Tracer{}
+
+	store := New(mockReader, clickhousestore.NewMockClickhouseWriter(), tracer, WithAllServicesMaxRange(time.Hour))
+	ctx := context.Background()
+
+	query := &spanstore.TraceQueryParameters{
+		StartTimeMin: time.Now().AddDate(0, 0, -7),
+	}
+
+	_, err := store.FindTraceIDs(ctx, query)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.ErrorContains(t, err, ErrTimeRangeTooLarge.Error())
+	assert.Equal(t, 0, len(mockReader.SearchCalls))
+
+	// a zero range disables the limit
+	unlimited := New(mockReader, clickhousestore.NewMockClickhouseWriter(), tracer, WithAllServicesMaxRange(0))
+	_, err = unlimited.FindTraceIDs(ctx, query)
+	assert.NoError(t, err)
+
+	// the limit does not apply to searches of a single service
+	query.ServiceName = clickhousestore.TestDataServiceNameOne
+	_, err = store.FindTraceIDs(ctx, query)
+	assert.NoError(t, err)
+}
+
+func TestStore_FindTraces_limitExceeded(t *testing.T) {
+	mockReader := clickhousestore.NewMockClickhouseReader(2)
+	mockReader.SearchError = fmt.Errorf("%w: limit for rows to read exceeded", clickhousestore.ErrQueryLimitExceeded)
+	tracer := noop.Tracer{}
+
+	store := New(mockReader, clickhousestore.NewMockClickhouseWriter(), tracer)
+	ctx := context.Background()
+
+	end := time.Now()
+	_, err := store.FindTraces(ctx, &spanstore.TraceQueryParameters{
+		ServiceName:  clickhousestore.TestDataServiceNameOne,
+		StartTimeMin: end.Add(-30 * time.Minute),
+		StartTimeMax: end,
+	})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Contains(t, err.Error(), "limit for rows to read exceeded")
+}
+
+func TestStore_searchOptions(t *testing.T) {
+	tests := []struct {
+		name          string
+		durationScope Scope
+		matchScope    Scope
+		tags          map[string]string
+		want          clickhousestore.SearchOptions
+		wantErr       bool
+	}{
+		{
+			name: "span durations",
+			tags: map[string]string{"http.method": "GET"},
+			want: clickhousestore.SearchOptions{
+				Attributes:  map[string]string{"http.method": "GET"},
+				MinDuration: time.Second,
+				MaxDuration: time.Minute,
+			},
+		},
+		{
+			name:          "trace durations by default",
+			durationScope: ScopeTrace,
+			want: clickhousestore.SearchOptions{
+				Attributes:       map[string]string{},
+				MinTraceDuration: time.Second,
+				MaxTraceDuration: time.Minute,
+			},
+		},
+		{
+			name: "trace durations and span counts by tags",
+			tags: map[string]string{"search.duration_scope": "trace", "search.min_spans": "5", "search.max_spans": "50"},
+			want: clickhousestore.SearchOptions{
+				Attributes:       map[string]string{},
+				MinTraceDuration: time.Second,
+				MaxTraceDuration: time.Minute,
+				MinSpanCount:     5,
+				MaxSpanCount:     50,
+			},
+		},
+		{
+			name:          "span durations by tag",
+			durationScope: ScopeTrace,
+			tags:          map[string]string{"search.duration_scope": "span"},
+			want: clickhousestore.SearchOptions{
+				Attributes:  map[string]string{},
+				MinDuration: time.Second,
+				MaxDuration: time.Minute,
+			},
+		},
+		{
+			name: "child tags",
+			tags: map[string]string{
+				"http.method":            "POST",
+				"search.child.service":   "payments",
+				"search.child.operation": "charge",
+				"search.child.error":     "true",
+				"!search.child.retry":    "",
+			},
+			want: clickhousestore.SearchOptions{
+				Attributes:  map[string]string{"http.method": "POST"},
+				MinDuration: time.Second,
+				MaxDuration: time.Minute,
+				Child: &clickhousestore.SpanFilter{
+					ServiceName: "payments",
+					SpanName:    "charge",
+					Attributes:  map[string]string{"error": "true", "!retry": ""},
+				},
+			},
+		},
+		{
+			name: "trace match scope by tag",
+			tags: map[string]string{"search.match_scope": "trace", "db.system": "postgresql"},
+			want: clickhousestore.SearchOptions{
+				Attributes:  map[string]string{"db.system": "postgresql"},
+				MinDuration: time.Second,
+				MaxDuration: time.Minute,
+				MatchTrace:  true,
+			},
+		},
+		{
+			name:    "child tags with trace match scope by tag",
+			tags:    map[string]string{"search.match_scope": "trace", "search.child.service": "payments"},
+			wantErr: true,
+		},
+		{
+			name:       "child tags with trace match scope by default",
+			matchScope: ScopeTrace,
+			tags:       map[string]string{"search.child.error": "true"},
+			wantErr:    true,
+		},
+		{
+			name:    "invalid match scope",
+			tags:    map[string]string{"search.match_scope": "resource"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid duration scope",
+			tags:    map[string]string{"search.duration_scope": "service"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid span count",
+			tags:    map[string]string{"search.min_spans": "many"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := []Option{}
+			if tt.durationScope != "" {
+				options = append(options, WithDurationScope(tt.durationScope))
+			}
+			if tt.matchScope != "" {
+				options = append(options, WithMatchScope(tt.matchScope))
+			}
+			store := New(clickhousestore.NewMockClickhouseReader(0), clickhousestore.NewMockClickhouseWriter(), noop.Tracer{}, options...)
+
+			got, err := store.searchOptions(&spanstore.TraceQueryParameters{
+				Tags:        tt.tags,
+				DurationMin: time.Second,
+				DurationMax: time.Minute,
+			}, 0)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidSearchTag)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestStore_FindTracesByRelation(t *testing.T) {
+	mockReader := clickhousestore.NewMockClickhouseReader(1)
+	tracer := noop.Tracer{}
+
+	store := New(mockReader, clickhousestore.NewMockClickhouseWriter(), tracer)
+	ctx := context.Background()
+
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:  "checkout",
+		StartTimeMin: time.Now().Add(-30 * time.Minute),
+	}
+	child := SpanQuery{
+		ServiceName: "payments",
+		Tags:        map[string]string{"error": "true"},
+	}
+
+	got, err := store.FindTracesByRelation(ctx, query, child)
+	if err != nil {
+		t.Errorf("Store.FindTracesByRelation() error = %v", err)
+		return
+	}
+
+	assert.Equal(t, 1, len(got))
+	assert.Equal(t, 1, len(mockReader.SearchCalls))
+	assert.Equal(t, &clickhousestore.SpanFilter{
+		ServiceName: "payments",
+		Attributes:  map[string]string{"error": "true"},
+	}, mockReader.SearchCalls[0].Options.Child)
+}
+
+func TestStore_FindTracesByRelation_traceMatchScope(t *testing.T) {
+	mockReader := clickhousestore.NewMockClickhouseReader(1)
+	store := New(mockReader, clickhousestore.NewMockClickhouseWriter(), noop.Tracer{}, WithMatchScope(ScopeTrace))
+
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:  "checkout",
+		StartTimeMin: time.Now().Add(-30 * time.Minute),
+	}
+
+	_, err := store.FindTracesByRelation(context.Background(), query, SpanQuery{ServiceName: "payments"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, 0, len(mockReader.SearchCalls))
+}
+
+func TestStore_FindTraces_order(t *testing.T) {
+	mockReader := clickhousestore.NewMockClickhouseReader(2)
+	tracer := noop.Tracer{}
+
+	store := New(mockReader, clickhousestore.NewMockClickhouseWriter(), tracer)
+	ctx := context.Background()
+
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:  clickhousestore.TestDataServiceNameOne,
+		StartTimeMin: time.Now().Add(-time.Hour),
+	}
+
+	traceIDOne, _ := model.TraceIDFromString(clickhousestore.TestDataTraceIDOne)
+	traceIDTwo, _ := model.TraceIDFromString(clickhousestore.TestDataTraceIDTwo)
+
+	for i := 0; i < 5; i++ {
+		got, err := store.FindTraces(ctx, query)
+		if err != nil {
+			t.Errorf("Store.FindTraces() error = %v", err)
+			return
+		}
+
+		// The second trace starts after the first one, so it is returned first even
+		// though the search returned it last
+		assert.Equal(t, 2, len(got))
+		assert.Equal(t, traceIDTwo, got[0].Spans[0].TraceID)
+		assert.Equal(t, traceIDOne, got[1].Spans[0].TraceID)
+	}
+}
+
+func TestStore_sortTracesByStartTime(t *testing.T) {
+	now := time.Now()
+	newTrace := func(starts ...time.Time) *model.Trace {
+		trace := &model.Trace{}
+		for _, start := range starts {
+			trace.Spans = append(trace.Spans, &model.Span{StartTime: start})
+		}
+		return trace
+	}
+
+	oldest := newTrace(now.Add(-time.Hour), now)
+	newest := newTrace(now.Add(time.Second), now.Add(time.Minute))
+	middle := newTrace(now.Add(-time.Minute))
+	sameAsMiddle := newTrace(now, now.Add(-time.Minute))
+
+	traces := []*model.Trace{oldest, middle, newest, sameAsMiddle}
+	sortTracesByStartTime(traces)
+
+	assert.Equal(t, []*model.Trace{newest, middle, sameAsMiddle, oldest}, traces)
+}
+
+func TestStore_GetDependencies(t *testing.T) {
+	mockReader := clickhousestore.NewMockClickhouseReader(2)
+	tracer := noop.Tracer{}
+
+	store := New(mockReader, clickhousestore.NewMockClickhouseWriter(), tracer)
+	ctx := context.Background()
+
+	got, err := store.GetDependencies(ctx, time.Now(), time.Hour)
+	if err != nil {
+		t.Errorf("Store.GetDependencies() error = %v", err)
+		return
+	}
+
+	assert.Equal(t, 1, len(got))
+	assert.Equal(t, clickhousestore.TestDataServiceNameOne, got[0].Parent)
+	assert.Equal(t, clickhousestore.TestDataServiceNameTwo, got[0].Child)
+	assert.Equal(t, uint64(2), got[0].CallCount)
+}
+
+func TestStore_GetTrace_links(t *testing.T) {
+	mockReader := clickhousestore.NewMockClickhouseReader(2)
+	tracer := noop.Tracer{}
+
+	store := New(mockReader, clickhousestore.NewMockClickhouseWriter(), tracer)
+	ctx := context.Background()
+
+	traceIDOne, _ := model.TraceIDFromString(clickhousestore.TestDataTraceIDOne)
+	traceIDTwo, _ := model.TraceIDFromString(clickhousestore.TestDataTraceIDTwo)
+	parentSpanID, _ := model.SpanIDFromString("a7d2aa025caa9cb8")
+	linkedSpanID, _ := model.SpanIDFromString("0d8fd33795ba49aa")
+
+	got, err := store.GetTrace(ctx, traceIDTwo)
+	if err != nil {
+		t.Errorf("Store.GetTrace() error = %v", err)
+		return
+	}
+
+	assert.Equal(t, 2, len(got.Spans))
+	assert.Equal(t, []model.SpanRef{
+		model.NewChildOfRef(traceIDTwo, parentSpanID),
+		model.NewFollowsFromRef(traceIDOne, linkedSpanID),
+	}, got.Spans[1].References)
+}
+
+func TestStore_convertClickhouseToJaegerTrace_sharedSpanLinks(t *testing.T) {
+	store := New(clickhousestore.NewMockClickhouseReader(2), clickhousestore.NewMockClickhouseWriter(), noop.Tracer{})
+
+	traceID, _ := model.TraceIDFromString(clickhousestore.TestDataTraceIDOne)
+	linkedTraceID, _ := model.TraceIDFromString(clickhousestore.TestDataTraceIDTwo)
+	parentSpanID, _ := model.SpanIDFromString("a7d2aa025caa9cb8")
+	sharedSpanID, _ := model.SpanIDFromString("0d8fd33795ba49aa")
+	linkedSpanID, _ := model.SpanIDFromString("1c2b3a4d5e6f7081")
+
+	client := clickhousestore.ClickhouseOtelSpan{
+		Timestamp:    clickhousestore.TestDataStartTime,
+		TraceID:      clickhousestore.TestDataTraceIDOne,
+		SpanID:       "0d8fd33795ba49aa",
+		ParentSpanID: "a7d2aa025caa9cb8",
+		SpanKind:     "SPAN_KIND_CLIENT",
+		ServiceName:  clickhousestore.TestDataServiceNameOne,
+	}
+	server := clickhousestore.ClickhouseOtelSpan{
+		Timestamp:       clickhousestore.TestDataStartTime,
+		TraceID:         clickhousestore.TestDataTraceIDOne,
+		SpanID:          "0d8fd33795ba49aa",
+		SpanKind:        "SPAN_KIND_SERVER",
+		ServiceName:     clickhousestore.TestDataServiceNameTwo,
+		LinksTraceID:    []string{clickhousestore.TestDataTraceIDTwo},
+		LinksSpanID:     []string{"1c2b3a4d5e6f7081"},
+		LinksTraceState: []string{""},
+	}
+
+	tests := []struct {
+		name  string
+		spans []clickhousestore.ClickhouseOtelSpan
+	}{
+		{name: "client first", spans: []clickhousestore.ClickhouseOtelSpan{client, server}},
+		{name: "server first", spans: []clickhousestore.ClickhouseOtelSpan{server, client}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.convertClickhouseToJaegerTrace(context.Background(), &clickhousestore.ClickhouseOtelTrace{
+				TraceID: clickhousestore.TestDataTraceIDOne,
+				Spans:   tt.spans,
+			})
+			assert.NoError(t, err)
+
+			// the server half is kept with the parent of the client half and its own link
+			assert.Equal(t, 1, len(got.Spans))
+			assert.Equal(t, sharedSpanID, got.Spans[0].SpanID)
+			assert.Equal(t, clickhousestore.TestDataServiceNameTwo, got.Spans[0].Process.ServiceName)
+			assert.Equal(t, []model.SpanRef{
+				model.NewChildOfRef(traceID, parentSpanID),
+				model.NewFollowsFromRef(linkedTraceID, linkedSpanID),
+			}, got.Spans[0].References)
+		})
+	}
+}
+
+func TestStore_GetTrace_processes(t *testing.T) {
+	mockReader := clickhousestore.NewMockClickhouseReader(2)
+	tracer := noop.Tracer{}
+
+	store := New(mockReader, clickhousestore.NewMockClickhouseWriter(), tracer)
+	ctx := context.Background()
+
+	traceIDOne, _ := model.TraceIDFromString(clickhousestore.TestDataTraceIDOne)
+
+	got, err := store.GetTrace(ctx, traceIDOne)
+	if err != nil {
+		t.Errorf("Store.GetTrace() error = %v", err)
+		return
+	}
+
+	assert.Equal(t, 2, len(got.ProcessMap))
+	for _, span := range got.Spans {
+		assert.Equal(t, clickhousestore.TestDataServiceNameOne, span.Process.ServiceName)
+	}
+	assert.Equal(t, "p1", got.Spans[0].ProcessID)
+	assert.Equal(t, 2, len(got.Spans[0].Process.Tags))
+	assert.Equal(t, "p2", got.Spans[1].ProcessID)
+	assert.Equal(t, 0, len(got.Spans[1].Process.Tags))
+}
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{name: "queryLimitExceeded", err: fmt.Errorf("%w: too many rows", clickhousestore.ErrQueryLimitExceeded), code: codes.ResourceExhausted},
+		{name: "timeRangeTooLarge", err: ErrTimeRangeTooLarge, code: codes.InvalidArgument},
+		{name: "invalidSearchTag", err: fmt.Errorf("%w search.match: unknown scope", ErrInvalidSearchTag), code: codes.InvalidArgument},
+		{name: "tagQuerySyntax", err: fmt.Errorf("%w: missing value", tagquery.ErrSyntax), code: codes.InvalidArgument},
+		{name: "notFound", err: fmt.Errorf("%w: trace", clickhousestore.ErrNotFound), code: codes.NotFound},
+		{name: "other", err: errors.New("connection reset"), code: codes.Unknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.code, status.Code(statusError(tt.err)))
+		})
+	}
+
+	assert.NoError(t, statusError(nil))
+}
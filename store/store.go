@@ -1,29 +1,136 @@
 package store
 
 import (
-	"context"
-	"github.com/jaegertracing/jaeger/model"
+	"fmt"
 	"github.com/jaegertracing/jaeger/storage/dependencystore"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/attributes"
 	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/clickhousestore"
 	"go.opentelemetry.io/otel/trace"
 	"log/slog"
+	"strings"
+	"time"
 )
 
+const (
+	defaultProgressiveSearchSteps         = 4
+	defaultProgressiveSearchInitialWindow = time.Hour
+	defaultAllServicesMaxRange            = time.Hour
+)
+
+var defaultProgressiveSearch = ProgressiveSearch{
+	Steps:         defaultProgressiveSearchSteps,
+	InitialWindow: defaultProgressiveSearchInitialWindow,
+}
+
 type Store struct {
-	clickhousestore clickhousestore.ClickhouseStore
-	tracer          trace.Tracer
-	logger          *slog.Logger
+	clickhousestore     clickhousestore.ClickhouseStore
+	writer              clickhousestore.ClickhouseSpanWriter
+	attributeTypes      *attributes.Types
+	progressiveSearch   ProgressiveSearch
+	allServicesMaxRange time.Duration
+	durationScope       Scope
+	matchScope          Scope
+	tracer              trace.Tracer
+	logger              *slog.Logger
+}
+
+// ProgressiveSearch configures how searches over long time ranges are split into steps.
+// The first step searches the most recent InitialWindow, or a larger window for long time
+// ranges, and every following step searches an older window twice as large until enough
+// traces have been found, the time range has been covered or the TimeBudget is spent.
+type ProgressiveSearch struct {
+	Steps         int
+	InitialWindow time.Duration
+	TimeBudget    time.Duration
+}
+
+// SpanQuery selects the child spans of structural searches.
+type SpanQuery struct {
+	ServiceName   string
+	OperationName string
+	Tags          map[string]string
+}
+
+// Scope defines whether parts of a search apply to single spans or to whole traces.
+type Scope string
+
+const (
+	ScopeSpan  Scope = "span"
+	ScopeTrace Scope = "trace"
+)
+
+// ParseScope parses a scope, where an empty scope defaults to spans.
+func ParseScope(scope string) (Scope, error) {
+	switch Scope(strings.ToLower(scope)) {
+	case "", ScopeSpan:
+		return ScopeSpan, nil
+	case ScopeTrace:
+		return ScopeTrace, nil
+	}
+	return "", fmt.Errorf("unknown scope %q, expected %q or %q", scope, ScopeSpan, ScopeTrace)
+}
+
+// Option configures optional behavior of a Store.
+type Option func(s *Store)
+
+// WithAttributeTypes sets the types used to convert attributes into typed tags.
+func WithAttributeTypes(types *attributes.Types) Option {
+	return func(s *Store) {
+		s.attributeTypes = types
+	}
 }
 
-func New(store clickhousestore.ClickhouseStore, tracer trace.Tracer) *Store {
-	return &Store{
-		clickhousestore: store,
-		tracer:          tracer,
-		logger:          slog.Default(),
+// WithProgressiveSearch configures searches over long time ranges.
+func WithProgressiveSearch(progressiveSearch ProgressiveSearch) Option {
+	return func(s *Store) {
+		s.progressiveSearch = progressiveSearch
 	}
 }
 
+// WithAllServicesMaxRange limits the time range of searches without a service name, which
+// cannot make use of the primary key of the spans table. A zero range disables the limit.
+func WithAllServicesMaxRange(maxRange time.Duration) Option {
+	return func(s *Store) {
+		s.allServicesMaxRange = maxRange
+	}
+}
+
+// WithDurationScope sets whether duration filters apply to spans or traces by default.
+func WithDurationScope(scope Scope) Option {
+	return func(s *Store) {
+		s.durationScope = scope
+	}
+}
+
+// WithMatchScope sets whether the conditions of a search have to be matched by a single
+// span or may be matched by different spans of a trace by default.
+func WithMatchScope(scope Scope) Option {
+	return func(s *Store) {
+		s.matchScope = scope
+	}
+}
+
+func New(store clickhousestore.ClickhouseStore, writer clickhousestore.ClickhouseSpanWriter, tracer trace.Tracer, options ...Option) *Store {
+	s := &Store{
+		clickhousestore:     store,
+		writer:              writer,
+		attributeTypes:      attributes.NewTypes(nil),
+		progressiveSearch:   defaultProgressiveSearch,
+		allServicesMaxRange: defaultAllServicesMaxRange,
+		durationScope:       ScopeSpan,
+		matchScope:          ScopeSpan,
+		tracer:              tracer,
+		logger:              slog.Default(),
+	}
+
+	for _, option := range options {
+		option(s)
+	}
+
+	return s
+}
+
 func (s *Store) SpanReader() spanstore.Reader {
 	return s
 }
@@ -41,9 +148,5 @@ func (s *Store) StreamingSpanWriter() spanstore.Writer {
 }
 
 func (s *Store) Close() error {
-	return nil
-}
-
-func (s *Store) WriteSpan(ctx context.Context, span *model.Span) error {
-	return nil
+	return s.writer.Close()
 }
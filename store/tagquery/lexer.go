@@ -0,0 +1,137 @@
+package tagquery
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenType int
+
+const (
+	tokenNot tokenType = iota
+	tokenKey
+	tokenOperator
+	tokenStar
+	tokenListStart
+	tokenListEnd
+	tokenComma
+	tokenValue
+)
+
+func (t tokenType) String() string {
+	switch t {
+	case tokenNot:
+		return "'!'"
+	case tokenKey:
+		return "key"
+	case tokenOperator:
+		return "operator"
+	case tokenStar:
+		return "'*'"
+	case tokenListStart:
+		return "'['"
+	case tokenListEnd:
+		return "']'"
+	case tokenComma:
+		return "','"
+	case tokenValue:
+		return "value"
+	}
+	return "unknown token"
+}
+
+type token struct {
+	typ   tokenType
+	value string
+	pos   int
+}
+
+// operators ordered by length, so that the longest operator is matched first
+var operators = []string{"!=~", "!=", "!~", "=~", ">=", "<=", "=", ">", "<"}
+
+// operatorChars end a key, as keys cannot contain any of them
+const operatorChars = "=!<>"
+
+// lex splits a tag query into tokens. Everything following the operator is part of the
+// value, except for lists enclosed in brackets, so values may contain operator characters
+// as in "http.url=https://example.com/?q=1".
+func lex(input string) ([]token, error) {
+	var tokens []token
+	pos := 0
+
+	if strings.HasPrefix(input, "!") {
+		tokens = append(tokens, token{typ: tokenNot, value: "!", pos: pos})
+		pos++
+	}
+
+	keyEnd := strings.IndexAny(input[pos:], operatorChars)
+	if keyEnd < 0 {
+		keyEnd = len(input) - pos
+	}
+	key := strings.TrimSpace(input[pos : pos+keyEnd])
+	if key == "" {
+		return nil, fmt.Errorf("%w: missing key at position %d", ErrSyntax, pos)
+	}
+	tokens = append(tokens, token{typ: tokenKey, value: key, pos: pos})
+	pos += keyEnd
+
+	if pos == len(input) {
+		return tokens, nil
+	}
+
+	operator := ""
+	for _, op := range operators {
+		if strings.HasPrefix(input[pos:], op) {
+			operator = op
+			break
+		}
+	}
+	if operator == "" {
+		return nil, fmt.Errorf("%w: unknown operator at position %d", ErrSyntax, pos)
+	}
+	tokens = append(tokens, token{typ: tokenOperator, value: operator, pos: pos})
+	pos += len(operator)
+
+	value := input[pos:]
+	switch {
+	case value == "*":
+		tokens = append(tokens, token{typ: tokenStar, value: value, pos: pos})
+	case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") && len(value) >= 2:
+		tokens = append(tokens, lexList(value, pos)...)
+	default:
+		tokens = append(tokens, token{typ: tokenValue, value: value, pos: pos})
+	}
+
+	return tokens, nil
+}
+
+// lexList splits a bracketed list into its values, where commas can be escaped as "\,".
+// Values are trimmed of surrounding whitespace.
+func lexList(list string, pos int) []token {
+	tokens := []token{{typ: tokenListStart, value: "[", pos: pos}}
+
+	var item strings.Builder
+	itemPos := pos + 1
+	addItem := func() {
+		tokens = append(tokens, token{typ: tokenValue, value: strings.TrimSpace(item.String()), pos: itemPos})
+		item.Reset()
+	}
+
+	inner := list[1 : len(list)-1]
+	for i := 0; i < len(inner); i++ {
+		switch {
+		case inner[i] == '\\' && i+1 < len(inner) && inner[i+1] == ',':
+			item.WriteByte(',')
+			i++
+		case inner[i] == ',':
+			addItem()
+			tokens = append(tokens, token{typ: tokenComma, value: ",", pos: pos + 1 + i})
+			itemPos = pos + 2 + i
+		default:
+			item.WriteByte(inner[i])
+		}
+	}
+	addItem()
+
+	return append(tokens, token{typ: tokenListEnd, value: "]", pos: pos + len(list) - 1})
+}
@@ -0,0 +1,89 @@
+package tagquery
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_lex(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []token
+		wantErr bool
+	}{
+		{
+			name:  "equal",
+			input: "http.method=GET",
+			want: []token{
+				{typ: tokenKey, value: "http.method", pos: 0},
+				{typ: tokenOperator, value: "=", pos: 11},
+				{typ: tokenValue, value: "GET", pos: 12},
+			},
+		},
+		{
+			name:  "longest operator",
+			input: "http.url!=~^https",
+			want: []token{
+				{typ: tokenKey, value: "http.url", pos: 0},
+				{typ: tokenOperator, value: "!=~", pos: 8},
+				{typ: tokenValue, value: "^https", pos: 11},
+			},
+		},
+		{
+			name:  "operator characters in value",
+			input: "http.url=https://example.com/?q=1&r>2",
+			want: []token{
+				{typ: tokenKey, value: "http.url", pos: 0},
+				{typ: tokenOperator, value: "=", pos: 8},
+				{typ: tokenValue, value: "https://example.com/?q=1&r>2", pos: 9},
+			},
+		},
+		{
+			name:  "not",
+			input: "!peer.service",
+			want: []token{
+				{typ: tokenNot, value: "!", pos: 0},
+				{typ: tokenKey, value: "peer.service", pos: 1},
+			},
+		},
+		{
+			name:  "star",
+			input: "db.statement=*",
+			want: []token{
+				{typ: tokenKey, value: "db.statement", pos: 0},
+				{typ: tokenOperator, value: "=", pos: 12},
+				{typ: tokenStar, value: "*", pos: 13},
+			},
+		},
+		{
+			name:  "list",
+			input: "region=[us-east-1, a\\,b]",
+			want: []token{
+				{typ: tokenKey, value: "region", pos: 0},
+				{typ: tokenOperator, value: "=", pos: 6},
+				{typ: tokenListStart, value: "[", pos: 7},
+				{typ: tokenValue, value: "us-east-1", pos: 8},
+				{typ: tokenComma, value: ",", pos: 17},
+				{typ: tokenValue, value: "a,b", pos: 18},
+				{typ: tokenListEnd, value: "]", pos: 23},
+			},
+		},
+		{
+			name:    "missing key",
+			input:   "=GET",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lex(tt.input)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrSyntax)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
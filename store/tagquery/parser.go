@@ -0,0 +1,308 @@
+// Package tagquery parses the tags of trace searches into conditions and compiles them
+// into parameterized Clickhouse SQL. A tag is a key, an operator and a value:
+//
+//	http.method=GET             equal
+//	http.method!=GET            not equal
+//	http.url=https://%          LIKE pattern, where "\%" is a literal '%'
+//	http.url!=https://%         NOT LIKE pattern
+//	http.url=~^https://         regular expression
+//	http.url!~^https://         negated regular expression, also written as "!=~"
+//	http.status_code>=500       numeric comparison with '>', '>=', '<' or '<='
+//	db.statement=*              attribute exists
+//	!peer.service               attribute does not exist, also written as "peer.service!=*"
+//	region=[us-east-1,eu-west-1]  one of the values, "!=" for none of the values
+package tagquery
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrSyntax = errors.New("invalid tag query")
+)
+
+// Operator compares the value of a tag to the values of a condition.
+type Operator int
+
+const (
+	OpEqual Operator = iota
+	OpNotEqual
+	OpLike
+	OpNotLike
+	OpMatch
+	OpNotMatch
+	OpGreater
+	OpGreaterOrEqual
+	OpLess
+	OpLessOrEqual
+	OpIn
+	OpNotIn
+	OpExists
+	OpNotExists
+)
+
+func (o Operator) String() string {
+	switch o {
+	case OpEqual:
+		return "EQUAL"
+	case OpNotEqual:
+		return "NOT EQUAL"
+	case OpLike:
+		return "LIKE"
+	case OpNotLike:
+		return "NOT LIKE"
+	case OpMatch:
+		return "MATCH"
+	case OpNotMatch:
+		return "NOT MATCH"
+	case OpGreater:
+		return "GREATER"
+	case OpGreaterOrEqual:
+		return "GREATER OR EQUAL"
+	case OpLess:
+		return "LESS"
+	case OpLessOrEqual:
+		return "LESS OR EQUAL"
+	case OpIn:
+		return "IN"
+	case OpNotIn:
+		return "NOT IN"
+	case OpExists:
+		return "EXISTS"
+	case OpNotExists:
+		return "NOT EXISTS"
+	}
+	return "UNKNOWN"
+}
+
+// Negated reports whether the operator matches when the positive condition does not.
+func (o Operator) Negated() bool {
+	switch o {
+	case OpNotEqual, OpNotLike, OpNotMatch, OpNotIn, OpNotExists:
+		return true
+	}
+	return false
+}
+
+// Positive returns the operator a negated operator negates, or the operator itself if it
+// is not negated.
+func (o Operator) Positive() Operator {
+	switch o {
+	case OpNotEqual:
+		return OpEqual
+	case OpNotLike:
+		return OpLike
+	case OpNotMatch:
+		return OpMatch
+	case OpNotIn:
+		return OpIn
+	case OpNotExists:
+		return OpExists
+	}
+	return o
+}
+
+// Expr is a parsed tag condition.
+type Expr struct {
+	Key      string
+	Operator Operator
+	Values   []string
+}
+
+// Check for instances of wildcard without being escaped
+var wildcardRegexp = regexp.MustCompile(`(^|[^\\])%`)
+
+// Parse parses a single tag condition.
+func Parse(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return Expr{}, err
+	}
+	p := &parser{input: input, tokens: tokens}
+	return p.parse()
+}
+
+// ParseTag parses a tag of a search query, which holds tags as a map of keys to values.
+// Operators are split between key and value when tags are parsed as "key=value" pairs,
+// so the condition is restored by joining them, as in "http.status_code>" and "500". A
+// condition without '=' ends up as key only, like "!peer.service" or "duration<5", with
+// an empty value or "true" depending on the client.
+func ParseTag(key string, value string) (Expr, error) {
+	if (value == "" || value == "true") && isCondition(key) {
+		return Parse(key)
+	}
+	return Parse(key + "=" + value)
+}
+
+// Operators which, followed by a value, make a key a complete condition. A bare "x=y" is
+// always split into key and value, so '=' on its own never remains in a key.
+var keyOperators = []string{"!~", "=~", "!=", "<", ">"}
+
+// isCondition reports whether a key is a complete condition on its own
+func isCondition(key string) bool {
+	if strings.HasPrefix(key, "!") {
+		return true
+	}
+	for _, operator := range keyOperators {
+		idx := strings.Index(key, operator)
+		if idx > 0 && idx+len(operator) < len(key) {
+			return true
+		}
+	}
+	return false
+}
+
+type parser struct {
+	input  string
+	tokens []token
+	pos    int
+}
+
+func (p *parser) next() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t, true
+}
+
+func (p *parser) expect(typ tokenType) (token, error) {
+	t, ok := p.next()
+	if !ok {
+		return t, fmt.Errorf("%w: expected %s at end of %q", ErrSyntax, typ, p.input)
+	}
+	if t.typ != typ {
+		return t, fmt.Errorf("%w: expected %s at position %d of %q, got %s", ErrSyntax, typ, t.pos, p.input, t.typ)
+	}
+	return t, nil
+}
+
+func (p *parser) expectEnd() error {
+	if t, ok := p.next(); ok {
+		return fmt.Errorf("%w: unexpected %s at position %d of %q", ErrSyntax, t.typ, t.pos, p.input)
+	}
+	return nil
+}
+
+func (p *parser) parse() (Expr, error) {
+	if p.tokens[0].typ == tokenNot {
+		p.pos++
+		key, err := p.expect(tokenKey)
+		if err != nil {
+			return Expr{}, err
+		}
+		return Expr{Key: key.value, Operator: OpNotExists}, p.expectEnd()
+	}
+
+	key, err := p.expect(tokenKey)
+	if err != nil {
+		return Expr{}, err
+	}
+
+	operator, err := p.expect(tokenOperator)
+	if err != nil {
+		return Expr{}, err
+	}
+
+	value, ok := p.next()
+	if !ok {
+		return Expr{}, fmt.Errorf("%w: missing value of %q", ErrSyntax, p.input)
+	}
+
+	var expr Expr
+	switch value.typ {
+	case tokenStar:
+		expr, err = p.existence(key.value, operator)
+	case tokenListStart:
+		expr, err = p.list(key.value, operator)
+	case tokenValue:
+		expr, err = p.comparison(key.value, operator, value.value)
+	default:
+		err = fmt.Errorf("%w: unexpected %s at position %d of %q", ErrSyntax, value.typ, value.pos, p.input)
+	}
+	if err != nil {
+		return Expr{}, err
+	}
+
+	return expr, p.expectEnd()
+}
+
+func (p *parser) existence(key string, operator token) (Expr, error) {
+	switch operator.value {
+	case "=":
+		return Expr{Key: key, Operator: OpExists}, nil
+	case "!=":
+		return Expr{Key: key, Operator: OpNotExists}, nil
+	}
+	return Expr{}, p.unsupported(operator, "'*'")
+}
+
+func (p *parser) list(key string, operator token) (Expr, error) {
+	var values []string
+	for {
+		value, err := p.expect(tokenValue)
+		if err != nil {
+			return Expr{}, err
+		}
+		values = append(values, value.value)
+
+		t, ok := p.next()
+		if !ok {
+			return Expr{}, fmt.Errorf("%w: unterminated list in %q", ErrSyntax, p.input)
+		}
+		if t.typ == tokenListEnd {
+			break
+		}
+		if t.typ != tokenComma {
+			return Expr{}, fmt.Errorf("%w: expected ',' at position %d of %q, got %s", ErrSyntax, t.pos, p.input, t.typ)
+		}
+	}
+
+	switch operator.value {
+	case "=":
+		return Expr{Key: key, Operator: OpIn, Values: values}, nil
+	case "!=":
+		return Expr{Key: key, Operator: OpNotIn, Values: values}, nil
+	}
+	return Expr{}, p.unsupported(operator, "lists")
+}
+
+func (p *parser) comparison(key string, operator token, value string) (Expr, error) {
+	switch operator.value {
+	case "=", "!=":
+		negated := operator.value == "!="
+		if wildcardRegexp.MatchString(value) {
+			return Expr{Key: key, Operator: pick(negated, OpNotLike, OpLike), Values: []string{value}}, nil
+		}
+		// Replace all escaped wildcards with literal '%'
+		value = strings.ReplaceAll(value, "\\%", "%")
+		return Expr{Key: key, Operator: pick(negated, OpNotEqual, OpEqual), Values: []string{value}}, nil
+	case "=~":
+		return Expr{Key: key, Operator: OpMatch, Values: []string{value}}, nil
+	case "!~", "!=~":
+		return Expr{Key: key, Operator: OpNotMatch, Values: []string{value}}, nil
+	}
+
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		return Expr{}, fmt.Errorf("%w: %s requires a number in %q", ErrSyntax, operator.value, p.input)
+	}
+
+	ops := map[string]Operator{">": OpGreater, ">=": OpGreaterOrEqual, "<": OpLess, "<=": OpLessOrEqual}
+	return Expr{Key: key, Operator: ops[operator.value], Values: []string{value}}, nil
+}
+
+func (p *parser) unsupported(operator token, operand string) error {
+	return fmt.Errorf("%w: operator %s is not supported for %s in %q", ErrSyntax, operator.value, operand, p.input)
+}
+
+func pick(negated bool, ifNegated Operator, otherwise Operator) Operator {
+	if negated {
+		return ifNegated
+	}
+	return otherwise
+}
@@ -0,0 +1,86 @@
+package tagquery
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Expr
+		wantErr bool
+	}{
+		{input: "http.method=GET", want: Expr{Key: "http.method", Operator: OpEqual, Values: []string{"GET"}}},
+		{input: "http.method!=GET", want: Expr{Key: "http.method", Operator: OpNotEqual, Values: []string{"GET"}}},
+		{input: "http.url=http%://duckduckgo.com", want: Expr{Key: "http.url", Operator: OpLike, Values: []string{"http%://duckduckgo.com"}}},
+		{input: "http.url!=%.com", want: Expr{Key: "http.url", Operator: OpNotLike, Values: []string{"%.com"}}},
+		{input: "discount=10\\%", want: Expr{Key: "discount", Operator: OpEqual, Values: []string{"10%"}}},
+		{input: "http.url=~http://[duck]+go.com", want: Expr{Key: "http.url", Operator: OpMatch, Values: []string{"http://[duck]+go.com"}}},
+		{input: "http.url!~^https", want: Expr{Key: "http.url", Operator: OpNotMatch, Values: []string{"^https"}}},
+		{input: "http.url!=~^https", want: Expr{Key: "http.url", Operator: OpNotMatch, Values: []string{"^https"}}},
+		{input: "http.status_code>500", want: Expr{Key: "http.status_code", Operator: OpGreater, Values: []string{"500"}}},
+		{input: "http.status_code>=500", want: Expr{Key: "http.status_code", Operator: OpGreaterOrEqual, Values: []string{"500"}}},
+		{input: "duration<0.5", want: Expr{Key: "duration", Operator: OpLess, Values: []string{"0.5"}}},
+		{input: "retries<=3", want: Expr{Key: "retries", Operator: OpLessOrEqual, Values: []string{"3"}}},
+		{input: "db.statement=*", want: Expr{Key: "db.statement", Operator: OpExists}},
+		{input: "db.statement!=*", want: Expr{Key: "db.statement", Operator: OpNotExists}},
+		{input: "!peer.service", want: Expr{Key: "peer.service", Operator: OpNotExists}},
+		{input: "region=[us-east-1,us-west-2]", want: Expr{Key: "region", Operator: OpIn, Values: []string{"us-east-1", "us-west-2"}}},
+		{input: "region!=[us-east-1]", want: Expr{Key: "region", Operator: OpNotIn, Values: []string{"us-east-1"}}},
+		{input: "http.method=", want: Expr{Key: "http.method", Operator: OpEqual, Values: []string{""}}},
+		{input: "http.method", wantErr: true},
+		{input: "http.status_code>=error", wantErr: true},
+		{input: "http.url=~*", wantErr: true},
+		{input: "region>[1,2]", wantErr: true},
+		{input: "!peer.service=x", wantErr: true},
+		{input: "region=[a,,b]", want: Expr{Key: "region", Operator: OpIn, Values: []string{"a", "", "b"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := Parse(tt.input)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrSyntax)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseTag(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		want  Expr
+	}{
+		{key: "http.method", value: "GET", want: Expr{Key: "http.method", Operator: OpEqual, Values: []string{"GET"}}},
+		{key: "error", value: "true", want: Expr{Key: "error", Operator: OpEqual, Values: []string{"true"}}},
+		{key: "http.status_code>", value: "500", want: Expr{Key: "http.status_code", Operator: OpGreaterOrEqual, Values: []string{"500"}}},
+		{key: "http.method!", value: "GET", want: Expr{Key: "http.method", Operator: OpNotEqual, Values: []string{"GET"}}},
+		{key: "http.url", value: "~^https", want: Expr{Key: "http.url", Operator: OpMatch, Values: []string{"^https"}}},
+		{key: "!peer.service", value: "", want: Expr{Key: "peer.service", Operator: OpNotExists}},
+		{key: "!peer.service", value: "true", want: Expr{Key: "peer.service", Operator: OpNotExists}},
+		{key: "http.status_code<500", value: "true", want: Expr{Key: "http.status_code", Operator: OpLess, Values: []string{"500"}}},
+		{key: "http.url!~^https", value: "true", want: Expr{Key: "http.url", Operator: OpNotMatch, Values: []string{"^https"}}},
+		{key: "http.url!~^https", value: "", want: Expr{Key: "http.url", Operator: OpNotMatch, Values: []string{"^https"}}},
+		{key: "http.url=~^https", value: "true", want: Expr{Key: "http.url", Operator: OpMatch, Values: []string{"^https"}}},
+		{key: "http.url!=~^https", value: "true", want: Expr{Key: "http.url", Operator: OpNotMatch, Values: []string{"^https"}}},
+		{key: "http.method!=GET", value: "true", want: Expr{Key: "http.method", Operator: OpNotEqual, Values: []string{"GET"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key+"="+tt.value, func(t *testing.T) {
+			got, err := ParseTag(tt.key, tt.value)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestOperator_Positive(t *testing.T) {
+	for _, operator := range []Operator{OpNotEqual, OpNotLike, OpNotMatch, OpNotIn, OpNotExists} {
+		assert.False(t, operator.Positive().Negated(), operator.String())
+	}
+	assert.Equal(t, OpGreater, OpGreater.Positive())
+}
@@ -0,0 +1,173 @@
+package tagquery
+
+import (
+	"fmt"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/attributes"
+	"strconv"
+	"strings"
+)
+
+// Target is a SQL expression the value of a tag is compared to, such as a column or an
+// attribute read from an attributes column. Missing attributes must evaluate to an empty
+// string, which is how existence is checked.
+type Target struct {
+	Expression string
+	// Args are the arguments of the placeholders in Expression
+	Args []interface{}
+	// Type of the values, so that "500" and "500.0" both match an integer status code
+	Type attributes.Type
+	// Lower marks a lower case expression, so values are compared in lower case as well
+	Lower bool
+}
+
+// Compile returns a parameterized condition matching the expression against any of the
+// targets. Negated expressions have to hold for all of the targets instead, so that
+// "!peer.service" does not match a span having the attribute on one of them only.
+func Compile(expr Expr, targets []Target) (string, []interface{}, error) {
+	var conditions []string
+	var args []interface{}
+
+	for _, target := range targets {
+		condition, conditionArgs, err := compileTarget(expr, target)
+		if err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, condition)
+		args = append(args, conditionArgs...)
+	}
+
+	switch len(conditions) {
+	case 0:
+		return "", nil, fmt.Errorf("no targets for tag %s", expr.Key)
+	case 1:
+		return conditions[0], args, nil
+	}
+
+	separator := " OR "
+	if expr.Operator.Negated() {
+		separator = " AND "
+	}
+	return "(" + strings.Join(conditions, separator) + ")", args, nil
+}
+
+func compileTarget(expr Expr, target Target) (string, []interface{}, error) {
+	args := append([]interface{}{}, target.Args...)
+
+	values := expr.Values
+	if target.Lower {
+		values = make([]string, len(expr.Values))
+		for i, value := range expr.Values {
+			values[i] = strings.ToLower(value)
+		}
+	}
+
+	switch expr.Operator {
+	case OpExists:
+		return target.Expression + " != ''", args, nil
+	case OpNotExists:
+		return target.Expression + " = ''", args, nil
+	case OpEqual, OpNotEqual:
+		operator := map[Operator]string{OpEqual: "=", OpNotEqual: "!="}[expr.Operator]
+		expression, value := typed(target, values[0])
+		return negatable(expr, expression, fmt.Sprintf("%s %s ?", expression, operator)), append(args, value), nil
+	case OpLike:
+		// Empty values never match a pattern, as missing attributes are empty
+		args = append(append(args, values[0]), target.Args...)
+		return fmt.Sprintf("(%[1]s LIKE ? AND %[1]s != '')", target.Expression), args, nil
+	case OpNotLike:
+		return target.Expression + " NOT LIKE ?", append(args, values[0]), nil
+	case OpMatch:
+		// Patterns are not converted to lower case, as that would change escapes like "\D"
+		return fmt.Sprintf("match(%s, ?)", target.Expression), append(args, expr.Values[0]), nil
+	case OpNotMatch:
+		return fmt.Sprintf("NOT match(%s, ?)", target.Expression), append(args, expr.Values[0]), nil
+	case OpGreater, OpGreaterOrEqual, OpLess, OpLessOrEqual:
+		operator := map[Operator]string{OpGreater: ">", OpGreaterOrEqual: ">=", OpLess: "<", OpLessOrEqual: "<="}[expr.Operator]
+		expression, value, err := numeric(target, values[0])
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("%s %s ?", expression, operator), append(args, value), nil
+	case OpIn, OpNotIn:
+		operator := map[Operator]string{OpIn: "IN", OpNotIn: "NOT IN"}[expr.Operator]
+		expression, typedValues := typedList(target, values)
+		placeholders := "?" + strings.Repeat(", ?", len(typedValues)-1)
+		return negatable(expr, expression, fmt.Sprintf("%s %s (%s)", expression, operator, placeholders)), append(args, typedValues...), nil
+	}
+
+	return "", nil, fmt.Errorf("unsupported operator %s", expr.Operator)
+}
+
+// negatable returns the condition comparing a typed expression, making negated conditions
+// hold for missing values and values that cannot be parsed as the type. These convert to
+// NULL, which is never unequal to a value, so that "http.status_code!=500" would otherwise
+// not match spans without a status code.
+func negatable(expr Expr, expression string, condition string) string {
+	nullable := strings.HasPrefix(expression, "toInt64OrNull(") || strings.HasPrefix(expression, "toFloat64OrNull(")
+	if !expr.Operator.Negated() || !nullable {
+		return condition
+	}
+	return fmt.Sprintf("ifNull(%s, 1)", condition)
+}
+
+// typed converts the target and value to the type of the target. Values that cannot be
+// parsed as the type of the target are compared as strings.
+func typed(target Target, value string) (string, interface{}) {
+	switch target.Type {
+	case attributes.TypeInt64:
+		if v, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return fmt.Sprintf("toInt64OrNull(%s)", target.Expression), v
+		}
+		// Integers written as decimals, like "500.0", are compared as floats
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			return fmt.Sprintf("toFloat64OrNull(%s)", target.Expression), v
+		}
+	case attributes.TypeFloat64:
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			return fmt.Sprintf("toFloat64OrNull(%s)", target.Expression), v
+		}
+	case attributes.TypeBool:
+		if v, err := strconv.ParseBool(value); err == nil {
+			return fmt.Sprintf("lower(%s)", target.Expression), strconv.FormatBool(v)
+		}
+	}
+	return target.Expression, value
+}
+
+// typedList converts the target and values to the type of the target if all of the
+// values can be parsed as the type, and compares them as strings otherwise. Integer
+// targets are compared as floats if only some of the values are written as decimals.
+func typedList(target Target, values []string) (string, []interface{}) {
+	var expression string
+	typedValues := make([]interface{}, 0, len(values))
+
+	for _, value := range values {
+		valueExpression, typedValue := typed(target, value)
+		if expression != "" && valueExpression != expression {
+			if target.Type == attributes.TypeInt64 {
+				return typedList(Target{Expression: target.Expression, Type: attributes.TypeFloat64}, values)
+			}
+			return typedList(Target{Expression: target.Expression}, values)
+		}
+		expression = valueExpression
+		typedValues = append(typedValues, typedValue)
+	}
+
+	return expression, typedValues
+}
+
+// numeric converts the target to a number, as integers for integer targets compared to an
+// integer and as floats otherwise.
+func numeric(target Target, value string) (string, interface{}, error) {
+	if target.Type == attributes.TypeInt64 {
+		if v, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return fmt.Sprintf("toInt64OrNull(%s)", target.Expression), v, nil
+		}
+	}
+
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %q is not a number", ErrSyntax, value)
+	}
+	return fmt.Sprintf("toFloat64OrNull(%s)", target.Expression), v, nil
+}
@@ -0,0 +1,225 @@
+package tagquery
+
+import (
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/attributes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCompile(t *testing.T) {
+	attribute := Target{Expression: "SpanAttributes[?]", Args: []interface{}{"key"}}
+	statusCode := Target{Expression: "SpanAttributes[?]", Args: []interface{}{"http.status_code"}, Type: attributes.TypeInt64}
+	kind := Target{Expression: "lower(SpanKind)", Lower: true}
+
+	tests := []struct {
+		name     string
+		input    string
+		targets  []Target
+		wantSQL  string
+		wantArgs []interface{}
+		wantErr  bool
+	}{
+		{
+			name:     "equal",
+			input:    "key=value",
+			targets:  []Target{attribute},
+			wantSQL:  "SpanAttributes[?] = ?",
+			wantArgs: []interface{}{"key", "value"},
+		},
+		{
+			name:     "typed equal",
+			input:    "http.status_code=500",
+			targets:  []Target{statusCode},
+			wantSQL:  "toInt64OrNull(SpanAttributes[?]) = ?",
+			wantArgs: []interface{}{"http.status_code", int64(500)},
+		},
+		{
+			name:     "typed equal with decimal integer",
+			input:    "http.status_code=500.0",
+			targets:  []Target{statusCode},
+			wantSQL:  "toFloat64OrNull(SpanAttributes[?]) = ?",
+			wantArgs: []interface{}{"http.status_code", 500.0},
+		},
+		{
+			name:     "typed in with decimal integer",
+			input:    "http.status_code=[500,502.0]",
+			targets:  []Target{statusCode},
+			wantSQL:  "toFloat64OrNull(SpanAttributes[?]) IN (?, ?)",
+			wantArgs: []interface{}{"http.status_code", 500.0, 502.0},
+		},
+		{
+			name:     "typed equal falls back to string",
+			input:    "http.status_code=5xx",
+			targets:  []Target{statusCode},
+			wantSQL:  "SpanAttributes[?] = ?",
+			wantArgs: []interface{}{"http.status_code", "5xx"},
+		},
+		{
+			name:     "not equal",
+			input:    "key!=value",
+			targets:  []Target{attribute},
+			wantSQL:  "SpanAttributes[?] != ?",
+			wantArgs: []interface{}{"key", "value"},
+		},
+		{
+			name:     "lower case",
+			input:    "span.kind=Server",
+			targets:  []Target{kind},
+			wantSQL:  "lower(SpanKind) = ?",
+			wantArgs: []interface{}{"server"},
+		},
+		{
+			name:     "like",
+			input:    "key=val%",
+			targets:  []Target{attribute},
+			wantSQL:  "(SpanAttributes[?] LIKE ? AND SpanAttributes[?] != '')",
+			wantArgs: []interface{}{"key", "val%", "key"},
+		},
+		{
+			name:     "not like",
+			input:    "key!=val%",
+			targets:  []Target{attribute},
+			wantSQL:  "SpanAttributes[?] NOT LIKE ?",
+			wantArgs: []interface{}{"key", "val%"},
+		},
+		{
+			name:     "match keeps case",
+			input:    "span.kind=~^S\\D",
+			targets:  []Target{kind},
+			wantSQL:  "match(lower(SpanKind), ?)",
+			wantArgs: []interface{}{"^S\\D"},
+		},
+		{
+			name:     "not match",
+			input:    "key!~^val",
+			targets:  []Target{attribute},
+			wantSQL:  "NOT match(SpanAttributes[?], ?)",
+			wantArgs: []interface{}{"key", "^val"},
+		},
+		{
+			name:     "integer comparison",
+			input:    "http.status_code>=500",
+			targets:  []Target{statusCode},
+			wantSQL:  "toInt64OrNull(SpanAttributes[?]) >= ?",
+			wantArgs: []interface{}{"http.status_code", int64(500)},
+		},
+		{
+			name:     "float comparison",
+			input:    "key<0.5",
+			targets:  []Target{attribute},
+			wantSQL:  "toFloat64OrNull(SpanAttributes[?]) < ?",
+			wantArgs: []interface{}{"key", 0.5},
+		},
+		{
+			name:     "exists",
+			input:    "key=*",
+			targets:  []Target{attribute},
+			wantSQL:  "SpanAttributes[?] != ''",
+			wantArgs: []interface{}{"key"},
+		},
+		{
+			name:     "not exists",
+			input:    "!key",
+			targets:  []Target{attribute},
+			wantSQL:  "SpanAttributes[?] = ''",
+			wantArgs: []interface{}{"key"},
+		},
+		{
+			name:     "in",
+			input:    "key=[a,b]",
+			targets:  []Target{attribute},
+			wantSQL:  "SpanAttributes[?] IN (?, ?)",
+			wantArgs: []interface{}{"key", "a", "b"},
+		},
+		{
+			name:     "typed in",
+			input:    "http.status_code=[500,503]",
+			targets:  []Target{statusCode},
+			wantSQL:  "toInt64OrNull(SpanAttributes[?]) IN (?, ?)",
+			wantArgs: []interface{}{"http.status_code", int64(500), int64(503)},
+		},
+		{
+			name:     "typed in falls back to strings",
+			input:    "http.status_code=[500,5xx]",
+			targets:  []Target{statusCode},
+			wantSQL:  "SpanAttributes[?] IN (?, ?)",
+			wantArgs: []interface{}{"http.status_code", "500", "5xx"},
+		},
+		{
+			name:     "not in",
+			input:    "key!=[a]",
+			targets:  []Target{attribute},
+			wantSQL:  "SpanAttributes[?] NOT IN (?)",
+			wantArgs: []interface{}{"key", "a"},
+		},
+		{
+			name:  "any target",
+			input: "key=value",
+			targets: []Target{
+				{Expression: "SpanAttributes[?]", Args: []interface{}{"key"}},
+				{Expression: "ResourceAttributes[?]", Args: []interface{}{"key"}},
+			},
+			wantSQL:  "(SpanAttributes[?] = ? OR ResourceAttributes[?] = ?)",
+			wantArgs: []interface{}{"key", "value", "key", "value"},
+		},
+		{
+			name:  "negated on all targets",
+			input: "!key",
+			targets: []Target{
+				{Expression: "SpanAttributes[?]", Args: []interface{}{"key"}},
+				{Expression: "ResourceAttributes[?]", Args: []interface{}{"key"}},
+			},
+			wantSQL:  "(SpanAttributes[?] = '' AND ResourceAttributes[?] = '')",
+			wantArgs: []interface{}{"key", "key"},
+		},
+		{
+			name:     "typed not equal",
+			input:    "http.status_code!=500",
+			targets:  []Target{statusCode},
+			wantSQL:  "ifNull(toInt64OrNull(SpanAttributes[?]) != ?, 1)",
+			wantArgs: []interface{}{"http.status_code", int64(500)},
+		},
+		{
+			name:  "typed negated on all targets",
+			input: "http.status_code!=500",
+			targets: []Target{
+				{Expression: "SpanAttributes[?]", Args: []interface{}{"http.status_code"}, Type: attributes.TypeInt64},
+				{Expression: "ResourceAttributes[?]", Args: []interface{}{"http.status_code"}, Type: attributes.TypeInt64},
+			},
+			wantSQL:  "(ifNull(toInt64OrNull(SpanAttributes[?]) != ?, 1) AND ifNull(toInt64OrNull(ResourceAttributes[?]) != ?, 1))",
+			wantArgs: []interface{}{"http.status_code", int64(500), "http.status_code", int64(500)},
+		},
+		{
+			name:  "typed not in on all targets",
+			input: "http.status_code!=[500,502.5]",
+			targets: []Target{
+				{Expression: "SpanAttributes[?]", Args: []interface{}{"http.status_code"}, Type: attributes.TypeInt64},
+				{Expression: "ResourceAttributes[?]", Args: []interface{}{"http.status_code"}, Type: attributes.TypeInt64},
+			},
+			wantSQL:  "(ifNull(toFloat64OrNull(SpanAttributes[?]) NOT IN (?, ?), 1) AND ifNull(toFloat64OrNull(ResourceAttributes[?]) NOT IN (?, ?), 1))",
+			wantArgs: []interface{}{"http.status_code", 500.0, 502.5, "http.status_code", 500.0, 502.5},
+		},
+		{
+			name:    "no targets",
+			input:   "key=value",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := Parse(tt.input)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			gotSQL, gotArgs, err := Compile(expr, tt.targets)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantSQL, gotSQL)
+			assert.Equal(t, tt.wantArgs, gotArgs)
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package store
+
+import (
+	"fmt"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/attributes"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/clickhousestore"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Tags used by Jaeger to represent OpenTelemetry span fields, as defined by the
+// OpenTelemetry to Jaeger translation specification:
+// * https://opentelemetry.io/docs/specs/otel/trace/sdk_exporters/jaeger/
+const (
+	tagSpanKind          = "span.kind"
+	tagStatusCode        = "otel.status_code"
+	tagStatusDescription = "otel.status_description"
+	tagScopeName         = "otel.scope.name"
+	tagScopeVersion      = "otel.scope.version"
+	tagLibraryName       = "otel.library.name"
+	tagLibraryVersion    = "otel.library.version"
+	tagTraceState        = "w3c.tracestate"
+	tagError             = "error"
+	logFieldEvent        = "event"
+
+	statusCodePrefix = "STATUS_CODE_"
+	statusCodeUnset  = "STATUS_CODE_UNSET"
+	statusCodeError  = "STATUS_CODE_ERROR"
+
+	spanKindPrefix      = "SPAN_KIND_"
+	spanKindUnspecified = "SPAN_KIND_UNSPECIFIED"
+)
+
+const (
+	eventNameException = "exception"
+
+	eventAttributeExceptionType       = "exception.type"
+	eventAttributeExceptionMessage    = "exception.message"
+	eventAttributeExceptionStacktrace = "exception.stacktrace"
+
+	logFieldErrorKind = "error.kind"
+	logFieldMessage   = "message"
+	logFieldStack     = "stack"
+)
+
+// eventAttributesToLogFields maps OpenTelemetry exception semantic conventions onto the
+// log fields Jaeger and OpenTracing instrumentations use for errors.
+var eventAttributesToLogFields = map[string]string{
+	eventAttributeExceptionType:       logFieldErrorKind,
+	eventAttributeExceptionMessage:    logFieldMessage,
+	eventAttributeExceptionStacktrace: logFieldStack,
+}
+
+// logFieldsToEventAttributes reverses eventAttributesToLogFields for exception events.
+var logFieldsToEventAttributes = map[string]string{
+	logFieldErrorKind: eventAttributeExceptionType,
+	logFieldMessage:   eventAttributeExceptionMessage,
+	logFieldStack:     eventAttributeExceptionStacktrace,
+}
+
+// convertSpanTags converts the attributes of a span into typed Jaeger tags, followed by the
+// tags representing the span kind, status, instrumentation scope and trace state. These are
+// left out when an attribute of the same key exists, like the error and span.kind tags of
+// spans written by Jaeger clients, so that tags are not repeated.
+func convertSpanTags(sp *clickhousestore.ClickhouseOtelSpan, types *attributes.Types) []model.KeyValue {
+	tags := make([]model.KeyValue, 0, len(sp.SpanAttributes)+7)
+
+	keys := make([]string, 0, len(sp.SpanAttributes))
+	for key := range sp.SpanAttributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		tags = append(tags, types.KeyValue(key, sp.SpanAttributes[key]))
+	}
+
+	appendTag := func(tag model.KeyValue) {
+		if _, ok := sp.SpanAttributes[tag.Key]; !ok {
+			tags = append(tags, tag)
+		}
+	}
+
+	if kind := convertSpanKind(sp.SpanKind); kind != "" {
+		appendTag(model.String(tagSpanKind, kind))
+	}
+
+	if code := convertStatusCode(sp.StatusCode); code != "" {
+		appendTag(model.String(tagStatusCode, code))
+		if code == "ERROR" {
+			appendTag(model.Bool(tagError, true))
+		}
+	}
+
+	if sp.StatusMessage != "" {
+		appendTag(model.String(tagStatusDescription, sp.StatusMessage))
+	}
+
+	if sp.ScopeName != "" {
+		appendTag(model.String(tagScopeName, sp.ScopeName))
+	}
+
+	if sp.ScopeVersion != "" {
+		appendTag(model.String(tagScopeVersion, sp.ScopeVersion))
+	}
+
+	if sp.TraceState != "" {
+		appendTag(model.String(tagTraceState, sp.TraceState))
+	}
+
+	return tags
+}
+
+// convertProcess converts the service name and resource attributes of a span into a
+// Jaeger process with tags sorted by key, so that identical resources hash identically.
+func convertProcess(sp *clickhousestore.ClickhouseOtelSpan, types *attributes.Types) *model.Process {
+	tags := make(model.KeyValues, 0, len(sp.ResourceAttributes))
+	for key, value := range sp.ResourceAttributes {
+		tags = append(tags, types.KeyValue(key, value))
+	}
+	tags.Sort()
+
+	return model.NewProcess(sp.ServiceName, tags)
+}
+
+// processTable deduplicates the processes of a trace by their hash, so that spans sharing
+// a resource share a single process and process ID, which are listed once in the process
+// map of the trace. Spans still carry their process, as the storage plugin protocol only
+// streams the spans of a trace to Jaeger Query, which drops the process map and would
+// otherwise show spans without a service.
+type processTable struct {
+	ids       map[uint64][]string
+	processes map[string]*model.Process
+	mappings  []model.Trace_ProcessMapping
+}
+
+func newProcessTable() *processTable {
+	return &processTable{
+		ids:       map[uint64][]string{},
+		processes: map[string]*model.Process{},
+	}
+}
+
+// add returns the ID and the shared instance of a process, registering it if no equal
+// process has been added before.
+func (t *processTable) add(process *model.Process) (string, *model.Process, error) {
+	hash, err := model.HashCode(process)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, id := range t.ids[hash] {
+		if t.processes[id].Equal(process) {
+			return id, t.processes[id], nil
+		}
+	}
+
+	id := fmt.Sprintf("p%d", len(t.mappings)+1)
+	t.ids[hash] = append(t.ids[hash], id)
+	t.processes[id] = process
+	t.mappings = append(t.mappings, model.Trace_ProcessMapping{ProcessID: id, Process: *process})
+
+	return id, process, nil
+}
+
+// convertSpanKind converts a span kind as stored by the exporter, either "SPAN_KIND_SERVER"
+// or "Server" depending on its version, into the lowercase Jaeger representation. An
+// unspecified kind results in an empty string.
+func convertSpanKind(kind string) string {
+	kind = strings.ToLower(strings.TrimPrefix(strings.ToUpper(kind), spanKindPrefix))
+	if kind == "unspecified" {
+		return ""
+	}
+	return kind
+}
+
+// convertStatusCode converts a status code as stored by the exporter, either
+// "STATUS_CODE_ERROR" or "Error" depending on its version, into "OK" or "ERROR". An
+// unset status results in an empty string.
+func convertStatusCode(code string) string {
+	code = strings.TrimPrefix(strings.ToUpper(code), statusCodePrefix)
+	if code == "UNSET" {
+		return ""
+	}
+	return code
+}
+
+// convertEventsToLogs converts the Events.* columns of a span into Jaeger logs. Each log
+// only carries the attributes of its own event. The columns are expected to have the
+// same length, but malformed rows are tolerated by converting only the events that
+// have both a name and a timestamp.
+func convertEventsToLogs(timestamps []time.Time, names []string, eventsAttributes []map[string]string, types *attributes.Types) []model.Log {
+	count := len(names)
+	if len(timestamps) < count {
+		count = len(timestamps)
+	}
+
+	if count == 0 {
+		return nil
+	}
+
+	logs := make([]model.Log, 0, count)
+	for idx := 0; idx < count; idx++ {
+		var eventAttributes map[string]string
+		if idx < len(eventsAttributes) {
+			eventAttributes = eventsAttributes[idx]
+		}
+
+		fields := make([]model.KeyValue, 0, len(eventAttributes)+1)
+		fields = append(fields, model.String(logFieldEvent, names[idx]))
+
+		keys := make([]string, 0, len(eventAttributes))
+		for key := range eventAttributes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			field := types.KeyValue(key, eventAttributes[key])
+			if logKey, ok := eventAttributesToLogFields[key]; ok {
+				field.Key = logKey
+			}
+			fields = append(fields, field)
+		}
+
+		logs = append(logs, model.Log{
+			Timestamp: timestamps[idx],
+			Fields:    fields,
+		})
+	}
+
+	return logs
+}
+
+// eventsAreMalformed reports whether the Events.* columns of a span differ in length.
+func eventsAreMalformed(timestamps []time.Time, names []string, attributes []map[string]string) bool {
+	return len(timestamps) != len(names) || (len(attributes) != 0 && len(attributes) != len(names))
+}
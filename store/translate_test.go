@@ -0,0 +1,203 @@
+package store
+
+import (
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/attributes"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/clickhousestore"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_convertEventsToLogs(t *testing.T) {
+	timestamp := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		timestamps []time.Time
+		names      []string
+		attributes []map[string]string
+		want       []model.Log
+	}{
+		{
+			name: "no events",
+			want: nil,
+		},
+		{
+			name:       "attributes are attached to their own event",
+			timestamps: []time.Time{timestamp, timestamp.Add(time.Second)},
+			names:      []string{"cache.miss", "cache.fill"},
+			attributes: []map[string]string{{"cache.key": "a"}, {"cache.size": "10"}},
+			want: []model.Log{
+				{Timestamp: timestamp, Fields: []model.KeyValue{model.String("event", "cache.miss"), model.String("cache.key", "a")}},
+				{Timestamp: timestamp.Add(time.Second), Fields: []model.KeyValue{model.String("event", "cache.fill"), model.String("cache.size", "10")}},
+			},
+		},
+		{
+			name:       "exception attributes are mapped to jaeger log fields",
+			timestamps: []time.Time{timestamp},
+			names:      []string{"exception"},
+			attributes: []map[string]string{{
+				"exception.type":       "java.lang.NullPointerException",
+				"exception.message":    "boom",
+				"exception.stacktrace": "at Main.main",
+				"exception.escaped":    "true",
+			}},
+			want: []model.Log{
+				{Timestamp: timestamp, Fields: []model.KeyValue{
+					model.String("event", "exception"),
+					model.Bool("exception.escaped", true),
+					model.String("message", "boom"),
+					model.String("stack", "at Main.main"),
+					model.String("error.kind", "java.lang.NullPointerException"),
+				}},
+			},
+		},
+		{
+			name:       "missing timestamps are skipped",
+			timestamps: []time.Time{timestamp},
+			names:      []string{"first", "second"},
+			attributes: []map[string]string{{}, {}},
+			want: []model.Log{
+				{Timestamp: timestamp, Fields: []model.KeyValue{model.String("event", "first")}},
+			},
+		},
+		{
+			name:       "missing attributes are tolerated",
+			timestamps: []time.Time{timestamp, timestamp},
+			names:      []string{"first", "second"},
+			attributes: []map[string]string{{"key": "value"}},
+			want: []model.Log{
+				{Timestamp: timestamp, Fields: []model.KeyValue{model.String("event", "first"), model.String("key", "value")}},
+				{Timestamp: timestamp, Fields: []model.KeyValue{model.String("event", "second")}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, convertEventsToLogs(tt.timestamps, tt.names, tt.attributes, attributes.NewTypes(nil)))
+		})
+	}
+}
+
+func Test_convertSpanTags(t *testing.T) {
+	tests := []struct {
+		name string
+		span clickhousestore.ClickhouseOtelSpan
+		want []model.KeyValue
+	}{
+		{
+			name: "empty span",
+			span: clickhousestore.ClickhouseOtelSpan{
+				SpanKind:   "SPAN_KIND_UNSPECIFIED",
+				StatusCode: "STATUS_CODE_UNSET",
+			},
+			want: []model.KeyValue{},
+		},
+		{
+			name: "attributes are sorted by key",
+			span: clickhousestore.ClickhouseOtelSpan{
+				SpanAttributes: map[string]string{"b": "2", "a": "1"},
+			},
+			want: []model.KeyValue{model.String("a", "1"), model.String("b", "2")},
+		},
+		{
+			name: "attributes are typed",
+			span: clickhousestore.ClickhouseOtelSpan{
+				SpanAttributes: map[string]string{"http.status_code": "500", "http.method": "GET"},
+			},
+			want: []model.KeyValue{model.String("http.method", "GET"), model.Int64("http.status_code", 500)},
+		},
+		{
+			name: "span kind",
+			span: clickhousestore.ClickhouseOtelSpan{SpanKind: "SPAN_KIND_SERVER"},
+			want: []model.KeyValue{model.String("span.kind", "server")},
+		},
+		{
+			name: "span kind from newer exporter versions",
+			span: clickhousestore.ClickhouseOtelSpan{SpanKind: "Consumer"},
+			want: []model.KeyValue{model.String("span.kind", "consumer")},
+		},
+		{
+			name: "ok status",
+			span: clickhousestore.ClickhouseOtelSpan{StatusCode: "STATUS_CODE_OK"},
+			want: []model.KeyValue{model.String("otel.status_code", "OK")},
+		},
+		{
+			name: "error status without attributes",
+			span: clickhousestore.ClickhouseOtelSpan{StatusCode: "STATUS_CODE_ERROR", StatusMessage: "boom"},
+			want: []model.KeyValue{
+				model.String("otel.status_code", "ERROR"),
+				model.Bool("error", true),
+				model.String("otel.status_description", "boom"),
+			},
+		},
+		{
+			name: "error status from newer exporter versions",
+			span: clickhousestore.ClickhouseOtelSpan{StatusCode: "Error"},
+			want: []model.KeyValue{
+				model.String("otel.status_code", "ERROR"),
+				model.Bool("error", true),
+			},
+		},
+		{
+			name: "attributes of the same key as synthesized tags",
+			span: clickhousestore.ClickhouseOtelSpan{
+				SpanAttributes: map[string]string{"error": "true", "span.kind": "client"},
+				SpanKind:       "SPAN_KIND_CLIENT",
+				StatusCode:     "STATUS_CODE_ERROR",
+			},
+			want: []model.KeyValue{
+				model.String("error", "true"),
+				model.String("span.kind", "client"),
+				model.String("otel.status_code", "ERROR"),
+			},
+		},
+		{
+			name: "scope and trace state",
+			span: clickhousestore.ClickhouseOtelSpan{
+				ScopeName:    "net/http",
+				ScopeVersion: "1.0.0",
+				TraceState:   "congo=t61rcWkgMzE",
+			},
+			want: []model.KeyValue{
+				model.String("otel.scope.name", "net/http"),
+				model.String("otel.scope.version", "1.0.0"),
+				model.String("w3c.tracestate", "congo=t61rcWkgMzE"),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, convertSpanTags(&tt.span, attributes.NewTypes(nil)))
+		})
+	}
+}
+
+func Test_processTable(t *testing.T) {
+	table := newProcessTable()
+
+	spans := []clickhousestore.ClickhouseOtelSpan{
+		{ServiceName: "frontend", ResourceAttributes: map[string]string{"host.name": "a", "os.type": "linux"}},
+		{ServiceName: "frontend", ResourceAttributes: map[string]string{"os.type": "linux", "host.name": "a"}},
+		{ServiceName: "frontend", ResourceAttributes: map[string]string{"host.name": "b", "os.type": "linux"}},
+		{ServiceName: "backend"},
+	}
+
+	ids := make([]string, 0, len(spans))
+	processes := make([]*model.Process, 0, len(spans))
+	for _, sp := range spans {
+		id, process, err := table.add(convertProcess(&sp, attributes.NewTypes(nil)))
+		assert.NoError(t, err)
+		ids = append(ids, id)
+		processes = append(processes, process)
+	}
+
+	assert.Equal(t, []string{"p1", "p1", "p2", "p3"}, ids)
+	assert.Same(t, processes[0], processes[1])
+	assert.Equal(t, 3, len(table.mappings))
+	assert.Equal(t, "backend", table.mappings[2].Process.ServiceName)
+	assert.Equal(t, []model.KeyValue{}, table.mappings[2].Process.Tags)
+}
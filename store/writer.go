@@ -0,0 +1,117 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/clickhousestore"
+	"go.opentelemetry.io/otel/attribute"
+	"strings"
+)
+
+func (s *Store) WriteSpan(ctx context.Context, span *model.Span) error {
+	ctx, sp := s.tracer.Start(ctx, "grpc:WriteSpan")
+	sp.SetAttributes(attribute.String("trace-id", span.TraceID.String()))
+	defer sp.End()
+
+	return statusError(s.writer.WriteSpan(ctx, convertJaegerToClickhouseSpan(span)))
+}
+
+// convertJaegerToClickhouseSpan maps a Jaeger span onto the schema of the OpenTelemetry
+// Clickhouse exporter. Tags that Jaeger uses to represent OpenTelemetry span fields are
+// moved back into their dedicated columns instead of being stored as attributes.
+func convertJaegerToClickhouseSpan(span *model.Span) *clickhousestore.ClickhouseOtelSpan {
+	chSpan := &clickhousestore.ClickhouseOtelSpan{
+		Timestamp:      span.StartTime,
+		TraceID:        fullTraceIDString(span.TraceID),
+		SpanID:         span.SpanID.String(),
+		SpanName:       span.OperationName,
+		SpanKind:       spanKindUnspecified,
+		SpanAttributes: make(map[string]string, len(span.Tags)),
+		Duration:       span.Duration.Nanoseconds(),
+		StatusCode:     statusCodeUnset,
+	}
+
+	// The first parent reference within the same trace becomes the parent span, while
+	// every other reference is recorded as a link.
+	for _, ref := range span.References {
+		if chSpan.ParentSpanID == "" && ref.RefType == model.ChildOf && ref.TraceID == span.TraceID {
+			chSpan.ParentSpanID = ref.SpanID.String()
+			continue
+		}
+		chSpan.LinksTraceID = append(chSpan.LinksTraceID, fullTraceIDString(ref.TraceID))
+		chSpan.LinksSpanID = append(chSpan.LinksSpanID, ref.SpanID.String())
+		chSpan.LinksTraceState = append(chSpan.LinksTraceState, "")
+		chSpan.LinksAttributes = append(chSpan.LinksAttributes, map[string]string{})
+	}
+
+	isError := false
+	for _, tag := range span.Tags {
+		switch tag.Key {
+		case tagSpanKind:
+			chSpan.SpanKind = spanKindPrefix + strings.ToUpper(tag.AsString())
+		case tagStatusCode:
+			chSpan.StatusCode = statusCodePrefix + strings.ToUpper(tag.AsString())
+		case tagStatusDescription:
+			chSpan.StatusMessage = tag.AsString()
+		case tagScopeName, tagLibraryName:
+			chSpan.ScopeName = tag.AsString()
+		case tagScopeVersion, tagLibraryVersion:
+			chSpan.ScopeVersion = tag.AsString()
+		case tagTraceState:
+			chSpan.TraceState = tag.AsString()
+		case tagError:
+			// Instrumentations set the error tag as a bool or as the string "true"
+			isError = strings.EqualFold(tag.AsString(), "true")
+		default:
+			chSpan.SpanAttributes[tag.Key] = tag.AsString()
+		}
+	}
+
+	if isError && chSpan.StatusCode == statusCodeUnset {
+		chSpan.StatusCode = statusCodeError
+	}
+
+	if span.Process != nil {
+		chSpan.ServiceName = span.Process.ServiceName
+		chSpan.ResourceAttributes = make(map[string]string, len(span.Process.Tags))
+		for _, tag := range span.Process.Tags {
+			chSpan.ResourceAttributes[tag.Key] = tag.AsString()
+		}
+	}
+
+	for _, log := range span.Logs {
+		name := ""
+		attributes := make(map[string]string, len(log.Fields))
+		for _, field := range log.Fields {
+			if field.Key == logFieldEvent && name == "" {
+				name = field.AsString()
+				continue
+			}
+			attributes[field.Key] = field.AsString()
+		}
+
+		// Exception attributes read as Jaeger error log fields are stored under their
+		// OpenTelemetry names again, so that archived traces read the same
+		if name == eventNameException {
+			for logKey, attributeKey := range logFieldsToEventAttributes {
+				if value, ok := attributes[logKey]; ok {
+					delete(attributes, logKey)
+					attributes[attributeKey] = value
+				}
+			}
+		}
+
+		chSpan.EventsTimestamp = append(chSpan.EventsTimestamp, log.Timestamp)
+		chSpan.EventsName = append(chSpan.EventsName, name)
+		chSpan.EventsAttributes = append(chSpan.EventsAttributes, attributes)
+	}
+
+	return chSpan
+}
+
+// fullTraceIDString formats a trace ID using all 32 hex characters as the OpenTelemetry
+// Clickhouse exporter does, including 64-bit trace IDs.
+func fullTraceIDString(traceID model.TraceID) string {
+	return fmt.Sprintf("%016x%016x", traceID.High, traceID.Low)
+}
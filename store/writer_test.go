@@ -0,0 +1,109 @@
+package store
+
+import (
+	"context"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/nextrevision/jaeger-otel-clickhouse-backend/store/clickhousestore"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace/noop"
+	"testing"
+	"time"
+)
+
+func TestStore_WriteSpan(t *testing.T) {
+	mockWriter := clickhousestore.NewMockClickhouseWriter()
+	tracer := noop.Tracer{}
+
+	store := New(clickhousestore.NewMockClickhouseReader(2), mockWriter, tracer)
+	ctx := context.Background()
+
+	traceID := model.NewTraceID(0, 0xc91fd0eb7e1193f8)
+	linkedTraceID := model.NewTraceID(1, 2)
+	startTime := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	span := &model.Span{
+		TraceID:       traceID,
+		SpanID:        model.NewSpanID(2),
+		OperationName: "GET /",
+		StartTime:     startTime,
+		Duration:      time.Second,
+		References: []model.SpanRef{
+			model.NewChildOfRef(traceID, model.NewSpanID(1)),
+			model.NewFollowsFromRef(linkedTraceID, model.NewSpanID(3)),
+		},
+		Tags: []model.KeyValue{
+			model.String("span.kind", "server"),
+			model.String("otel.scope.name", "net/http"),
+			model.String("otel.status_description", "boom"),
+			model.Bool("error", true),
+			model.Int64("http.status_code", 500),
+		},
+		Logs: []model.Log{
+			{
+				Timestamp: startTime,
+				Fields: []model.KeyValue{
+					model.String("event", "exception"),
+					model.String("error.kind", "RuntimeError"),
+					model.String("message", "boom"),
+				},
+			},
+		},
+		Process: model.NewProcess("test-server", []model.KeyValue{model.String("host.name", "localhost")}),
+	}
+
+	err := store.WriteSpan(ctx, span)
+	if err != nil {
+		t.Errorf("Store.WriteSpan() error = %v", err)
+		return
+	}
+
+	assert.Equal(t, 1, len(mockWriter.Spans))
+	got := mockWriter.Spans[0]
+	assert.Equal(t, "0000000000000000c91fd0eb7e1193f8", got.TraceID)
+	assert.Equal(t, "0000000000000002", got.SpanID)
+	assert.Equal(t, "0000000000000001", got.ParentSpanID)
+	assert.Equal(t, "GET /", got.SpanName)
+	assert.Equal(t, "SPAN_KIND_SERVER", got.SpanKind)
+	assert.Equal(t, "net/http", got.ScopeName)
+	assert.Equal(t, "STATUS_CODE_ERROR", got.StatusCode)
+	assert.Equal(t, "boom", got.StatusMessage)
+	assert.Equal(t, int64(time.Second), got.Duration)
+	assert.Equal(t, "test-server", got.ServiceName)
+	assert.Equal(t, map[string]string{"host.name": "localhost"}, got.ResourceAttributes)
+	assert.Equal(t, map[string]string{"http.status_code": "500"}, got.SpanAttributes)
+	assert.Equal(t, []string{"exception"}, got.EventsName)
+	assert.Equal(t, []map[string]string{{"exception.type": "RuntimeError", "exception.message": "boom"}}, got.EventsAttributes)
+	assert.Equal(t, []string{"00000000000000010000000000000002"}, got.LinksTraceID)
+	assert.Equal(t, []string{"0000000000000003"}, got.LinksSpanID)
+}
+
+func TestStore_Close(t *testing.T) {
+	mockWriter := clickhousestore.NewMockClickhouseWriter()
+	tracer := noop.Tracer{}
+
+	store := New(clickhousestore.NewMockClickhouseReader(2), mockWriter, tracer)
+
+	assert.NoError(t, store.Close())
+	assert.True(t, mockWriter.Closed)
+}
+
+func Test_convertJaegerToClickhouseSpan_errorTag(t *testing.T) {
+	tests := []struct {
+		name string
+		tag  model.KeyValue
+		want string
+	}{
+		{name: "bool", tag: model.Bool("error", true), want: "STATUS_CODE_ERROR"},
+		{name: "string", tag: model.String("error", "true"), want: "STATUS_CODE_ERROR"},
+		{name: "uppercase string", tag: model.String("error", "TRUE"), want: "STATUS_CODE_ERROR"},
+		{name: "false", tag: model.Bool("error", false), want: "STATUS_CODE_UNSET"},
+		{name: "false string", tag: model.String("error", "false"), want: "STATUS_CODE_UNSET"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := convertJaegerToClickhouseSpan(&model.Span{Tags: []model.KeyValue{tt.tag}})
+			assert.Equal(t, tt.want, got.StatusCode)
+		})
+	}
+}